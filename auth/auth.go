@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/tlog"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// Authenticator checks client credentials and returns credentials
+	// to use for the upstream connections.
+	// Failure is returned as *click.Exception.
+	Authenticator interface {
+		Authenticate(ctx context.Context, creds click.Credentials, remote net.Addr) (upstream click.Credentials, err error)
+	}
+
+	// Static authenticates users from the static list.
+	Static struct {
+		Users map[string]*User `yaml:"users"`
+	}
+
+	User struct {
+		// Only one of them is checked in that order.
+		// No password is allowed if none is set.
+		PasswordBcrypt string `yaml:"password_bcrypt"`
+		PasswordSHA256 string `yaml:"password_sha256_hex"`
+		Password       string `yaml:"password"`
+
+		// Networks client is allowed to connect from.
+		// IPs and CIDRs. Any network is allowed if empty.
+		Networks []string `yaml:"networks"`
+
+		// Upstream credentials. Client ones are used if not set.
+		Upstream *Upstream `yaml:"upstream"`
+
+		nets []*net.IPNet
+	}
+
+	Upstream struct {
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+		Database string `yaml:"database"`
+	}
+)
+
+var _ Authenticator = &Static{}
+
+// LoadFile loads Static users from yaml file.
+func LoadFile(name string) (*Static, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+
+	return Parse(data)
+}
+
+// Parse parses Static users yaml.
+func Parse(data []byte) (s *Static, err error) {
+	s = &Static{}
+
+	err = yaml.Unmarshal(data, s)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+
+	for name, u := range s.Users {
+		if u == nil {
+			u = &User{}
+			s.Users[name] = u
+		}
+
+		err = u.parse()
+		if err != nil {
+			return nil, errors.Wrap(err, "user %v", name)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Static) Authenticate(ctx context.Context, creds click.Credentials, remote net.Addr) (up click.Credentials, err error) {
+	u, ok := s.Users[creds.User]
+
+	var reason string
+
+	switch {
+	case !ok:
+		reason = "no such user"
+	case !u.allowed(remote):
+		reason = "network is not allowed"
+	case !u.checkPassword(creds.Password):
+		reason = "wrong password"
+	}
+
+	if reason != "" {
+		tlog.SpanFromContext(ctx).Printw("authentication failed", "user", creds.User, "remote", remote, "reason", reason)
+
+		return up, &click.Exception{
+			Code:    click.AUTHENTICATION_FAILED,
+			Name:    "DB::Exception",
+			Message: creds.User + ": Authentication failed: password is incorrect, or there is no user with such name.",
+		}
+	}
+
+	up = creds
+
+	if x := u.Upstream; x != nil {
+		if x.User != "" {
+			up.User = x.User
+			up.Password = x.Password
+		}
+
+		if x.Database != "" {
+			up.Database = x.Database
+		}
+	}
+
+	return up, nil
+}
+
+func (u *User) parse() error {
+	if u.PasswordSHA256 != "" {
+		h, err := hex.DecodeString(u.PasswordSHA256)
+		if err != nil || len(h) != sha256.Size {
+			return errors.New("bad password_sha256_hex")
+		}
+	}
+
+	for _, n := range u.Networks {
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return errors.New("bad network: %v", n)
+			}
+
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+
+			u.nets = append(u.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return errors.Wrap(err, "network")
+		}
+
+		u.nets = append(u.nets, ipnet)
+	}
+
+	return nil
+}
+
+func (u *User) checkPassword(p string) bool {
+	switch {
+	case u.PasswordBcrypt != "":
+		return bcrypt.CompareHashAndPassword([]byte(u.PasswordBcrypt), []byte(p)) == nil
+	case u.PasswordSHA256 != "":
+		h := sha256.Sum256([]byte(p))
+
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(strings.ToLower(u.PasswordSHA256))) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(u.Password), []byte(p)) == 1
+	}
+}
+
+func (u *User) allowed(remote net.Addr) bool {
+	if len(u.nets) == 0 {
+		return true
+	}
+
+	ip := addrIP(remote)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range u.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+
+	h, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		h = a.String()
+	}
+
+	return net.ParseIP(h)
+}
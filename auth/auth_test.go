@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestStatic(t *testing.T) {
+	ctx := context.Background()
+
+	bc, err := bcrypt.GenerateFromPassword([]byte("bpass"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	sh := sha256.Sum256([]byte("spass"))
+
+	s, err := Parse([]byte(`
+users:
+  alice:
+    password_sha256_hex: ` + hex.EncodeToString(sh[:]) + `
+    networks: [10.0.0.0/8, 127.0.0.1]
+  bob:
+    password_bcrypt: ` + string(bc) + `
+    upstream:
+      user: writer
+      password: secret
+      database: logs
+  guest:
+`))
+	require.NoError(t, err)
+
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1000}
+
+	up, err := s.Authenticate(ctx, click.Credentials{User: "alice", Password: "spass", Database: "db"}, local)
+	assert.NoError(t, err)
+	assert.Equal(t, click.Credentials{User: "alice", Password: "spass", Database: "db"}, up)
+
+	up, err = s.Authenticate(ctx, click.Credentials{User: "bob", Password: "bpass", Database: "default"}, remote)
+	assert.NoError(t, err)
+	assert.Equal(t, click.Credentials{User: "writer", Password: "secret", Database: "logs"}, up)
+
+	_, err = s.Authenticate(ctx, click.Credentials{User: "guest"}, remote)
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		creds click.Credentials
+		addr  net.Addr
+	}{
+		{click.Credentials{User: "alice", Password: "spass"}, remote},
+		{click.Credentials{User: "alice", Password: "bad"}, local},
+		{click.Credentials{User: "bob", Password: "spass"}, remote},
+		{click.Credentials{User: "guest", Password: "x"}, remote},
+		{click.Credentials{User: "eve"}, remote},
+	} {
+		_, err = s.Authenticate(ctx, tc.creds, tc.addr)
+
+		var exc *click.Exception
+		if assert.ErrorAs(t, err, &exc, "%+v", tc.creds) {
+			assert.Equal(t, int32(click.AUTHENTICATION_FAILED), exc.Code)
+		}
+	}
+
+	_, err = Parse([]byte("users: {a: {networks: [bad]}}"))
+	assert.Error(t, err)
+}
@@ -2,6 +2,8 @@ package batcher
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,6 +14,11 @@ import (
 )
 
 type (
+	// Batcher merges INSERTs with the same query, settings and credentials
+	// and commits them together.
+	// Batch is flushed when it reaches MaxRows or MaxBytes
+	// or when MaxInterval has passed since its first row.
+	// With AckWait clients wait for the flush, so MaxInterval is their added latency.
 	Batcher struct {
 		pool click.ClientPool
 
@@ -19,50 +26,116 @@ type (
 		MaxBytes    int64
 		MaxInterval time.Duration
 
-		mu sync.Mutex
-		bs map[key]*batch
+		// Ack is the default acknowledgement mode.
+		// TableAck overrides it by db.table or table name.
+		// Query settings override both: async_insert=0 means AckWait,
+		// async_insert=1 takes the mode from wait_for_async_insert if it's set.
+		Ack      AckMode
+		TableAck map[string]AckMode
+
+		// Failed async commits are retried with exponential backoff up to a minute.
+		// Exceptions are not retried.
+		// Inserts wait while pending rows are over MaxRows or MaxBytes.
+		MaxRetries   int
+		RetryBackoff time.Duration
+
+		ctx context.Context
+
+		mu     sync.Mutex
+		bs     map[key]*batch
+		closed bool
+		stopc  chan struct{}
+		wg     sync.WaitGroup
 
 		now func() time.Time
 	}
 
 	key struct {
-		creds click.Credentials
-		q     string
+		creds    click.Credentials
+		q        string
+		settings string
+		quota    string
 	}
 
 	batch struct {
+		k    key
 		q    *click.Query
 		meta click.QueryMeta
 
-		block *click.Block
+		types []click.ColType
 
 		opts []click.ClientOption
+		ack  AckMode
+
+		// rows waiting for the flush
+		cur *pending
+
+		signal  chan struct{}
+		stopped bool
 
 		tr tlog.Span
 	}
 
+	// pending rows are committed together.
+	// Block columns are fixed when it's created, table structure may change later.
+	pending struct {
+		block *click.Block
+		types []click.ColType
+		bytes int64
+		first time.Time
+
+		done chan struct{}
+		err  error
+	}
+
 	client struct {
 		p *Batcher
 		b *batch
 
 		blocks []*click.Block
 
+		// rows to wait for and their commit error
+		pd  *pending
+		err error
+
 		click.Client
 
 		creds click.Credentials
 		opts  []click.ClientOption
 	}
+
+	// AckMode is when the client INSERT is acknowledged.
+	AckMode uint8
+)
+
+// Ack modes.
+const (
+	// AckWait holds the client until its rows are committed, errors are passed back.
+	AckWait AckMode = iota
+
+	// AckAsync acknowledges when rows are buffered, failures are logged and retried.
+	AckAsync
 )
 
+var ErrClosed = errors.New("batcher closed")
+
+const maxRetryBackoff = time.Minute
+
 func New(ctx context.Context, cl click.ClientPool) (p *Batcher) {
 	p = &Batcher{
 		pool: cl,
 
 		MaxRows:     1000000,
-		MaxBytes:    100 << 20, // 100MiB
-		MaxInterval: 1 * time.Minute,
+		MaxBytes:    100 << 20,   // 100MiB
+		MaxInterval: time.Second, // the same as ClickHouse async_insert_busy_timeout_ms
+
+		MaxRetries:   3,
+		RetryBackoff: time.Second,
+
+		ctx: ctx,
 
-		bs: make(map[key]*batch),
+		bs:    make(map[key]*batch),
+		stopc: make(chan struct{}),
 
 		now: time.Now,
 	}
@@ -91,37 +164,92 @@ func (p *Batcher) Get(ctx context.Context, opts ...click.ClientOption) (_ click.
 }
 
 func (p *Batcher) Put(ctx context.Context, cl click.Client, err error) error {
-	return nil
-}
+	c := cl.(*client)
 
-func (p *Batcher) Close() error {
-	// TODO: flush batches
+	if c.Client == nil {
+		return nil
+	}
 
-	return nil
+	return p.pool.Put(ctx, c.Client, err)
 }
 
-func (p *Batcher) batch(ctx context.Context, c *client, q *click.Query) (b *batch, err error) {
-	defer p.mu.Unlock()
+// Close flushes all pending batches and closes the underlying pool.
+func (p *Batcher) Close() (err error) {
 	p.mu.Lock()
 
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+
+	p.closed = true
+	close(p.stopc)
+
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return p.pool.Close()
+}
+
+// batch returns the batch for the query creating it if needed.
+// New batch asks upstream for the table structure, it's done without p.mu held.
+func (p *Batcher) batch(ctx context.Context, c *client, q *click.Query) (b *batch, meta click.QueryMeta, err error) {
 	k := key{
-		creds: c.creds,
-		q:     q.Query,
+		creds:    c.creds,
+		q:        q.Query,
+		settings: q.Settings.Key(),
+		quota:    q.Info.QuotaKey,
 	}
 
-	b, ok := p.bs[k]
-	if ok {
-		return b, nil
+	if k.quota == "" {
+		k.quota = q.QuotaKey // deprecated field
+	}
+
+	b, meta, err = p.lookup(k)
+	if b != nil || err != nil {
+		return b, meta, err
 	}
 
-	b, err = p.newBatch(ctx, c, q)
+	nb, err := p.newBatch(ctx, c, q)
 	if err != nil {
-		return nil, errors.Wrap(err, "new batch")
+		return nil, nil, errors.Wrap(err, "new batch")
 	}
 
-	p.bs[k] = b
+	defer p.mu.Unlock()
+	p.mu.Lock()
 
-	return b, nil
+	if p.closed {
+		nb.tr.Finish()
+		return nil, nil, ErrClosed
+	}
+
+	if b, ok := p.bs[k]; ok { // created concurrently
+		nb.tr.Finish()
+		return b, b.meta, nil
+	}
+
+	nb.k = k
+
+	p.start(nb)
+
+	return nb, nb.meta, nil
+}
+
+func (p *Batcher) lookup(k key) (b *batch, meta click.QueryMeta, err error) {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	if p.closed {
+		return nil, nil, ErrClosed
+	}
+
+	b, ok := p.bs[k]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	return b, b.meta, nil
 }
 
 func (p *Batcher) newBatch(ctx context.Context, c *client, q *click.Query) (b *batch, err error) {
@@ -156,25 +284,111 @@ func (p *Batcher) newBatch(ctx context.Context, c *client, q *click.Query) (b *b
 		return nil, errors.Wrap(err, "get meta")
 	}
 
+	types, err := parseTypes(meta)
+	if err != nil {
+		return nil, err
+	}
+
 	b = &batch{
-		q:    q,
-		meta: meta,
-		block: &click.Block{
-			Cols: make([]click.Column, len(meta)),
-		},
-		opts: c.opts,
+		q:     q,
+		meta:  meta,
+		types: types,
+		opts:  c.opts,
+		ack:   p.ackMode(c, q),
+
+		signal: make(chan struct{}, 1),
 
 		tr: tr,
 	}
 
-	for i, c := range meta {
-		b.block.Cols[i] = click.Column{
-			Name: c.Name,
-			Type: c.Type,
+	return b, nil
+}
+
+// start registers the batch and starts its flusher. p.mu must be held.
+func (p *Batcher) start(b *batch) {
+	b.stopped = false
+	p.bs[b.k] = b
+
+	p.wg.Add(1)
+
+	go p.flusher(b)
+}
+
+// flusher flushes the batch when it's full or MaxInterval has passed since its first row.
+// The batch is removed if no rows were added for MaxInterval.
+func (p *Batcher) flusher(b *batch) {
+	defer p.wg.Done()
+
+	for {
+		p.mu.Lock()
+		pd := b.cur
+		full := pd != nil && p.full(pd)
+		p.mu.Unlock()
+
+		if full {
+			p.flush(b)
+			continue
+		}
+
+		d := p.MaxInterval
+		if pd != nil {
+			d = pd.first.Add(p.MaxInterval).Sub(p.now())
+		}
+
+		t := time.NewTimer(d)
+
+		select {
+		case <-b.signal:
+			t.Stop()
+			continue
+		case <-p.stopc:
+			t.Stop()
+			p.flush(b)
+
+			b.tr.Finish()
+
+			return
+		case <-t.C:
+		}
+
+		if pd != nil {
+			p.flush(b)
+			continue
+		}
+
+		p.mu.Lock()
+
+		idle := b.cur == nil
+		if idle {
+			delete(p.bs, b.k)
+			b.stopped = true
+		}
+
+		p.mu.Unlock()
+
+		if idle {
+			b.tr.Finish()
+			return
 		}
 	}
+}
 
-	return b, nil
+// full reports whether pending rows must be flushed. p.mu must be held.
+func (p *Batcher) full(pd *pending) bool {
+	return p.over(pd) || p.MaxInterval <= 0
+}
+
+// over reports whether pending rows reached the limits. p.mu must be held.
+func (p *Batcher) over(pd *pending) bool {
+	return p.MaxRows > 0 && pd.block.Rows >= p.MaxRows ||
+		p.MaxBytes > 0 && pd.bytes >= p.MaxBytes
+}
+
+func (b *batch) wakeup() {
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
 }
 
 func (p *Batcher) consumeResponse(ctx context.Context, cl click.Client) (err error) {
@@ -187,16 +401,66 @@ func (p *Batcher) consumeResponse(ctx context.Context, cl click.Client) (err err
 		switch tp {
 		case click.ServerEndOfStream:
 			return nil
+		case click.ServerException:
+			return cl.RecvException(ctx)
+		case click.ServerProgress:
+			_, err = cl.RecvProgress(ctx)
+		case click.ServerProfileInfo:
+			_, err = cl.RecvProfileInfo(ctx)
+		case click.ServerLog, click.ServerProfileEvents:
+			_, err = cl.RecvBlock(ctx, false)
+		case click.ServerTableColumns:
+			_, err = cl.RecvTableColumns(ctx)
 		default:
 			return errors.New("unexpected packet: %x", tp)
 		}
+
+		if err != nil {
+			return errors.Wrap(err, "recv %x", tp)
+		}
 	}
 }
 
-func (p *Batcher) addBlocks(ctx context.Context, batch *batch, blocks []*click.Block) (err error) {
+// addBlocks merges blocks into the batch pending rows.
+// If they are over the limits, the flusher is busy with the previous ones,
+// so it waits for them to be committed.
+func (p *Batcher) addBlocks(ctx context.Context, c *client, blocks []*click.Block) (pd *pending, err error) {
+	for {
+		pd, wait, err := p.appendBlocks(ctx, c, blocks)
+		if wait == nil {
+			return pd, err
+		}
+
+		select {
+		case <-wait.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *Batcher) appendBlocks(ctx context.Context, c *client, blocks []*click.Block) (pd, wait *pending, err error) {
 	defer p.mu.Unlock()
 	p.mu.Lock()
 
+	if p.closed {
+		return nil, nil, ErrClosed
+	}
+
+	batch := c.b
+
+	if batch.stopped {
+		if b, ok := p.bs[batch.k]; ok {
+			batch = b
+		} else {
+			batch.tr = tlog.SpawnFromContext(ctx, "batch", "db", c.creds.Database, "query", batch.q.Query)
+
+			p.start(batch)
+		}
+
+		c.b = batch
+	}
+
 	rows := 0
 	for _, b := range blocks {
 		rows += b.Rows
@@ -204,28 +468,175 @@ func (p *Batcher) addBlocks(ctx context.Context, batch *batch, blocks []*click.B
 
 	batch.tr.Printw("merge blocks", "blocks", len(blocks), "rows", rows, "", tlog.IDFromContext(ctx))
 
-	bb := batch.block
+	if rows == 0 {
+		return nil, nil, nil
+	}
+
+	pd = batch.cur
+
+	if pd != nil && p.over(pd) {
+		batch.wakeup()
+
+		return nil, pd, nil
+	}
+
+	if pd == nil {
+		pd = &pending{
+			block: &click.Block{
+				Cols: make([]click.Column, len(batch.meta)),
+			},
+			types: batch.types,
+			first: p.now(),
+			done:  make(chan struct{}),
+		}
+
+		for i, m := range batch.meta {
+			pd.block.Cols[i] = click.Column{Name: m.Name, Type: m.Type}
+		}
+	}
+
+	bb := pd.block
+
+	for _, b := range blocks {
+		if len(b.Cols) != len(bb.Cols) {
+			return nil, nil, errors.New("block columns mismatch: %d != %d", len(b.Cols), len(bb.Cols))
+		}
+
+		for i, c := range b.Cols {
+			if m := bb.Cols[i]; c.Name != m.Name || c.Type != m.Type {
+				return nil, nil, errors.New("column %d mismatch: %v %v != %v %v", i, c.Name, c.Type, m.Name, m.Type)
+			}
+		}
+	}
+
+	// append all or nothing, the pending block is shared with other clients
+	data := make([][]byte, len(bb.Cols))
+	n := bb.Rows
+	size := pd.bytes
+
+	for i, c := range bb.Cols {
+		data[i] = c.RawData
+	}
 
 	for _, b := range blocks {
 		for i, c := range b.Cols {
-			bb.Cols[i].RawData = append(bb.Cols[i].RawData, c.RawData...)
+			data[i], err = click.AppendColumnData(pd.types[i], data[i], n, c.RawData, b.Rows)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "append column %v", c.Name)
+			}
 		}
 
-		bb.Rows += b.Rows
+		n += b.Rows
+		size += b.DataSize()
 	}
 
-	err = p.flushBatch(ctx, batch)
-	if err != nil {
-		return errors.Wrap(err, "flush batch")
+	for i := range bb.Cols {
+		bb.Cols[i].RawData = data[i]
 	}
 
-	return nil
+	bb.Rows = n
+	pd.bytes = size
+	batch.cur = pd
+
+	if bb.Rows == rows || p.full(pd) {
+		batch.wakeup()
+	}
+
+	return pd, nil, nil
+}
+
+// flush commits pending rows of the batch.
+func (p *Batcher) flush(b *batch) {
+	p.mu.Lock()
+	pd := b.cur
+	b.cur = nil
+	p.mu.Unlock()
+
+	if pd == nil {
+		return
+	}
+
+	for try := 0; ; try++ {
+		pd.err = p.commit(p.ctx, b, pd.block)
+		if pd.err == nil || b.ack != AckAsync || try >= p.MaxRetries || isException(pd.err) {
+			break
+		}
+
+		d := p.retryDelay(try)
+
+		b.tr.Printw("flush batch: retry", "rows", pd.block.Rows, "try", try+1, "delay", d, "err", pd.err)
+
+		t := time.NewTimer(d)
+
+		select {
+		case <-t.C:
+		case <-p.ctx.Done():
+			t.Stop()
+		}
+	}
+
+	if pd.err != nil {
+		b.tr.Printw("flush batch", "rows", pd.block.Rows, "ack", b.ack, "err", pd.err)
+	}
+
+	close(pd.done)
+}
+
+// retryDelay doubles RetryBackoff for each try up to maxRetryBackoff.
+func (p *Batcher) retryDelay(try int) time.Duration {
+	d := p.RetryBackoff
+
+	for i := 0; i < try && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+
+	if d > maxRetryBackoff && p.RetryBackoff <= maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+
+	return d
 }
 
-func (p *Batcher) flushBatch(ctx context.Context, b *batch) (err error) {
-	tr := b.tr.Spawn("flush_batch", "rows", b.block.Rows)
+func (p *Batcher) ackMode(c *client, q *click.Query) AckMode {
+	if v, ok := q.Settings.Get("async_insert"); ok {
+		if !isTrue(v) {
+			return AckWait
+		}
+
+		// wait_for_async_insert has no effect without async_insert
+		if v, ok := q.Settings.Get("wait_for_async_insert"); ok {
+			if isTrue(v) {
+				return AckWait
+			}
+
+			return AckAsync
+		}
+	}
+
+	st := q.Statement()
+
+	db := st.Database
+	if db == "" {
+		db = c.creds.Database
+	}
+
+	if m, ok := p.TableAck[db+"."+st.Table]; ok {
+		return m
+	}
+
+	if m, ok := p.TableAck[st.Table]; ok {
+		return m
+	}
+
+	return p.Ack
+}
+
+func (p *Batcher) commit(ctx context.Context, b *batch, bb *click.Block) (err error) {
+	tr := b.tr.Spawn("flush_batch", "rows", bb.Rows)
 	defer func() { tr.Finish("err", err, "", loc.Caller(1)) }()
 
+	ctx = tlog.ContextWithSpan(ctx, tr)
+
 	cl, err := p.pool.Get(ctx, b.opts...)
 	if err != nil {
 		return errors.Wrap(err, "get client")
@@ -238,32 +649,49 @@ func (p *Batcher) flushBatch(ctx context.Context, b *batch) (err error) {
 		return errors.Wrap(err, "send query")
 	}
 
-	bb := b.block
-
 	err = cl.SendBlock(ctx, bb, b.q.Compressed)
 	if err != nil {
-		return errors.Wrap(err, "send cancel")
+		return errors.Wrap(err, "send block")
 	}
 
 	err = cl.SendBlock(ctx, nil, b.q.Compressed)
 	if err != nil {
-		return errors.Wrap(err, "send cancel")
+		return errors.Wrap(err, "send end of data")
 	}
 
 	err = p.consumeResponse(ctx, cl)
 	if err != nil {
-		return errors.Wrap(err, "get meta")
+		return errors.Wrap(err, "get response")
 	}
 
-	for i := range bb.Cols {
-		bb.Cols[i].RawData = bb.Cols[i].RawData[:0]
+	p.updateMeta(b, meta)
+
+	return nil
+}
+
+// updateMeta sets the new table structure for the following pending blocks.
+func (p *Batcher) updateMeta(b *batch, meta click.QueryMeta) {
+	p.mu.Lock()
+	same := metaEqual(b.meta, meta)
+	p.mu.Unlock()
+
+	if same {
+		return
 	}
 
-	bb.Rows = 0
+	types, err := parseTypes(meta)
+	if err != nil {
+		b.tr.Printw("table structure changed", "err", err)
+		return
+	}
 
-	b.meta = meta
+	b.tr.Printw("table structure changed", "columns", len(meta))
 
-	return nil
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	b.meta = meta
+	b.types = types
 }
 
 //
@@ -273,9 +701,45 @@ func (c *client) NextPacket(ctx context.Context) (click.ServerPacket, error) {
 		return c.Client.NextPacket(ctx)
 	}
 
+	if pd := c.pd; pd != nil {
+		c.pd = nil
+
+		select {
+		case <-pd.done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+
+		if pd.err != nil {
+			c.err = pd.err
+
+			return click.ServerException, nil
+		}
+	}
+
 	return click.ServerEndOfStream, nil
 }
 
+func (c *client) RecvException(ctx context.Context) error {
+	if c.Client != nil {
+		return c.Client.RecvException(ctx)
+	}
+
+	err := c.err
+	c.err = nil
+
+	var exc *click.Exception
+	if errors.As(err, &exc) {
+		return exc
+	}
+
+	return &click.Exception{
+		Code:    click.NETWORK_ERROR,
+		Name:    "DB::Exception",
+		Message: fmt.Sprintf("batch commit failed: %v", err),
+	}
+}
+
 func (c *client) SendQuery(ctx context.Context, q *click.Query) (meta click.QueryMeta, err error) {
 	if !q.IsInsert() {
 		c.Client, err = c.p.pool.Get(ctx, c.opts...)
@@ -286,12 +750,12 @@ func (c *client) SendQuery(ctx context.Context, q *click.Query) (meta click.Quer
 		return c.Client.SendQuery(ctx, q)
 	}
 
-	c.b, err = c.p.batch(ctx, c, q)
+	c.b, meta, err = c.p.batch(ctx, c, q)
 	if err != nil {
 		return nil, errors.Wrap(err, "batch")
 	}
 
-	return c.b.meta, nil
+	return meta, nil
 }
 
 func (c *client) SendBlock(ctx context.Context, b *click.Block, compr bool) (err error) {
@@ -300,7 +764,14 @@ func (c *client) SendBlock(ctx context.Context, b *click.Block, compr bool) (err
 	}
 
 	if b.IsEmpty() {
-		return c.p.addBlocks(ctx, c.b, c.blocks)
+		pd, err := c.p.addBlocks(ctx, c, c.blocks)
+		c.blocks = c.blocks[:0]
+
+		if err == nil && c.b.ack == AckWait {
+			c.pd = pd
+		}
+
+		return err
 	}
 
 	c.blocks = append(c.blocks, b)
@@ -317,3 +788,71 @@ func (c *client) CancelQuery(ctx context.Context) error {
 
 	return nil
 }
+
+func (c *client) Buffered() int {
+	if c.Client != nil {
+		return c.Client.Buffered()
+	}
+
+	return 0
+}
+
+// ParseAckMode parses ack mode name.
+func ParseAckMode(s string) (AckMode, error) {
+	switch s {
+	case "wait":
+		return AckWait, nil
+	case "async":
+		return AckAsync, nil
+	default:
+		return 0, errors.New("unknown ack mode: %v", s)
+	}
+}
+
+func (m AckMode) String() string {
+	switch m {
+	case AckWait:
+		return "wait"
+	case AckAsync:
+		return "async"
+	default:
+		return "unknown"
+	}
+}
+
+func parseTypes(meta click.QueryMeta) (types []click.ColType, err error) {
+	types = make([]click.ColType, len(meta))
+
+	for i, c := range meta {
+		types[i], err = click.ParseColType(c.Type)
+		if err != nil {
+			return nil, errors.Wrap(err, "col %v", c.Name)
+		}
+	}
+
+	return types, nil
+}
+
+func metaEqual(a, b click.QueryMeta) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Type != b[i].Type {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isException(err error) bool {
+	var exc *click.Exception
+
+	return errors.As(err, &exc)
+}
+
+func isTrue(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
@@ -0,0 +1,524 @@
+package batcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	upstream struct {
+		mu        sync.Mutex
+		committed []int
+		closed    bool
+
+		// table structure, single UInt8 column a by default
+		meta click.QueryMeta
+
+		fails int
+		err   error
+
+		// SendQuery of slowQuery signals held and waits for release
+		slowQuery     string
+		held, release chan struct{}
+	}
+
+	upstreamClient struct {
+		click.Client
+
+		u *upstream
+	}
+)
+
+func TestBatcherMaxRows(t *testing.T) {
+	ctx := context.Background()
+
+	u := &upstream{}
+	b := New(ctx, u)
+	b.Ack = AckAsync
+	b.MaxRows = 5
+	b.MaxInterval = time.Hour
+
+	insert(t, b, 2)
+	insert(t, b, 2)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, u.commits())
+
+	insert(t, b, 2)
+
+	assert.Eventually(t, func() bool { return len(u.commits()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int{6}, u.commits())
+
+	insert(t, b, 1)
+
+	require.NoError(t, b.Close())
+
+	assert.Equal(t, []int{6, 1}, u.commits())
+	assert.True(t, u.closed)
+
+	cl, err := b.Get(ctx)
+	require.NoError(t, err)
+
+	_, err = cl.SendQuery(ctx, &click.Query{Query: "INSERT INTO t VALUES"})
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestBatcherMaxBytes(t *testing.T) {
+	ctx := context.Background()
+
+	u := &upstream{}
+	b := New(ctx, u)
+	b.Ack = AckAsync
+	b.MaxBytes = 15 // 9 bytes per one row block
+	b.MaxInterval = time.Hour
+
+	defer func() {
+		assert.NoError(t, b.Close())
+	}()
+
+	insert(t, b, 1)
+	insert(t, b, 3)
+
+	assert.Eventually(t, func() bool { return len(u.commits()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int{4}, u.commits())
+}
+
+func TestBatcherMaxInterval(t *testing.T) {
+	ctx := context.Background()
+
+	u := &upstream{}
+	b := New(ctx, u)
+	b.Ack = AckAsync
+	b.MaxInterval = 20 * time.Millisecond
+
+	defer func() {
+		assert.NoError(t, b.Close())
+	}()
+
+	insert(t, b, 1)
+	insert(t, b, 1)
+
+	assert.Eventually(t, func() bool { return sum(u.commits()) == 2 }, time.Second, time.Millisecond)
+
+	// idle batch is removed and started again on the next insert
+	assert.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		return len(b.bs) == 0
+	}, time.Second, time.Millisecond)
+
+	insert(t, b, 3)
+
+	assert.Eventually(t, func() bool { return sum(u.commits()) == 5 }, time.Second, time.Millisecond)
+}
+
+func TestBatcherAckWait(t *testing.T) {
+	ctx := context.Background()
+
+	u := &upstream{}
+	b := New(ctx, u)
+	b.MaxInterval = 10 * time.Millisecond
+
+	defer func() {
+		assert.NoError(t, b.Close())
+	}()
+
+	insert(t, b, 2)
+	assert.Equal(t, []int{2}, u.commits())
+
+	u.mu.Lock()
+	u.fails, u.err = 1, &click.Exception{Code: 60, Name: "DB::Exception", Message: "table doesn't exist"}
+	u.mu.Unlock()
+
+	err := tryInsert(t, b, 1)
+	assert.Equal(t, u.err, err)
+
+	u.mu.Lock()
+	u.fails, u.err = 1, errors.New("connection reset")
+	u.mu.Unlock()
+
+	err = tryInsert(t, b, 1)
+	if exc, ok := err.(*click.Exception); assert.True(t, ok, "exception expected: %v", err) {
+		assert.Equal(t, int32(click.NETWORK_ERROR), exc.Code)
+	}
+
+	assert.Equal(t, []int{2}, u.commits())
+}
+
+func TestBatcherAckAsync(t *testing.T) {
+	ctx := context.Background()
+
+	u := &upstream{fails: 1, err: errors.New("connection reset")}
+	b := New(ctx, u)
+	b.MaxInterval = 10 * time.Millisecond
+	b.RetryBackoff = time.Millisecond
+
+	defer func() {
+		assert.NoError(t, b.Close())
+	}()
+
+	insert(t, b, 2, click.Setting{Name: "async_insert", Value: "1"}, click.Setting{Name: "wait_for_async_insert", Value: "0"})
+
+	assert.Eventually(t, func() bool { return len(u.commits()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int{2}, u.commits())
+}
+
+func TestBatcherBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u := &upstream{fails: 1, err: errors.New("connection reset")}
+	b := New(ctx, u)
+	b.Ack = AckAsync
+	b.MaxRows = 2
+	b.MaxInterval = time.Hour
+	b.RetryBackoff = time.Hour
+
+	defer func() {
+		assert.NoError(t, b.Close())
+	}()
+
+	insert(t, b, 2)
+
+	assert.Eventually(t, func() bool {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		return u.fails == 0
+	}, time.Second, time.Millisecond)
+
+	// the flusher is waiting to retry, the next rows are not flushed
+	insert(t, b, 2)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		insert(t, b, 1)
+	}()
+
+	select {
+	case <-done:
+		t.Errorf("insert is not blocked by full pending rows")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel() // retry right away
+
+	<-done
+
+	assert.Equal(t, []int{2, 2}, u.commits())
+}
+
+func TestBatcherRetryDelay(t *testing.T) {
+	b := New(context.Background(), nil)
+	b.RetryBackoff = time.Second
+
+	assert.Equal(t, time.Second, b.retryDelay(0))
+	assert.Equal(t, 4*time.Second, b.retryDelay(2))
+	assert.Equal(t, maxRetryBackoff, b.retryDelay(10))
+	assert.Equal(t, maxRetryBackoff, b.retryDelay(100))
+
+	b.RetryBackoff = 2 * maxRetryBackoff
+
+	assert.Equal(t, 2*maxRetryBackoff, b.retryDelay(3))
+}
+
+func TestBatcherSlowNewBatch(t *testing.T) {
+	ctx := context.Background()
+
+	u := &upstream{
+		slowQuery: "INSERT INTO slow VALUES",
+		held:      make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+
+	b := New(ctx, u)
+	b.Ack = AckAsync
+	b.MaxInterval = time.Hour
+
+	defer func() {
+		assert.NoError(t, b.Close())
+	}()
+
+	errc := make(chan error, 1)
+
+	go func() {
+		cl, err := b.Get(ctx)
+		if err == nil {
+			_, err = cl.SendQuery(ctx, &click.Query{Query: u.slowQuery})
+		}
+
+		errc <- err
+	}()
+
+	<-u.held
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		insert(t, b, 1)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("insert is blocked by another batch creation")
+	}
+
+	close(u.release)
+
+	assert.NoError(t, <-errc)
+	<-done
+}
+
+func TestBatcherSchemaChange(t *testing.T) {
+	ctx := context.Background()
+
+	u := &upstream{}
+	b := New(ctx, u)
+	b.Ack = AckAsync
+	b.MaxRows = 2
+	b.MaxInterval = time.Hour
+
+	defer func() {
+		assert.NoError(t, b.Close())
+	}()
+
+	old := click.Column{Name: "a", Type: "UInt8", RawData: []byte{1}}
+	add := click.Column{Name: "b", Type: "LowCardinality(String)"}
+
+	insert(t, b, 1)
+
+	// column added, the flush sees the new structure
+	u.mu.Lock()
+	u.meta = click.QueryMeta{{Name: old.Name, Type: old.Type}, {Name: add.Name, Type: add.Type}}
+	u.mu.Unlock()
+
+	insert(t, b, 1)
+
+	assert.Eventually(t, func() bool { return len(u.commits()) == 1 }, time.Second, time.Millisecond)
+
+	// new clients get the new structure
+	meta, err := sendInsert(t, b, &click.Block{Rows: 1, Cols: []click.Column{old}})
+	assert.Equal(t, u.meta, meta)
+	assert.Error(t, err)
+
+	// shared dictionaries, additional keys with UInt8 indexes, key "x", index 0
+	add.RawData = []byte{
+		1, 0, 0, 0, 0, 0, 0, 0,
+		0, 2, 0, 0, 0, 0, 0, 0,
+		1, 0, 0, 0, 0, 0, 0, 0, 1, 'x',
+		1, 0, 0, 0, 0, 0, 0, 0, 0,
+	}
+
+	_, err = sendInsert(t, b, &click.Block{Rows: 1, Cols: []click.Column{old, add}})
+	assert.NoError(t, err)
+
+	// broken data is not merged partially
+	_, err = sendInsert(t, b, &click.Block{Rows: 1, Cols: []click.Column{old, {Name: add.Name, Type: add.Type, RawData: []byte{1, 2, 3}}}})
+	assert.Error(t, err)
+
+	_, err = sendInsert(t, b, &click.Block{Rows: 1, Cols: []click.Column{old, add}})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return len(u.commits()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int{2, 2}, u.commits())
+}
+
+func TestBatcherAckMode(t *testing.T) {
+	b := New(context.Background(), nil)
+	b.Ack = AckAsync
+	b.TableAck = map[string]AckMode{
+		"db.events": AckWait,
+		"logs":      AckWait,
+	}
+
+	c := &client{creds: click.Credentials{Database: "db"}}
+
+	for _, tc := range []struct {
+		q    string
+		sets click.Settings
+		ack  AckMode
+	}{
+		{q: "INSERT INTO t VALUES", ack: AckAsync},
+		{q: "INSERT INTO events VALUES", ack: AckWait},
+		{q: "INSERT INTO other.events VALUES", ack: AckAsync},
+		{q: "INSERT INTO other.logs VALUES", ack: AckWait},
+		{q: "INSERT INTO t VALUES", sets: click.Settings{{Name: "async_insert", Value: "0"}}, ack: AckWait},
+		{q: "INSERT INTO t VALUES", sets: click.Settings{{Name: "async_insert", Value: "1"}}, ack: AckAsync},
+		{q: "INSERT INTO logs VALUES", sets: click.Settings{{Name: "async_insert", Value: "1"}}, ack: AckWait},
+		{q: "INSERT INTO t VALUES", sets: click.Settings{{Name: "async_insert", Value: "1"}, {Name: "wait_for_async_insert", Value: "1"}}, ack: AckWait},
+		{q: "INSERT INTO logs VALUES", sets: click.Settings{{Name: "async_insert", Value: "1"}, {Name: "wait_for_async_insert", Value: "0"}}, ack: AckAsync},
+		{q: "INSERT INTO t VALUES", sets: click.Settings{{Name: "wait_for_async_insert", Value: "1"}}, ack: AckAsync},
+		{q: "INSERT INTO logs VALUES", sets: click.Settings{{Name: "wait_for_async_insert", Value: "0"}}, ack: AckWait},
+	} {
+		assert.Equal(t, tc.ack, b.ackMode(c, &click.Query{Query: tc.q, Settings: tc.sets}), "%v %v", tc.q, tc.sets)
+	}
+}
+
+func insert(t testing.TB, b *Batcher, rows int, settings ...click.Setting) {
+	t.Helper()
+
+	assert.NoError(t, tryInsert(t, b, rows, settings...))
+}
+
+// tryInsert returns exception received instead of EndOfStream.
+func tryInsert(t testing.TB, b *Batcher, rows int, settings ...click.Setting) (err error) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	cl, err := b.Get(ctx)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, b.Put(ctx, cl, err))
+	}()
+
+	meta, err := cl.SendQuery(ctx, &click.Query{Query: "INSERT INTO t VALUES", Settings: settings})
+	require.NoError(t, err)
+	require.Len(t, meta, 1)
+
+	require.NoError(t, cl.SendBlock(ctx, &click.Block{
+		Rows: rows,
+		Cols: []click.Column{{Name: "a", Type: "UInt8", RawData: make([]byte, rows)}},
+	}, false))
+
+	require.NoError(t, cl.SendBlock(ctx, nil, false))
+
+	return recvResult(t, cl)
+}
+
+// sendInsert sends the block as is and returns the table structure and the data error.
+func sendInsert(t testing.TB, b *Batcher, block *click.Block) (meta click.QueryMeta, err error) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	cl, err := b.Get(ctx)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, b.Put(ctx, cl, err))
+	}()
+
+	meta, err = cl.SendQuery(ctx, &click.Query{Query: "INSERT INTO t VALUES"})
+	require.NoError(t, err)
+
+	require.NoError(t, cl.SendBlock(ctx, block, false))
+
+	err = cl.SendBlock(ctx, nil, false)
+	if err != nil {
+		return meta, err
+	}
+
+	return meta, recvResult(t, cl)
+}
+
+func recvResult(t testing.TB, cl click.Client) (err error) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	pk, err := cl.NextPacket(ctx)
+	require.NoError(t, err)
+
+	if pk == click.ServerException {
+		return cl.RecvException(ctx)
+	}
+
+	assert.Equal(t, click.ServerEndOfStream, pk)
+
+	return nil
+}
+
+func sum(l []int) (s int) {
+	for _, x := range l {
+		s += x
+	}
+
+	return s
+}
+
+func (u *upstream) commits() []int {
+	defer u.mu.Unlock()
+	u.mu.Lock()
+
+	return append([]int{}, u.committed...)
+}
+
+func (u *upstream) Get(ctx context.Context, opts ...click.ClientOption) (click.Client, error) {
+	return &upstreamClient{u: u}, nil
+}
+
+func (u *upstream) Put(ctx context.Context, cl click.Client, err error) error { return nil }
+
+func (u *upstream) Close() error {
+	u.closed = true
+
+	return nil
+}
+
+func (c *upstreamClient) SendQuery(ctx context.Context, q *click.Query) (click.QueryMeta, error) {
+	if q.Query == c.u.slowQuery {
+		c.u.held <- struct{}{}
+		<-c.u.release
+	}
+
+	defer c.u.mu.Unlock()
+	c.u.mu.Lock()
+
+	if c.u.meta != nil {
+		return c.u.meta, nil
+	}
+
+	return click.QueryMeta{{Name: "a", Type: "UInt8"}}, nil
+}
+
+func (c *upstreamClient) CancelQuery(ctx context.Context) error { return nil }
+
+func (c *upstreamClient) SendBlock(ctx context.Context, b *click.Block, compr bool) error {
+	if b.IsEmpty() {
+		return nil
+	}
+
+	defer c.u.mu.Unlock()
+	c.u.mu.Lock()
+
+	if c.u.fails > 0 {
+		c.u.fails--
+		return c.u.err
+	}
+
+	for _, col := range b.Cols {
+		ct, err := click.ParseColType(col.Type)
+		if err != nil {
+			return err
+		}
+
+		l, err := click.ColumnDataLen(ct, col.RawData, b.Rows)
+		if err != nil || l != len(col.RawData) {
+			return errors.New("column %v: bad data: %d != %d (%v)", col.Name, l, len(col.RawData), err)
+		}
+	}
+
+	c.u.committed = append(c.u.committed, b.Rows)
+
+	return nil
+}
+
+func (c *upstreamClient) NextPacket(ctx context.Context) (click.ServerPacket, error) {
+	return click.ServerEndOfStream, nil
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"net"
 	"os"
+	"os/user"
 	"strings"
+	"time"
 
 	"github.com/ClickHouse/clickhouse-go/lib/protocol"
 	click "github.com/nikandfor/clickhouse"
@@ -16,13 +18,26 @@ type (
 		conn
 
 		// server response
-		Server   click.Agent
-		TimeZone string
+		Server       click.Agent
+		TimeZone     string
+		DisplayName  string
+		VersionPatch int
 
 		// client request
 		Client click.Agent
 
 		Credentials click.Credentials
+
+		// packets received before query meta
+		queue []queued
+
+		stream bool // query response is not fully read
+	}
+
+	queued struct {
+		pk click.ServerPacket
+		b  *click.Block
+		tc click.TableColumns
 	}
 )
 
@@ -31,14 +46,26 @@ var (
 	_ click.Pinger = &Client{}
 )
 
+// cancelTimeout limits sending Cancel if write timeout is not set.
+const cancelTimeout = time.Second
+
 var hostname, _ = os.Hostname()
 
+var osUser = func() string {
+	u, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+
+	return u.Username
+}()
+
 func NewClient(ctx context.Context, conn net.Conn) *Client {
 	return &Client{
 		conn: newConn(ctx, conn),
 		Client: click.Agent{
 			Name: "Clickhouse clien",
-			Ver:  click.Ver{1, 1, 54213},
+			Ver:  click.Ver{1, 1, click.DBMS_TCP_PROTOCOL_VERSION},
 		},
 		Credentials: click.Credentials{
 			Database: "default",
@@ -48,6 +75,8 @@ func NewClient(ctx context.Context, conn net.Conn) *Client {
 }
 
 func (c *Client) Hello(ctx context.Context) (err error) {
+	c.bind(ctx)
+
 	err = c.sendHello()
 	if err != nil {
 		return
@@ -71,8 +100,6 @@ func (c *Client) Hello(ctx context.Context) (err error) {
 	default:
 		return errors.New("unexpected packet: %x", tp)
 	}
-
-	return nil
 }
 
 func (c *Client) sendHello() (err error) {
@@ -110,13 +137,32 @@ func (c *Client) recvHello() (err error) {
 		return
 	}
 
-	if c.Server.Ver[2] >= protocol.DBMS_MIN_REVISION_WITH_SERVER_TIMEZONE {
+	err = c.negotiate(c.Client.Ver, c.Server.Ver)
+	if err != nil {
+		return
+	}
+
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_SERVER_TIMEZONE {
 		c.TimeZone, err = c.d.String()
 		if err != nil {
 			return
 		}
 	}
 
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_SERVER_DISPLAY_NAME {
+		c.DisplayName, err = c.d.String()
+		if err != nil {
+			return
+		}
+	}
+
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_VERSION_PATCH {
+		c.VersionPatch, err = c.d.Uvarint()
+		if err != nil {
+			return
+		}
+	}
+
 	return nil
 }
 
@@ -131,119 +177,289 @@ func (c *Client) SendQuery(ctx context.Context, q *click.Query) (_ click.QueryMe
 		return
 	}
 
-	tp, err := c.NextPacket(ctx)
-	if err != nil {
+	for {
+		var tp click.ServerPacket
+
+		tp, err = c.conn.NextPacket(ctx)
+		if err != nil {
+			return
+		}
+
+		x := queued{pk: tp}
+
+		switch tp {
+		case click.ServerData:
+			return c.recvMeta(ctx, q)
+		case click.ServerEndOfStream:
+			c.stream = false
+
+			return nil, nil
+		case click.ServerException:
+			return nil, c.RecvException(ctx)
+		case click.ServerLog, click.ServerProfileEvents:
+			x.b, err = c.conn.RecvBlock(ctx, false)
+		case click.ServerTableColumns:
+			x.tc, err = c.recvTableColumns()
+		default:
+			return nil, errors.New("unexpected packet: %x", tp)
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "recv %x", tp)
+		}
+
+		c.queue = append(c.queue, x)
+	}
+}
+
+func (c *Client) NextPacket(ctx context.Context) (pk click.ServerPacket, err error) {
+	if len(c.queue) != 0 {
+		return c.queue[0].pk, nil
+	}
+
+	pk, err = c.conn.NextPacket(ctx)
+	if pk == click.ServerEndOfStream && err == nil {
+		c.stream = false
+	}
+
+	return
+}
+
+// Streaming reports whether the query is sent but its response is not fully read.
+func (c *Client) Streaming() bool { return c.stream }
+
+func (c *Client) Buffered() int { return len(c.queue) }
+
+func (c *Client) dequeue() (x queued, ok bool) {
+	if len(c.queue) == 0 {
 		return
 	}
 
-	switch tp {
-	case protocol.ServerData:
-	case protocol.ServerEndOfStream:
-		return nil, nil
-	case protocol.ServerException:
-		return nil, c.RecvException(ctx)
-	default:
-		return nil, errors.New("unexpected packet: %x", tp)
+	x = c.queue[0]
+	c.queue = c.queue[1:]
+
+	return x, true
+}
+
+// RecvBlock receives Data, Totals and Extremes blocks.
+// Log and ProfileEvents blocks are never compressed.
+func (c *Client) RecvBlock(ctx context.Context, compr bool) (*click.Block, error) {
+	if x, ok := c.dequeue(); ok {
+		if x.b == nil {
+			return nil, errors.New("unexpected recv block for packet %x", x.pk)
+		}
+
+		return x.b, nil
 	}
 
-	return c.recvMeta(ctx, q)
+	return c.conn.RecvBlock(ctx, compr)
 }
 
-func (c *Client) sendQuery(ctx context.Context, q *click.Query) (err error) {
-	err = c.sendPacket(int(protocol.ClientQuery))
+func (c *Client) RecvTableColumns(ctx context.Context) (click.TableColumns, error) {
+	c.bind(ctx)
+
+	if x, ok := c.dequeue(); ok {
+		if x.pk != click.ServerTableColumns {
+			return click.TableColumns{}, errors.New("unexpected recv table columns for packet %x", x.pk)
+		}
+
+		return x.tc, nil
+	}
+
+	return c.recvTableColumns()
+}
+
+func (c *Client) recvTableColumns() (tc click.TableColumns, err error) {
+	tc.Table, err = c.d.String()
 	if err != nil {
 		return
 	}
 
-	err = c.e.String(q.ID)
+	tc.Columns, err = c.d.String()
 	if err != nil {
 		return
 	}
 
-	err = c.sendQueryInfo(ctx, q)
+	return
+}
+
+func (c *Client) RecvPartUUIDs(ctx context.Context) (ids [][16]byte, err error) {
+	c.bind(ctx)
+
+	n, err := c.d.Uvarint()
 	if err != nil {
 		return
 	}
 
-	if c.Server.Ver[2] >= click.DBMS_MIN_REVISION_WITH_QUOTA_KEY_IN_CLIENT_INFO {
-		err = c.e.String(q.QuotaKey)
+	ids = make([][16]byte, n)
+
+	for i := range ids {
+		_, err = c.d.ReadFull(ids[i][:])
 		if err != nil {
-			return
+			return nil, err
 		}
 	}
 
-	err = c.e.String("") // settings
+	return ids, nil
+}
+
+func (c *Client) SendReadTaskResponse(ctx context.Context, resp string) (err error) {
+	c.bind(ctx)
+
+	err = c.sendPacket(int(click.ClientReadTaskResponse))
 	if err != nil {
 		return
 	}
 
-	err = c.e.Uvarint(2) // state complete
+	err = c.e.Uvarint(click.DBMS_CLUSTER_PROCESSING_PROTOCOL_VERSION)
 	if err != nil {
 		return
 	}
 
-	err = c.e.Bool(q.Compressed)
+	err = c.e.String(resp)
 	if err != nil {
 		return
 	}
 
-	err = c.e.String(q.Query)
+	return c.e.Flush()
+}
+
+func (c *Client) sendQuery(ctx context.Context, q *click.Query) (err error) {
+	c.bind(ctx)
+
+	c.queue = c.queue[:0]
+	c.stream = true
+
+	err = c.sendPacket(int(protocol.ClientQuery))
 	if err != nil {
 		return
 	}
 
-	err = c.sendEmptyData(protocol.ClientData, q.Compressed)
+	err = c.e.String(q.ID)
 	if err != nil {
 		return
 	}
 
-	return
-}
+	info := c.queryInfo(q)
 
-func (c *Client) sendQueryInfo(ctx context.Context, q *click.Query) (err error) {
-	err = c.e.Uvarint(1)
+	err = c.sendQueryInfo(c.rev, &info)
 	if err != nil {
-		return
+		return errors.Wrap(err, "client info")
 	}
 
-	err = c.e.String("")
+	err = c.sendSettings(c.rev, q.Settings)
 	if err != nil {
-		return
+		return errors.Wrap(err, "settings")
 	}
 
-	err = c.e.String("")
-	if err != nil {
-		return
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_INTERSERVER_SECRET {
+		err = c.e.String("") // no secret, we are not a cluster node
+		if err != nil {
+			return
+		}
 	}
 
-	err = c.e.String("localhost:0")
+	err = c.e.Uvarint(2) // state complete
 	if err != nil {
 		return
 	}
 
-	err = c.e.Uvarint(1)
+	err = c.e.Bool(q.Compressed)
 	if err != nil {
 		return
 	}
 
-	err = c.e.String(hostname)
+	err = c.e.String(q.Query)
 	if err != nil {
 		return
 	}
 
-	err = c.e.String(hostname)
+	err = c.sendExtTables(ctx, q)
 	if err != nil {
-		return
+		return errors.Wrap(err, "ext tables")
 	}
 
-	err = c.sendClientInfo(c.Client.Name, c.Client.Ver)
+	err = c.sendEmptyData(protocol.ClientData, q.Compressed)
 	if err != nil {
 		return
 	}
 
+	return
+}
+
+func (c *Client) sendExtTables(ctx context.Context, q *click.Query) (err error) {
+	for _, t := range q.Tables {
+		if t.Name == "" {
+			return errors.New("external table without name")
+		}
+
+		blocks := t.Blocks
+
+		if len(blocks) == 0 { // just structure
+			blocks = []*click.Block{click.NewBlock(t.Structure)}
+		}
+
+		for _, b := range blocks {
+			b := *b
+			b.Table = t.Name
+
+			err = c.sendBlock(ctx, int(protocol.ClientData), &b, q.Compressed)
+			if err != nil {
+				return errors.Wrap(err, "table %v", t.Name)
+			}
+		}
+	}
+
 	return nil
 }
 
+// queryInfo fills in ClientInfo fields the caller left empty.
+func (c *Client) queryInfo(q *click.Query) (info click.ClientInfo) {
+	info = q.Info
+
+	if info.QuotaKey == "" {
+		info.QuotaKey = q.QuotaKey
+	}
+
+	if info.Kind == click.NoQuery {
+		info.Kind = click.InitialQuery
+	}
+
+	if info.Kind == click.InitialQuery && info.InitialQueryID == "" {
+		info.InitialQueryID = q.ID
+	}
+
+	if info.InitialAddress == "" {
+		info.InitialAddress = "0.0.0.0:0"
+	}
+
+	if info.Interface == 0 {
+		info.Interface = click.InterfaceTCP
+	}
+
+	if info.Interface != click.InterfaceTCP {
+		return
+	}
+
+	if info.OSUser == "" {
+		info.OSUser = osUser
+	}
+
+	if info.Hostname == "" {
+		info.Hostname = hostname
+	}
+
+	if info.Client.Name == "" {
+		info.Client = q.Client
+	}
+
+	if info.Client.Name == "" {
+		info.Client = c.Client
+	}
+
+	return
+}
+
 func (c *Client) recvMeta(ctx context.Context, q *click.Query) (meta click.QueryMeta, err error) {
 	_, err = c.d.String()
 	if err != nil {
@@ -282,6 +498,8 @@ func (c *Client) recvMeta(ctx context.Context, q *click.Query) (meta click.Query
 }
 
 func (c *Client) SendPing(ctx context.Context) (err error) {
+	c.bind(ctx)
+
 	err = c.sendPacket(int(click.ClientPing))
 	if err != nil {
 		return
@@ -290,7 +508,20 @@ func (c *Client) SendPing(ctx context.Context) (err error) {
 	return c.e.Flush()
 }
 
+// CancelQuery sends Cancel packet.
+// ctx is usually done by now, so the packet is sent with its own deadline
+// and ctx is not bound as the query response may be read concurrently.
 func (c *Client) CancelQuery(ctx context.Context) (err error) {
+	timeout := cancelTimeout
+	if c.dc != nil && c.dc.writeTimeout > 0 {
+		timeout = c.dc.writeTimeout
+	}
+
+	wctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c.bindWrite(wctx)
+
 	err = c.sendPacket(int(click.ClientCancel))
 	if err != nil {
 		return
@@ -304,6 +535,10 @@ func (c *Client) SendBlock(ctx context.Context, b *click.Block, compr bool) (err
 }
 
 func (c *Client) RecvException(ctx context.Context) (err error) {
+	c.bind(ctx)
+
+	c.stream = false
+
 	root := &click.Exception{}
 	exc := root
 
@@ -347,7 +582,9 @@ func (c *Client) RecvException(ctx context.Context) (err error) {
 	return root
 }
 
-func (c *Client) RecvProgress(context.Context) (p click.Progress, err error) {
+func (c *Client) RecvProgress(ctx context.Context) (p click.Progress, err error) {
+	c.bind(ctx)
+
 	p.Rows, err = c.d.Uvarint64()
 	if err != nil {
 		return
@@ -363,10 +600,24 @@ func (c *Client) RecvProgress(context.Context) (p click.Progress, err error) {
 		return
 	}
 
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_CLIENT_WRITE_INFO {
+		p.WrittenRows, err = c.d.Uvarint64()
+		if err != nil {
+			return
+		}
+
+		p.WrittenBytes, err = c.d.Uvarint64()
+		if err != nil {
+			return
+		}
+	}
+
 	return
 }
 
-func (c *Client) RecvProfileInfo(context.Context) (p click.ProfileInfo, err error) {
+func (c *Client) RecvProfileInfo(ctx context.Context) (p click.ProfileInfo, err error) {
+	c.bind(ctx)
+
 	p.Rows, err = c.d.Uvarint64()
 	if err != nil {
 		return
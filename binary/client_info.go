@@ -0,0 +1,356 @@
+package binary
+
+import (
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+)
+
+func (c *conn) sendQueryInfo(rev int, info *click.ClientInfo) (err error) {
+	err = c.e.UInt8(uint8(info.Kind))
+	if err != nil {
+		return
+	}
+
+	if info.Kind == click.NoQuery {
+		return nil
+	}
+
+	err = c.e.String(info.InitialUser)
+	if err != nil {
+		return
+	}
+
+	err = c.e.String(info.InitialQueryID)
+	if err != nil {
+		return
+	}
+
+	err = c.e.String(info.InitialAddress)
+	if err != nil {
+		return
+	}
+
+	if rev >= click.DBMS_MIN_PROTOCOL_VERSION_WITH_INITIAL_QUERY_START_TIME {
+		var us int64
+		if !info.InitialTime.IsZero() {
+			us = info.InitialTime.UnixNano() / 1000
+		}
+
+		err = c.e.Int64(us)
+		if err != nil {
+			return
+		}
+	}
+
+	err = c.e.UInt8(uint8(info.Interface))
+	if err != nil {
+		return
+	}
+
+	switch info.Interface {
+	case click.InterfaceTCP:
+		err = c.e.String(info.OSUser)
+		if err != nil {
+			return
+		}
+
+		err = c.e.String(info.Hostname)
+		if err != nil {
+			return
+		}
+
+		err = c.sendClientInfo(info.Client.Name, info.Client.Ver)
+		if err != nil {
+			return
+		}
+	case click.InterfaceHTTP:
+		err = c.e.UInt8(info.HTTPMethod)
+		if err != nil {
+			return
+		}
+
+		err = c.e.String(info.HTTPUserAgent)
+		if err != nil {
+			return
+		}
+
+		if rev >= click.DBMS_MIN_REVISION_WITH_X_FORWARDED_FOR_IN_CLIENT_INFO {
+			err = c.e.String(info.ForwardedFor)
+			if err != nil {
+				return
+			}
+		}
+
+		if rev >= click.DBMS_MIN_REVISION_WITH_REFERER_IN_CLIENT_INFO {
+			err = c.e.String(info.Referer)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if rev >= click.DBMS_MIN_REVISION_WITH_QUOTA_KEY_IN_CLIENT_INFO {
+		err = c.e.String(info.QuotaKey)
+		if err != nil {
+			return
+		}
+	}
+
+	if rev >= click.DBMS_MIN_PROTOCOL_VERSION_WITH_DISTRIBUTED_DEPTH {
+		err = c.e.Uvarint(info.DistributedDepth)
+		if err != nil {
+			return
+		}
+	}
+
+	if info.Interface == click.InterfaceTCP && rev >= click.DBMS_MIN_REVISION_WITH_VERSION_PATCH {
+		err = c.e.Uvarint(info.VersionPatch)
+		if err != nil {
+			return
+		}
+	}
+
+	if rev >= click.DBMS_MIN_REVISION_WITH_OPENTELEMETRY {
+		err = c.sendTraceContext(&info.Trace)
+		if err != nil {
+			return errors.Wrap(err, "trace context")
+		}
+	}
+
+	if rev >= click.DBMS_MIN_REVISION_WITH_PARALLEL_REPLICAS {
+		collab := 0
+		if info.CollaborateWithInitiator {
+			collab = 1
+		}
+
+		err = c.e.Uvarint(collab)
+		if err != nil {
+			return
+		}
+
+		err = c.e.Uvarint(info.ParallelReplicas)
+		if err != nil {
+			return
+		}
+
+		err = c.e.Uvarint(info.ReplicaNumber)
+		if err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+func (c *conn) recvQueryInfo(rev int, info *click.ClientInfo) (err error) {
+	kind, err := c.d.UInt8()
+	if err != nil {
+		return
+	}
+
+	info.Kind = click.QueryKind(kind)
+
+	if info.Kind == click.NoQuery {
+		return nil
+	}
+
+	info.InitialUser, err = c.d.String()
+	if err != nil {
+		return
+	}
+
+	info.InitialQueryID, err = c.d.String()
+	if err != nil {
+		return
+	}
+
+	info.InitialAddress, err = c.d.String()
+	if err != nil {
+		return
+	}
+
+	if rev >= click.DBMS_MIN_PROTOCOL_VERSION_WITH_INITIAL_QUERY_START_TIME {
+		var us int64
+
+		us, err = c.d.Int64()
+		if err != nil {
+			return
+		}
+
+		if us != 0 {
+			info.InitialTime = time.Unix(0, us*1000)
+		}
+	}
+
+	iface, err := c.d.UInt8()
+	if err != nil {
+		return
+	}
+
+	info.Interface = click.Interface(iface)
+
+	switch info.Interface {
+	case click.InterfaceTCP:
+		info.OSUser, err = c.d.String()
+		if err != nil {
+			return
+		}
+
+		info.Hostname, err = c.d.String()
+		if err != nil {
+			return
+		}
+
+		info.Client.Name, info.Client.Ver, err = c.recvClientInfo()
+		if err != nil {
+			return
+		}
+	case click.InterfaceHTTP:
+		info.HTTPMethod, err = c.d.UInt8()
+		if err != nil {
+			return
+		}
+
+		info.HTTPUserAgent, err = c.d.String()
+		if err != nil {
+			return
+		}
+
+		if rev >= click.DBMS_MIN_REVISION_WITH_X_FORWARDED_FOR_IN_CLIENT_INFO {
+			info.ForwardedFor, err = c.d.String()
+			if err != nil {
+				return
+			}
+		}
+
+		if rev >= click.DBMS_MIN_REVISION_WITH_REFERER_IN_CLIENT_INFO {
+			info.Referer, err = c.d.String()
+			if err != nil {
+				return
+			}
+		}
+	default:
+		return errors.New("unsupported interface: %x", iface)
+	}
+
+	if rev >= click.DBMS_MIN_REVISION_WITH_QUOTA_KEY_IN_CLIENT_INFO {
+		info.QuotaKey, err = c.d.String()
+		if err != nil {
+			return
+		}
+	}
+
+	if rev >= click.DBMS_MIN_PROTOCOL_VERSION_WITH_DISTRIBUTED_DEPTH {
+		info.DistributedDepth, err = c.d.Uvarint()
+		if err != nil {
+			return
+		}
+	}
+
+	if info.Interface == click.InterfaceTCP && rev >= click.DBMS_MIN_REVISION_WITH_VERSION_PATCH {
+		info.VersionPatch, err = c.d.Uvarint()
+		if err != nil {
+			return
+		}
+	}
+
+	if rev >= click.DBMS_MIN_REVISION_WITH_OPENTELEMETRY {
+		err = c.recvTraceContext(&info.Trace)
+		if err != nil {
+			return errors.Wrap(err, "trace context")
+		}
+	}
+
+	if rev >= click.DBMS_MIN_REVISION_WITH_PARALLEL_REPLICAS {
+		var collab int
+
+		collab, err = c.d.Uvarint()
+		if err != nil {
+			return
+		}
+
+		info.CollaborateWithInitiator = collab != 0
+
+		info.ParallelReplicas, err = c.d.Uvarint()
+		if err != nil {
+			return
+		}
+
+		info.ReplicaNumber, err = c.d.Uvarint()
+		if err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+func (c *conn) sendTraceContext(t *click.TraceContext) (err error) {
+	if t.TraceID == ([16]byte{}) {
+		return c.e.UInt8(0)
+	}
+
+	err = c.e.UInt8(1)
+	if err != nil {
+		return
+	}
+
+	_, err = c.e.Write(t.TraceID[:])
+	if err != nil {
+		return
+	}
+
+	err = c.e.UInt64(t.SpanID)
+	if err != nil {
+		return
+	}
+
+	err = c.e.String(t.TraceState)
+	if err != nil {
+		return
+	}
+
+	err = c.e.UInt8(t.TraceFlags)
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func (c *conn) recvTraceContext(t *click.TraceContext) (err error) {
+	have, err := c.d.UInt8()
+	if err != nil {
+		return
+	}
+
+	if have == 0 {
+		return nil
+	}
+
+	id, err := c.d.ReadFixed(len(t.TraceID))
+	if err != nil {
+		return
+	}
+
+	copy(t.TraceID[:], id)
+
+	t.SpanID, err = c.d.UInt64()
+	if err != nil {
+		return
+	}
+
+	t.TraceState, err = c.d.String()
+	if err != nil {
+		return
+	}
+
+	t.TraceFlags, err = c.d.UInt8()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package binary
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientInfo(t *testing.T) {
+	ctx := context.Background()
+
+	info := click.ClientInfo{
+		Kind:           click.SecondaryQuery,
+		InitialUser:    "user",
+		InitialQueryID: "qid",
+		InitialAddress: "10.0.0.1:50000",
+		InitialTime:    time.Unix(1600000000, 123456000),
+		Interface:      click.InterfaceTCP,
+		OSUser:         "os_user",
+		Hostname:       "host",
+		Client:         click.Agent{Name: "client", Ver: click.Ver{21, 11, 54450}},
+		VersionPatch:   3,
+		QuotaKey:       "quota",
+
+		DistributedDepth: 1,
+
+		Trace: click.TraceContext{
+			TraceID:    [16]byte{1, 2, 3},
+			SpanID:     4,
+			TraceState: "state",
+			TraceFlags: 1,
+		},
+
+		CollaborateWithInitiator: true,
+		ParallelReplicas:         2,
+		ReplicaNumber:            1,
+	}
+
+	http := info
+	http.Interface = click.InterfaceHTTP
+	http.OSUser, http.Hostname, http.Client, http.VersionPatch = "", "", click.Agent{}, 0
+	http.HTTPMethod = 2
+	http.HTTPUserAgent = "curl"
+	http.ForwardedFor = "10.0.0.2"
+	http.Referer = "ref"
+
+	for _, x := range []click.ClientInfo{info, http, {}} {
+		for _, rev := range []int{54213, 54453} {
+			var buf bytes.Buffer
+
+			c := conn{d: NewDecoder(ctx, &buf), e: NewEncoder(ctx, &buf)}
+
+			require.NoError(t, c.sendQueryInfo(rev, &x), rev)
+
+			var r click.ClientInfo
+			require.NoError(t, c.recvQueryInfo(rev, &r), rev)
+
+			exp := x
+
+			if rev < click.DBMS_MIN_REVISION_WITH_PARALLEL_REPLICAS {
+				exp.InitialTime = time.Time{}
+				exp.DistributedDepth = 0
+				exp.Trace = click.TraceContext{}
+				exp.CollaborateWithInitiator, exp.ParallelReplicas, exp.ReplicaNumber = false, 0, 0
+				exp.ForwardedFor, exp.Referer = "", ""
+				exp.VersionPatch = 0
+			}
+
+			if !exp.InitialTime.IsZero() {
+				assert.True(t, exp.InitialTime.Equal(r.InitialTime), rev)
+				exp.InitialTime, r.InitialTime = time.Time{}, time.Time{}
+			}
+
+			assert.Equal(t, exp, r, rev)
+			assert.Zero(t, buf.Len(), rev)
+		}
+	}
+}
+
+func TestQueryDeprecatedInfo(t *testing.T) {
+	ctx := context.Background()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	qc := make(chan *click.Query, 1)
+
+	go func() {
+		srv := NewServerConn(ctx, sc)
+
+		if err := srv.Hello(ctx); err != nil {
+			qc <- nil
+			return
+		}
+
+		_, _ = srv.NextPacket(ctx)
+
+		q, _ := srv.RecvQuery(ctx)
+		qc <- q
+	}()
+
+	cl := NewClient(ctx, cc)
+	require.NoError(t, cl.Hello(ctx))
+
+	agent := click.Agent{Name: "legacy", Ver: click.Ver{1, 2, 54450}}
+
+	require.NoError(t, cl.sendQuery(ctx, &click.Query{Query: "SELECT 1", QuotaKey: "quota", Client: agent}))
+	require.NoError(t, cl.Flush())
+
+	q := <-qc
+	require.NotNil(t, q)
+
+	assert.Equal(t, "quota", q.Info.QuotaKey)
+	assert.Equal(t, "quota", q.QuotaKey)
+	assert.Equal(t, agent, q.Info.Client)
+	assert.Equal(t, agent, q.Client)
+}
@@ -0,0 +1,433 @@
+package binary
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+)
+
+type (
+	// Conn is a high-level client connection.
+	// It's not safe for concurrent use, Rows must be closed before the next query.
+	Conn struct {
+		*Client
+
+		Compressed bool
+		Settings   click.Settings // sent with every query
+
+		// watcher may cancel the query while Insert sends data
+		wmu sync.Mutex
+	}
+
+	// Rows is a query result stream.
+	Rows struct {
+		c   *Conn
+		ctx context.Context
+		q   *click.Query
+
+		meta click.QueryMeta
+		b    *click.Block
+
+		progress click.Progress
+		profile  click.ProfileInfo
+
+		totals   *click.Block
+		extremes *click.Block
+
+		stop     func() bool
+		stopped  bool
+		canceled bool
+
+		done    bool
+		closing bool
+		err     error
+	}
+)
+
+// Dial connects to addr and makes Hello.
+func Dial(ctx context.Context, addr string, creds click.Credentials) (_ *Conn, err error) {
+	var d net.Dialer
+
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+
+	cl := NewClient(ctx, nc)
+	cl.Credentials = creds
+
+	err = cl.Hello(ctx)
+	if err != nil {
+		_ = nc.Close()
+		return nil, errors.Wrap(err, "hello")
+	}
+
+	return NewConn(cl), nil
+}
+
+func NewConn(cl *Client) *Conn {
+	return &Conn{Client: cl}
+}
+
+// Query sends the query and returns result stream.
+func (c *Conn) Query(ctx context.Context, query string) (r *Rows, err error) {
+	q := &click.Query{
+		Query:      query,
+		Compressed: c.Compressed,
+		Settings:   c.Settings,
+	}
+
+	r = &Rows{
+		c:   c,
+		ctx: ctx,
+		q:   q,
+	}
+
+	err = c.sendQuery(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "send query")
+	}
+
+	err = c.e.Flush()
+	if err != nil {
+		return nil, errors.Wrap(err, "send query")
+	}
+
+	r.stop = c.watch(ctx)
+
+	r.meta, err = r.recvMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Exec executes the query discarding the result.
+func (c *Conn) Exec(ctx context.Context, query string) (err error) {
+	r, err := c.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	for r.Next() {
+	}
+
+	return r.Close()
+}
+
+// Insert executes INSERT query sending blocks as its data.
+// Blocks columns must match the table structure returned by the server.
+func (c *Conn) Insert(ctx context.Context, query string, blocks ...*click.Block) (err error) {
+	r, err := c.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	return r.Insert(blocks...)
+}
+
+// Ping checks the connection is alive.
+func (c *Conn) Ping(ctx context.Context) (err error) {
+	err = c.SendPing(ctx)
+	if err != nil {
+		return errors.Wrap(err, "send ping")
+	}
+
+	pk, err := c.NextPacket(ctx)
+	if err != nil {
+		return errors.Wrap(err, "recv pong")
+	}
+
+	if pk != click.ServerPong {
+		return errors.New("unexpected packet: %x", pk)
+	}
+
+	return nil
+}
+
+// watch cancels the query when ctx is done.
+// stop ends watching and reports if the query was canceled.
+func (c *Conn) watch(ctx context.Context) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	done := make(chan struct{})
+	res := make(chan bool, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.wmu.Lock()
+			_ = c.CancelQuery(ctx)
+			c.wmu.Unlock()
+
+			res <- true
+		case <-done:
+			res <- false
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return <-res
+	}
+}
+
+// sendData sends INSERT data blocks ending them with an empty one.
+func (c *Conn) sendData(ctx context.Context, blocks []*click.Block, compr bool) (err error) {
+	defer c.wmu.Unlock()
+	c.wmu.Lock()
+
+	for _, b := range blocks {
+		if b.Rows == 0 {
+			continue
+		}
+
+		err = c.SendBlock(ctx, b, compr)
+		if err != nil {
+			return
+		}
+	}
+
+	err = c.sendEmptyData(int(click.ClientData), compr)
+	if err != nil {
+		return
+	}
+
+	return c.e.Flush()
+}
+
+func checkBlock(meta click.QueryMeta, b *click.Block) error {
+	if len(b.Cols) != len(meta) {
+		return errors.New("expected %d columns, got %d", len(meta), len(b.Cols))
+	}
+
+	for i, c := range b.Cols {
+		if c.Name != meta[i].Name || c.Type != meta[i].Type {
+			return errors.New("col %d: expected %v %v, got %v %v", i, meta[i].Name, meta[i].Type, c.Name, c.Type)
+		}
+	}
+
+	return nil
+}
+
+// recvMeta receives the result header.
+// Statements with no result may end the stream right away.
+func (r *Rows) recvMeta() (meta click.QueryMeta, err error) {
+	for !r.done {
+		pk, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if pk == click.ServerData {
+			return r.b.Meta(), nil
+		}
+	}
+
+	return nil, r.err
+}
+
+// Insert sends blocks as INSERT query data and waits for the query to finish.
+// Rows are closed after that.
+func (r *Rows) Insert(blocks ...*click.Block) (err error) {
+	defer func() {
+		e := r.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+
+	if r.done {
+		return errors.New("not an insert query")
+	}
+
+	for i, b := range blocks {
+		err = checkBlock(r.meta, b)
+		if err != nil {
+			return errors.Wrap(err, "block %d", i)
+		}
+	}
+
+	err = r.c.sendData(r.ctx, blocks, r.q.Compressed)
+	if err != nil {
+		return errors.Wrap(err, "send block")
+	}
+
+	for r.Next() {
+	}
+
+	return r.Err()
+}
+
+// Meta returns result columns.
+func (r *Rows) Meta() click.QueryMeta { return r.meta }
+
+// Next receives the next non-empty block.
+func (r *Rows) Next() bool {
+	for !r.done {
+		pk, _ := r.next()
+
+		if pk == click.ServerData && r.b.Rows != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Block returns the current block.
+func (r *Rows) Block() *click.Block { return r.b }
+
+// Scan decodes the current block into dst, see click.Block.Scan.
+func (r *Rows) Scan(dst interface{}) error {
+	if r.b == nil {
+		return errors.New("no block")
+	}
+
+	return r.b.Scan(dst)
+}
+
+// Progress returns accumulated query progress.
+func (r *Rows) Progress() click.Progress { return r.progress }
+
+// ProfileInfo returns the last received profile info.
+func (r *Rows) ProfileInfo() click.ProfileInfo { return r.profile }
+
+// Totals returns WITH TOTALS block if received.
+func (r *Rows) Totals() *click.Block { return r.totals }
+
+// Extremes returns extremes block if received.
+func (r *Rows) Extremes() *click.Block { return r.extremes }
+
+// Err returns the query error.
+func (r *Rows) Err() error { return r.err }
+
+// Close cancels the query if it's not finished and reads the rest of the stream.
+func (r *Rows) Close() error {
+	if !r.done {
+		r.closing = true
+
+		// the watcher may have canceled already and must not write concurrently
+		if !r.unwatch() {
+			err := r.c.CancelQuery(r.ctx)
+			if err != nil {
+				r.finish(errors.Wrap(err, "cancel query"))
+			}
+		}
+	}
+
+	for !r.done {
+		_, _ = r.next()
+	}
+
+	return r.err
+}
+
+func (r *Rows) next() (pk click.ServerPacket, err error) {
+	ctx := r.ctx
+
+	pk, err = r.c.NextPacket(ctx)
+	if err != nil {
+		return pk, r.finish(errors.Wrap(err, "recv packet"))
+	}
+
+	switch pk {
+	case click.ServerEndOfStream:
+		return pk, r.finish(nil)
+	case click.ServerData:
+		r.b, err = r.c.RecvBlock(ctx, r.q.Compressed)
+		if err != nil {
+			return pk, r.finish(errors.Wrap(err, "recv block"))
+		}
+	case click.ServerException:
+		err = r.c.RecvException(ctx)
+		if _, ok := err.(*click.Exception); !ok {
+			err = errors.Wrap(err, "recv exception")
+		}
+
+		return pk, r.finish(err)
+	case click.ServerProgress:
+		p, err := r.c.RecvProgress(ctx)
+		if err != nil {
+			return pk, r.finish(errors.Wrap(err, "recv progress"))
+		}
+
+		r.progress.Rows += p.Rows
+		r.progress.Bytes += p.Bytes
+		r.progress.TotalRows += p.TotalRows
+		r.progress.WrittenRows += p.WrittenRows
+		r.progress.WrittenBytes += p.WrittenBytes
+	case click.ServerProfileInfo:
+		r.profile, err = r.c.RecvProfileInfo(ctx)
+		if err != nil {
+			return pk, r.finish(errors.Wrap(err, "recv profile info"))
+		}
+	case click.ServerTotals:
+		r.totals, err = r.c.RecvBlock(ctx, r.q.Compressed)
+		if err != nil {
+			return pk, r.finish(errors.Wrap(err, "recv totals"))
+		}
+	case click.ServerExtremes:
+		r.extremes, err = r.c.RecvBlock(ctx, r.q.Compressed)
+		if err != nil {
+			return pk, r.finish(errors.Wrap(err, "recv extremes"))
+		}
+	case click.ServerLog, click.ServerProfileEvents:
+		_, err = r.c.RecvBlock(ctx, false)
+		if err != nil {
+			return pk, r.finish(errors.Wrap(err, "recv %x", pk))
+		}
+	case click.ServerTableColumns:
+		_, err = r.c.RecvTableColumns(ctx)
+		if err != nil {
+			return pk, r.finish(errors.Wrap(err, "recv table columns"))
+		}
+	case click.ServerPartUUIDs:
+		_, err = r.c.RecvPartUUIDs(ctx)
+		if err != nil {
+			return pk, r.finish(errors.Wrap(err, "recv part uuids"))
+		}
+	default:
+		return pk, r.finish(errors.New("unexpected packet: %x", pk))
+	}
+
+	return pk, nil
+}
+
+func (r *Rows) finish(err error) error {
+	r.done = true
+
+	if _, ok := err.(*click.Exception); ok && r.closing {
+		err = nil // canceled by us
+	}
+
+	canceled := r.unwatch()
+
+	if canceled && r.ctx.Err() != nil {
+		err = r.ctx.Err()
+	}
+
+	// connection deadline may fire before the watcher noticed ctx is done
+	if !canceled && !r.closing && errors.Is(err, context.DeadlineExceeded) {
+		_ = r.c.CancelQuery(r.ctx)
+	}
+
+	r.err = err
+
+	return err
+}
+
+func (r *Rows) unwatch() bool {
+	if !r.stopped {
+		r.stopped = true
+		r.canceled = r.stop()
+	}
+
+	return r.canceled
+}
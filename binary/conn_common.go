@@ -5,7 +5,7 @@ import (
 	"bytes"
 	"context"
 	"net"
-	"strings"
+	"time"
 
 	click "github.com/nikandfor/clickhouse"
 	"github.com/nikandfor/errors"
@@ -19,34 +19,86 @@ type (
 		r *bufio.Reader
 		w *bufio.Writer
 
-		c net.Conn
+		c  net.Conn
+		dc *deadlineConn
+
+		// negotiated protocol revision
+		rev int
 	}
 )
 
 func newConn(ctx context.Context, c net.Conn) conn {
-	r := bufio.NewReader(c)
-	w := bufio.NewWriter(c)
+	dc := newDeadlineConn(c)
+
+	r := bufio.NewReader(dc)
+	w := bufio.NewWriter(dc)
 
 	return conn{
-		d: NewDecoder(ctx, r),
-		e: NewEncoder(ctx, w),
-		r: r,
-		w: w,
-		c: c,
+		d:  NewDecoder(ctx, r),
+		e:  NewEncoder(ctx, w),
+		r:  r,
+		w:  w,
+		c:  c,
+		dc: dc,
+	}
+}
+
+// SetTimeouts sets timeouts for each connection read and write.
+// Context deadline is also applied if it's earlier. Zero means no timeout.
+func (c *conn) SetTimeouts(read, write time.Duration) {
+	c.dc.readTimeout = read
+	c.dc.writeTimeout = write
+}
+
+// bind makes the following reads and writes respect ctx deadline.
+func (c *conn) bind(ctx context.Context) {
+	if c.dc == nil {
+		return
 	}
+
+	c.dc.bind(ctx)
+}
+
+func (c *conn) bindWrite(ctx context.Context) {
+	if c.dc == nil {
+		return
+	}
+
+	c.dc.bindWrite(ctx)
 }
 
 func (c *conn) NextPacket(ctx context.Context) (tp click.ServerPacket, err error) {
+	c.bind(ctx)
+
 	x, err := c.d.Uvarint()
 
 	return click.ServerPacket(x), err
 }
 
+// Revision returns protocol revision negotiated by Hello.
+func (c *conn) Revision() int { return c.rev }
+
+// negotiate sets revision both sides support.
+func (c *conn) negotiate(a, b click.Ver) (err error) {
+	c.rev = a[2]
+	if b[2] < c.rev {
+		c.rev = b[2]
+	}
+
+	if c.rev < click.DBMS_MIN_SUPPORTED_REVISION {
+		return errors.New("unsupported protocol revision: %v", c.rev)
+	}
+
+	return nil
+}
+
 func (c *conn) sendPacket(tp int) (err error) {
 	return c.e.Uvarint(tp)
 }
 
 func (c *conn) RecvBlock(ctx context.Context, compr bool) (b *click.Block, err error) {
+	c.bind(ctx)
+
 	tab, err := c.d.String()
 	if err != nil {
 		return
@@ -82,38 +134,16 @@ func (c *conn) RecvBlock(ctx context.Context, compr bool) (b *click.Block, err e
 			return
 		}
 
-		var d []byte
+		var t click.ColType
 
-		switch {
-		case tp == "String":
-			for j := 0; j < rows; j++ {
-				x, err := c.d.ReadString()
-				if err != nil {
-					return nil, err
-				}
-
-				d = append(d, x...)
-			}
-		case tp == "UInt64" || tp == "Int64", strings.HasPrefix(tp, "DateTime64("):
-			d = make([]byte, 8*rows)
-
-			_, err = c.d.ReadFull(d)
-		case tp == "UInt32" || tp == "Int32":
-			d = make([]byte, 4*rows)
-
-			_, err = c.d.ReadFull(d)
-		case tp == "UInt16" || tp == "Int16" || tp == "Date":
-			d = make([]byte, 2*rows)
-
-			_, err = c.d.ReadFull(d)
-		case tp == "UInt8" || tp == "Int8":
-			d = make([]byte, rows)
-
-			_, err = c.d.ReadFull(d)
-		default:
-			return nil, errors.New("unsupported type: %v (col %v)", tp, name)
+		t, err = click.ParseColType(tp)
+		if err != nil {
+			return nil, errors.Wrap(err, "col %v", name)
 		}
 
+		var d []byte
+
+		d, err = click.ReadColumnData(c.d, t, rows, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -130,6 +160,8 @@ func (c *conn) RecvBlock(ctx context.Context, compr bool) (b *click.Block, err e
 }
 
 func (c *conn) sendBlock(ctx context.Context, pk int, b *click.Block, compr bool) (err error) {
+	c.bind(ctx)
+
 	err = c.sendPacket(pk)
 	if err != nil {
 		return
@@ -183,6 +215,10 @@ func (c *conn) sendBlock(ctx context.Context, pk int, b *click.Block, compr bool
 }
 
 func (c *conn) Close() error {
+	if c.dc != nil {
+		return c.dc.Close() // stops context watchers
+	}
+
 	return c.c.Close()
 }
 
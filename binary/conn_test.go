@@ -0,0 +1,623 @@
+package binary
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnQuery(t *testing.T) {
+	ctx := context.Background()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+
+	type row struct {
+		N uint64 `ch:"n"`
+	}
+
+	meta := click.QueryMeta{{Name: "n", Type: "UInt64"}}
+
+	res := click.NewBlock(meta)
+	require.NoError(t, res.AppendRows([]row{{N: 1}, {N: 2}}))
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- func() (err error) {
+			defer sc.Close()
+
+			srv := NewServerConn(ctx, sc)
+
+			err = srv.Hello(ctx)
+			if err != nil {
+				return
+			}
+
+			// select
+			_, err = srv.NextPacket(ctx)
+			if err != nil {
+				return
+			}
+
+			q, err := srv.RecvQuery(ctx)
+			if err != nil {
+				return
+			}
+
+			assert.Equal(t, "SELECT n", q.Query)
+
+			err = srv.SendQueryMeta(ctx, meta, false)
+			if err != nil {
+				return
+			}
+
+			err = srv.SendProgress(ctx, click.Progress{Rows: 2})
+			if err != nil {
+				return
+			}
+
+			err = srv.SendBlock(ctx, res, false)
+			if err != nil {
+				return
+			}
+
+			err = srv.SendEndOfStream(ctx)
+			if err != nil {
+				return
+			}
+
+			// insert
+			_, err = srv.NextPacket(ctx)
+			if err != nil {
+				return
+			}
+
+			_, err = srv.RecvQuery(ctx)
+			if err != nil {
+				return
+			}
+
+			err = srv.SendQueryMeta(ctx, meta, false)
+			if err != nil {
+				return
+			}
+
+			_, err = srv.NextPacket(ctx)
+			if err != nil {
+				return
+			}
+
+			b, err := srv.RecvBlock(ctx, false)
+			if err != nil {
+				return
+			}
+
+			assert.Equal(t, res, b)
+
+			_, err = srv.NextPacket(ctx)
+			if err != nil {
+				return
+			}
+
+			b, err = srv.RecvBlock(ctx, false)
+			if err != nil {
+				return
+			}
+
+			assert.True(t, b.IsEmpty())
+
+			err = srv.SendException(ctx, &click.Exception{Code: 60, Name: "DB::Exception", Message: "no table"})
+			if err != nil {
+				return
+			}
+
+			return nil
+		}()
+	}()
+
+	c := NewConn(NewClient(ctx, cc))
+	require.NoError(t, c.Hello(ctx))
+
+	r, err := c.Query(ctx, "SELECT n")
+	require.NoError(t, err)
+	assert.Equal(t, meta, r.Meta())
+
+	var rows []row
+
+	for r.Next() {
+		require.NoError(t, r.Scan(&rows))
+	}
+
+	require.NoError(t, r.Close())
+	assert.Equal(t, []row{{N: 1}, {N: 2}}, rows)
+	assert.Equal(t, uint64(2), r.Progress().Rows)
+
+	err = c.Insert(ctx, "INSERT INTO t VALUES", res)
+	var exc *click.Exception
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(60), exc.Code)
+	}
+
+	require.NoError(t, <-errc)
+}
+
+func TestConnInsertCanceled(t *testing.T) {
+	ctx := context.Background()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+
+	meta := click.QueryMeta{{Name: "n", Type: "UInt64"}}
+
+	b := click.NewBlock(meta)
+	require.NoError(t, b.AppendRows(make([]struct {
+		N uint64 `ch:"n"`
+	}, 100)))
+
+	errc := make(chan error, 1)
+	release := make(chan struct{})
+
+	go func() {
+		errc <- func() (err error) {
+			defer sc.Close()
+
+			srv := NewServerConn(ctx, sc)
+
+			err = srv.Hello(ctx)
+			if err != nil {
+				return
+			}
+
+			_, err = srv.NextPacket(ctx)
+			if err != nil {
+				return
+			}
+
+			_, err = srv.RecvQuery(ctx)
+			if err != nil {
+				return
+			}
+
+			err = srv.SendQueryMeta(ctx, meta, false)
+			if err != nil {
+				return
+			}
+
+			// stuck server: stop reading so that the client blocks on write
+			<-release
+
+			return nil
+		}()
+	}()
+
+	c := NewConn(NewClient(ctx, cc))
+	require.NoError(t, c.Hello(ctx))
+
+	qctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	blocks := make([]*click.Block, 100)
+	for i := range blocks {
+		blocks[i] = b
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond)
+		cancel()
+	}()
+
+	err := c.Insert(qctx, "INSERT INTO t VALUES", blocks...)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	close(release)
+	require.NoError(t, <-errc)
+}
+
+func TestExtTables(t *testing.T) {
+	ctx := context.Background()
+
+	type row struct {
+		ID   uint32 `ch:"id"`
+		Name string `ch:"name"`
+	}
+
+	meta := click.QueryMeta{{Name: "id", Type: "UInt32"}, {Name: "name", Type: "String"}}
+
+	b1 := click.NewBlock(meta)
+	require.NoError(t, b1.AppendRows([]row{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}}))
+
+	b2 := click.NewBlock(meta)
+	require.NoError(t, b2.AppendRows([]row{{ID: 3, Name: "c"}}))
+
+	q := &click.Query{
+		Tables: []click.ExtTable{{
+			Name:      "ids",
+			Structure: meta,
+			Blocks:    []*click.Block{b1, b2},
+		}, {
+			Name:      "empty",
+			Structure: click.QueryMeta{{Name: "x", Type: "String"}},
+		}},
+	}
+
+	for _, compr := range []bool{false, true} {
+		q.Compressed = compr
+
+		var buf bytes.Buffer
+
+		c := conn{d: NewDecoder(ctx, &buf), e: NewEncoder(ctx, &buf)}
+		cl := &Client{conn: c}
+		srv := &Server{conn: c}
+
+		require.NoError(t, cl.sendExtTables(ctx, q))
+		require.NoError(t, cl.sendEmptyData(int(click.ClientData), q.Compressed))
+
+		r := &click.Query{Compressed: compr}
+		require.NoError(t, srv.recvExtTables(ctx, r))
+
+		if assert.Len(t, r.Tables, 2) {
+			assert.Equal(t, "ids", r.Tables[0].Name)
+			assert.Equal(t, meta, r.Tables[0].Structure)
+
+			var rows []row
+			for _, b := range r.Tables[0].Blocks {
+				require.NoError(t, b.Scan(&rows))
+			}
+
+			assert.Equal(t, []row{{1, "a"}, {2, "b"}, {3, "c"}}, rows)
+
+			assert.Equal(t, q.Tables[1].Name, r.Tables[1].Name)
+			assert.Equal(t, q.Tables[1].Structure, r.Tables[1].Structure)
+			assert.Len(t, r.Tables[1].Blocks, 0)
+		}
+
+		assert.Zero(t, buf.Len())
+	}
+}
+
+func TestHelloRevision(t *testing.T) {
+	ctx := context.Background()
+
+	for _, rev := range []int{54213, 54420, click.DBMS_TCP_PROTOCOL_VERSION, 60000} {
+		cc, sc := net.Pipe()
+
+		srv := NewServerConn(ctx, sc)
+		srv.DisplayName = "display"
+		srv.VersionPatch = 3
+
+		errc := make(chan error, 1)
+
+		go func() {
+			errc <- func() (err error) {
+				err = srv.Hello(ctx)
+				if err != nil {
+					return
+				}
+
+				return srv.SendProgress(ctx, click.Progress{Rows: 1, WrittenRows: 2})
+			}()
+		}()
+
+		cl := NewClient(ctx, cc)
+		cl.Client.Ver[2] = rev
+
+		require.NoError(t, cl.Hello(ctx), rev)
+
+		exp := rev
+		if exp > click.DBMS_TCP_PROTOCOL_VERSION {
+			exp = click.DBMS_TCP_PROTOCOL_VERSION
+		}
+
+		assert.Equal(t, exp, cl.Revision(), rev)
+		assert.Equal(t, exp, srv.Revision(), rev)
+
+		if rev >= click.DBMS_MIN_REVISION_WITH_VERSION_PATCH {
+			assert.Equal(t, "display", cl.DisplayName, rev)
+			assert.Equal(t, 3, cl.VersionPatch, rev)
+		}
+
+		_, err := cl.NextPacket(ctx)
+		require.NoError(t, err, rev)
+
+		p, err := cl.RecvProgress(ctx)
+		require.NoError(t, err, rev)
+		require.NoError(t, <-errc, rev)
+
+		expp := click.Progress{Rows: 1, WrittenRows: 2}
+		if rev < click.DBMS_MIN_REVISION_WITH_CLIENT_WRITE_INFO {
+			expp.WrittenRows = 0
+		}
+
+		assert.Equal(t, expp, p, rev)
+
+		_ = cc.Close()
+		_ = sc.Close()
+	}
+}
+
+func TestExtraPackets(t *testing.T) {
+	ctx := context.Background()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+
+	meta := click.QueryMeta{{Name: "n", Type: "UInt64"}}
+
+	type row struct {
+		N uint64 `ch:"n"`
+	}
+
+	totals := click.NewBlock(meta)
+	require.NoError(t, totals.AppendRows([]row{{N: 3}}))
+
+	logs := click.NewBlock(click.QueryMeta{{Name: "text", Type: "String"}})
+	require.NoError(t, logs.AppendRows([]struct {
+		Text string `ch:"text"`
+	}{{Text: "log line"}}))
+
+	tc := click.TableColumns{Columns: "columns format version: 1\n1 columns:\n`n` UInt64\n"}
+	ids := [][16]byte{{1}, {2}}
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- func() (err error) {
+			defer sc.Close()
+
+			srv := NewServerConn(ctx, sc)
+
+			err = srv.Hello(ctx)
+			if err != nil {
+				return
+			}
+
+			_, err = srv.NextPacket(ctx)
+			if err != nil {
+				return
+			}
+
+			_, err = srv.RecvQuery(ctx)
+			if err != nil {
+				return
+			}
+
+			for _, f := range []func() error{
+				func() error { return srv.SendTableColumns(ctx, tc) },
+				func() error { return srv.SendLog(ctx, logs) },
+				func() error { return srv.SendQueryMeta(ctx, meta, true) },
+				func() error { return srv.SendTotals(ctx, totals, true) },
+				func() error { return srv.SendExtremes(ctx, totals, true) },
+				func() error { return srv.SendProfileEvents(ctx, logs) },
+				func() error { return srv.SendPartUUIDs(ctx, ids) },
+				func() error { return srv.SendReadTaskRequest(ctx) },
+			} {
+				err = f()
+				if err != nil {
+					return
+				}
+			}
+
+			pk, err := srv.NextPacket(ctx)
+			if err != nil {
+				return
+			}
+
+			assert.Equal(t, click.ClientReadTaskResponse, pk)
+
+			resp, err := srv.RecvReadTaskResponse(ctx)
+			if err != nil {
+				return
+			}
+
+			assert.Equal(t, "task", resp)
+
+			return srv.SendEndOfStream(ctx)
+		}()
+	}()
+
+	cl := NewClient(ctx, cc)
+	require.NoError(t, cl.Hello(ctx))
+
+	rmeta, err := cl.SendQuery(ctx, &click.Query{Query: "INSERT INTO t VALUES", Compressed: true})
+	require.NoError(t, err)
+	assert.Equal(t, meta, rmeta)
+	assert.Equal(t, 2, cl.Buffered())
+
+	next := func(exp click.ServerPacket) {
+		pk, err := cl.NextPacket(ctx)
+		require.NoError(t, err)
+		require.Equal(t, exp, pk)
+	}
+
+	next(click.ServerTableColumns)
+	rtc, err := cl.RecvTableColumns(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, tc, rtc)
+
+	next(click.ServerLog)
+	b, err := cl.RecvBlock(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, logs, b)
+	assert.Equal(t, 0, cl.Buffered())
+
+	for _, pk := range []click.ServerPacket{click.ServerTotals, click.ServerExtremes} {
+		next(pk)
+		b, err = cl.RecvBlock(ctx, true)
+		require.NoError(t, err)
+		assert.Equal(t, totals, b)
+	}
+
+	next(click.ServerProfileEvents)
+	b, err = cl.RecvBlock(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, logs, b)
+
+	next(click.ServerPartUUIDs)
+	rids, err := cl.RecvPartUUIDs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ids, rids)
+
+	next(click.ServerReadTaskRequest)
+	require.NoError(t, cl.SendReadTaskResponse(ctx, "task"))
+
+	next(click.ServerEndOfStream)
+
+	require.NoError(t, <-errc)
+}
+
+func TestDeadlines(t *testing.T) {
+	ctx := context.Background()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	go func() {
+		srv := NewServerConn(ctx, sc)
+
+		_, _ = srv.NextPacket(ctx) // hello, never answered
+	}()
+
+	cl := NewClient(ctx, cc)
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	err := cl.Hello(tctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// canceled with no deadline
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err = cl.NextPacket(cctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// read timeout
+	cl.SetTimeouts(20*time.Millisecond, 0)
+
+	_, err = cl.NextPacket(ctx)
+	if assert.Error(t, err) {
+		var nerr net.Error
+
+		if assert.ErrorAs(t, err, &nerr) {
+			assert.True(t, nerr.Timeout())
+		}
+	}
+
+	// write timeout, nobody reads
+	cl.SetTimeouts(0, 20*time.Millisecond)
+
+	err = cl.SendPing(ctx)
+	if err == nil {
+		err = cl.Flush()
+	}
+
+	assert.Error(t, err)
+}
+
+func TestCancelOnDeadline(t *testing.T) {
+	ctx := context.Background()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	meta := click.QueryMeta{{Name: "n", Type: "UInt64"}}
+
+	pkc := make(chan click.ClientPacket, 1)
+
+	go func() {
+		srv := NewServerConn(ctx, sc)
+
+		err := srv.Hello(ctx)
+		if err != nil {
+			return
+		}
+
+		_, _ = srv.NextPacket(ctx)
+
+		_, err = srv.RecvQuery(ctx)
+		if err != nil {
+			return
+		}
+
+		err = srv.SendQueryMeta(ctx, meta, false)
+		if err != nil {
+			return
+		}
+
+		pk, err := srv.NextPacket(ctx) // query is running
+		if err != nil {
+			return
+		}
+
+		pkc <- pk
+	}()
+
+	c := NewConn(NewClient(ctx, cc))
+	require.NoError(t, c.Hello(ctx))
+
+	qctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	r, err := c.Query(qctx, "SELECT sleep(10)")
+	require.NoError(t, err)
+
+	for r.Next() {
+	}
+
+	assert.ErrorIs(t, r.Err(), context.DeadlineExceeded)
+
+	select {
+	case pk := <-pkc:
+		assert.Equal(t, click.ClientCancel, pk)
+	case <-time.After(time.Second):
+		t.Fatalf("no cancel received")
+	}
+}
+
+func TestServerAuthFailed(t *testing.T) {
+	ctx := context.Background()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	errc := make(chan error, 1)
+
+	go func() {
+		srv := NewServerConn(ctx, sc)
+		srv.Auth = func(ctx context.Context, s *Server) error {
+			return errors.New("users db: dial 10.0.0.1:5432: connection refused")
+		}
+
+		errc <- srv.Hello(ctx)
+	}()
+
+	cl := NewClient(ctx, cc)
+	cl.Credentials.User = "user"
+
+	err := cl.Hello(ctx)
+
+	var exc *click.Exception
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(click.AUTHENTICATION_FAILED), exc.Code)
+		assert.Equal(t, "user: Authentication failed", exc.Message)
+	}
+
+	err = <-errc
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "connection refused")
+	}
+}
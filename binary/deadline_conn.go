@@ -0,0 +1,243 @@
+package binary
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// deadlineConn sets connection deadlines before each Read and Write.
+	// Deadline is the earliest of the bound context deadline and now plus timeout.
+	// Pending Read and Write are interrupted when the bound context is done.
+	deadlineConn struct {
+		net.Conn
+
+		mu   sync.Mutex
+		ctx  context.Context
+		wctx context.Context // may differ to send Cancel
+
+		// stop watching ctx and wctx
+		rstop, wstop chan struct{}
+
+		// timeouts for a single Read or Write call, zero means no timeout
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+
+		// deadlines set last time
+		rdl, wdl time.Time
+	}
+)
+
+// aLongTimeAgo is a deadline to interrupt pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+func newDeadlineConn(c net.Conn) *deadlineConn {
+	return &deadlineConn{
+		Conn: c,
+		ctx:  context.Background(),
+		wctx: context.Background(),
+	}
+}
+
+// bind sets the context for the following reads and writes.
+// Query may be canceled from another goroutine while reading, so it's synchronized.
+func (c *deadlineConn) bind(ctx context.Context) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	if ctx == c.ctx && ctx == c.wctx {
+		return
+	}
+
+	c.ctx = ctx
+	c.wctx = ctx
+
+	stopWatch(c.wstop)
+	stopWatch(c.rstop)
+
+	c.wstop = nil
+	c.rstop = c.watch(ctx)
+}
+
+// bindWrite sets the context for the following writes only.
+func (c *deadlineConn) bindWrite(ctx context.Context) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	if ctx == c.wctx {
+		return
+	}
+
+	c.wctx = ctx
+
+	stopWatch(c.wstop)
+	c.wstop = nil
+
+	if ctx != c.ctx {
+		c.wstop = c.watch(ctx)
+	}
+}
+
+// watch interrupts I/O bound to ctx when it's done.
+// It must be called with mu held.
+func (c *deadlineConn) watch(ctx context.Context) (stop chan struct{}) {
+	done := ctx.Done()
+	if done == nil {
+		return nil
+	}
+
+	stop = make(chan struct{})
+
+	go func() {
+		select {
+		case <-done:
+		case <-stop:
+			return
+		}
+
+		c.interrupt(ctx)
+	}()
+
+	return stop
+}
+
+func (c *deadlineConn) interrupt(ctx context.Context) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	if c.ctx == ctx {
+		c.rdl = aLongTimeAgo
+		_ = c.Conn.SetReadDeadline(c.rdl)
+	}
+
+	if c.wctx == ctx {
+		c.wdl = aLongTimeAgo
+		_ = c.Conn.SetWriteDeadline(c.wdl)
+	}
+}
+
+func stopWatch(stop chan struct{}) {
+	if stop != nil {
+		close(stop)
+	}
+}
+
+func (c *deadlineConn) Close() error {
+	c.mu.Lock()
+
+	stopWatch(c.wstop)
+	stopWatch(c.rstop)
+
+	c.wstop = nil
+	c.rstop = nil
+
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *deadlineConn) Read(p []byte) (n int, err error) {
+	ctx, err := c.readDeadline()
+	if err != nil {
+		return
+	}
+
+	n, err = c.Conn.Read(p)
+
+	return n, ctxErr(ctx, err)
+}
+
+func (c *deadlineConn) Write(p []byte) (n int, err error) {
+	ctx, err := c.writeDeadline()
+	if err != nil {
+		return
+	}
+
+	n, err = c.Conn.Write(p)
+
+	return n, ctxErr(ctx, err)
+}
+
+func (c *deadlineConn) readDeadline() (ctx context.Context, err error) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	ctx = c.ctx
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	dl := deadline(ctx, c.readTimeout)
+
+	if dl != c.rdl {
+		err = c.Conn.SetReadDeadline(dl)
+		if err != nil {
+			return
+		}
+
+		c.rdl = dl
+	}
+
+	return ctx, nil
+}
+
+func (c *deadlineConn) writeDeadline() (ctx context.Context, err error) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	ctx = c.wctx
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	dl := deadline(ctx, c.writeTimeout)
+
+	if dl != c.wdl {
+		err = c.Conn.SetWriteDeadline(dl)
+		if err != nil {
+			return
+		}
+
+		c.wdl = dl
+	}
+
+	return ctx, nil
+}
+
+func deadline(ctx context.Context, timeout time.Duration) (dl time.Time) {
+	dl, _ = ctx.Deadline()
+
+	if timeout <= 0 {
+		return dl
+	}
+
+	t := time.Now().Add(timeout)
+
+	if dl.IsZero() || t.Before(dl) {
+		dl = t
+	}
+
+	return dl
+}
+
+// ctxErr replaces timeout error by the context error if it's done.
+func ctxErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+
+	// connection deadline may fire before the context timer
+	if dl, ok := ctx.Deadline(); ok && !time.Now().Before(dl) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/ClickHouse/clickhouse-go/lib/protocol"
 	click "github.com/nikandfor/clickhouse"
 	"github.com/nikandfor/errors"
+	"github.com/nikandfor/tlog"
 )
 
 type (
@@ -16,8 +17,10 @@ type (
 		Auth func(context.Context, *Server) error
 
 		// server response
-		Server   click.Agent
-		TimeZone string
+		Server       click.Agent
+		TimeZone     string
+		DisplayName  string
+		VersionPatch int
 
 		// client request
 		Client click.Agent
@@ -33,7 +36,7 @@ func NewServerConn(ctx context.Context, conn net.Conn) *Server {
 		conn: newConn(ctx, conn),
 		Server: click.Agent{
 			Name: "Clickhouse",
-			Ver:  click.Ver{21, 11, 54450},
+			Ver:  click.Ver{21, 11, click.DBMS_TCP_PROTOCOL_VERSION},
 		},
 		TimeZone: "UTC",
 	}
@@ -57,7 +60,7 @@ func (c *Server) Hello(ctx context.Context) error {
 	if c.Auth != nil {
 		err = c.Auth(ctx, c)
 		if err != nil {
-			return errors.Wrap(err, "auth")
+			return c.authFailed(ctx, err)
 		}
 	}
 
@@ -74,6 +77,29 @@ func (c *Server) Hello(ctx context.Context) error {
 	return nil
 }
 
+// authFailed reports auth error to the client as an exception.
+// Internal errors are logged and not shown to the client.
+func (c *Server) authFailed(ctx context.Context, err error) error {
+	var exc *click.Exception
+
+	if !errors.As(err, &exc) {
+		tlog.SpanFromContext(ctx).Printw("authentication failed", "user", c.Credentials.User, "err", err)
+
+		exc = &click.Exception{
+			Code:    click.AUTHENTICATION_FAILED,
+			Name:    "DB::Exception",
+			Message: c.Credentials.User + ": Authentication failed",
+		}
+	}
+
+	e := c.SendException(ctx, exc)
+	if e != nil {
+		return errors.Wrap(e, "send auth exception")
+	}
+
+	return errors.Wrap(err, "auth")
+}
+
 func (c *Server) recvHello() (err error) {
 	n, v, err := c.recvClientInfo()
 	if err != nil {
@@ -83,6 +109,11 @@ func (c *Server) recvHello() (err error) {
 	c.Client.Name = n
 	c.Client.Ver = v
 
+	err = c.negotiate(c.Client.Ver, c.Server.Ver)
+	if err != nil {
+		return
+	}
+
 	c.Credentials.Database, err = c.d.String()
 	if err != nil {
 		return
@@ -112,23 +143,41 @@ func (c *Server) sendHello() (err error) {
 		return
 	}
 
-	if c.Server.Ver[2] >= click.DBMS_MIN_REVISION_WITH_SERVER_TIMEZONE {
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_SERVER_TIMEZONE {
 		err = c.e.String(c.TimeZone)
 		if err != nil {
 			return
 		}
 	}
 
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_SERVER_DISPLAY_NAME {
+		err = c.e.String(c.DisplayName)
+		if err != nil {
+			return
+		}
+	}
+
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_VERSION_PATCH {
+		err = c.e.Uvarint(c.VersionPatch)
+		if err != nil {
+			return
+		}
+	}
+
 	return nil
 }
 
 func (c *Server) NextPacket(ctx context.Context) (pk click.ClientPacket, err error) {
+	c.bind(ctx)
+
 	tp, err := c.d.Uvarint()
 
 	return click.ClientPacket(tp), err
 }
 
 func (c *Server) RecvQuery(ctx context.Context) (q *click.Query, err error) {
+	c.bind(ctx)
+
 	q = new(click.Query)
 
 	q.ID, err = c.d.String()
@@ -136,29 +185,29 @@ func (c *Server) RecvQuery(ctx context.Context) (q *click.Query, err error) {
 		return
 	}
 
-	err = c.recvQueryInfo(ctx, q)
+	err = c.recvQueryInfo(c.rev, &q.Info)
 	if err != nil {
-		return
+		return q, errors.Wrap(err, "client info")
 	}
 
-	q.QuotaKey, err = c.d.String()
+	q.QuotaKey, q.Client = q.Info.QuotaKey, q.Info.Client
+
+	q.Settings, err = c.recvSettings(c.rev)
 	if err != nil {
-		return
+		return q, errors.Wrap(err, "settings")
 	}
 
-	for { // settings
-		var s string
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_INTERSERVER_SECRET {
+		var secret string
 
-		s, err = c.d.String()
+		secret, err = c.d.String()
 		if err != nil {
 			return
 		}
 
-		if s == "" {
-			break
+		if secret != "" {
+			return q, errors.New("interserver secret is not supported")
 		}
-
-		panic(s)
 	}
 
 	sc, err := c.d.Uvarint()
@@ -188,10 +237,9 @@ func (c *Server) RecvQuery(ctx context.Context) (q *click.Query, err error) {
 	return q, nil
 }
 
+// recvExtTables receives external tables data blocks terminated by an empty block.
 func (c *Server) recvExtTables(ctx context.Context, q *click.Query) (err error) {
-	var last bool
-
-	for !last {
+	for {
 		var tp click.ClientPacket
 
 		tp, err = c.NextPacket(ctx)
@@ -203,148 +251,187 @@ func (c *Server) recvExtTables(ctx context.Context, q *click.Query) (err error)
 			return errors.New("unexpected packet: %x", tp)
 		}
 
-		var tab string
+		var b *click.Block
 
-		tab, err = c.d.String()
+		b, err = c.RecvBlock(ctx, q.Compressed)
 		if err != nil {
 			return
 		}
 
-		last, err = c.recvExcTable(ctx, q, tab)
-		if err != nil {
-			return
+		if b.Table == "" && b.IsEmpty() {
+			return nil
 		}
-	}
 
-	return nil
-}
+		if b.Table == "" {
+			return errors.New("external table without name")
+		}
 
-func (c *Server) recvExcTable(ctx context.Context, q *click.Query, tab string) (last bool, err error) {
-	if q.Compressed {
-		c.d.SetCompressed(true)
-		defer c.d.SetCompressed(false)
-	}
+		if l := len(q.Tables); l == 0 || q.Tables[l-1].Name != b.Table {
+			q.Tables = append(q.Tables, click.ExtTable{
+				Name:      b.Table,
+				Structure: b.Meta(),
+			})
+		}
 
-	cols, rows, err := c.recvBlockHeader()
-	if err != nil {
-		return false, err
-	}
+		t := &q.Tables[len(q.Tables)-1]
 
-	if tab == "" && cols == 0 && rows == 0 {
-		return true, nil
+		if b.Rows != 0 {
+			t.Blocks = append(t.Blocks, b)
+		}
 	}
-
-	return false, errors.New("implement ext tables please")
 }
 
-func (c *Server) recvQueryInfo(ctx context.Context, q *click.Query) (err error) {
-	var x []byte
-
-	_ = x
+func (c *Server) SendQueryMeta(ctx context.Context, meta click.QueryMeta, compr bool) (err error) {
+	c.bind(ctx)
 
-	x, err = c.d.ReadUvarint()
+	err = c.sendPacket(int(click.ServerData))
 	if err != nil {
 		return
 	}
 
-	//	q.Info = append(q.Info, x...)
-
-	x, err = c.d.ReadString()
+	err = c.e.String("") // table
 	if err != nil {
 		return
 	}
 
-	//	q.Info = append(q.Info, x...)
+	if compr {
+		c.e.SetCompressed(true)
+		defer c.e.SetCompressed(false)
+	}
 
-	x, err = c.d.ReadString()
+	err = c.sendBlockHeader(len(meta), 0)
 	if err != nil {
 		return
 	}
 
-	//	q.Info = append(q.Info, x...)
+	for _, col := range meta {
+		err = c.e.String(col.Name)
+		if err != nil {
+			return
+		}
 
-	x, err = c.d.ReadString()
+		err = c.e.String(col.Type)
+		if err != nil {
+			return
+		}
+	}
+
+	err = c.e.Flush()
 	if err != nil {
 		return
 	}
 
-	//	q.Info = append(q.Info, x...)
+	return nil
+}
 
-	x, err = c.d.ReadUvarint()
-	if err != nil {
-		return
+func (c *Server) SendBlock(ctx context.Context, b *click.Block, compr bool) (err error) {
+	return c.sendBlock(ctx, int(click.ServerData), b, compr)
+}
+
+func (c *Server) SendTotals(ctx context.Context, b *click.Block, compr bool) (err error) {
+	return c.sendBlock(ctx, int(click.ServerTotals), b, compr)
+}
+
+func (c *Server) SendExtremes(ctx context.Context, b *click.Block, compr bool) (err error) {
+	return c.sendBlock(ctx, int(click.ServerExtremes), b, compr)
+}
+
+// SendLog sends server logs block. It's skipped for clients not supporting it.
+func (c *Server) SendLog(ctx context.Context, b *click.Block) (err error) {
+	if c.rev < click.DBMS_MIN_REVISION_WITH_SERVER_LOGS {
+		return nil
 	}
 
-	//	q.Info = append(q.Info, x...)
+	return c.sendBlock(ctx, int(click.ServerLog), b, false)
+}
 
-	x, err = c.d.ReadString()
-	if err != nil {
-		return
+// SendProfileEvents sends profile events block. It's skipped for clients not supporting it.
+func (c *Server) SendProfileEvents(ctx context.Context, b *click.Block) (err error) {
+	if c.rev < click.DBMS_MIN_PROTOCOL_VERSION_WITH_INCREMENTAL_PROFILE_EVENTS {
+		return nil
 	}
 
-	//	q.Info = append(q.Info, x...)
+	return c.sendBlock(ctx, int(click.ServerProfileEvents), b, false)
+}
+
+// SendTableColumns sends table columns description. It's skipped for clients not supporting it.
+func (c *Server) SendTableColumns(ctx context.Context, tc click.TableColumns) (err error) {
+	c.bind(ctx)
 
-	x, err = c.d.ReadString()
+	if c.rev < click.DBMS_MIN_REVISION_WITH_COLUMN_DEFAULTS_METADATA {
+		return nil
+	}
+
+	err = c.sendPacket(int(click.ServerTableColumns))
 	if err != nil {
 		return
 	}
 
-	//	q.Info = append(q.Info, x...)
+	err = c.e.String(tc.Table)
+	if err != nil {
+		return
+	}
 
-	q.Client.Name, q.Client.Ver, err = c.recvClientInfo()
+	err = c.e.String(tc.Columns)
 	if err != nil {
 		return
 	}
 
-	return nil
+	return c.e.Flush()
 }
 
-func (c *Server) SendQueryMeta(ctx context.Context, meta click.QueryMeta, compr bool) (err error) {
-	err = c.sendPacket(int(click.ServerData))
+func (c *Server) SendPartUUIDs(ctx context.Context, ids [][16]byte) (err error) {
+	c.bind(ctx)
+
+	err = c.sendPacket(int(click.ServerPartUUIDs))
 	if err != nil {
 		return
 	}
 
-	err = c.e.String("") // table
+	err = c.e.Uvarint(len(ids))
 	if err != nil {
 		return
 	}
 
-	if compr {
-		c.e.SetCompressed(true)
-		defer c.e.SetCompressed(false)
+	for _, id := range ids {
+		_, err = c.e.Write(id[:])
+		if err != nil {
+			return
+		}
 	}
 
-	err = c.sendBlockHeader(len(meta), 0)
+	return c.e.Flush()
+}
+
+func (c *Server) SendReadTaskRequest(ctx context.Context) (err error) {
+	c.bind(ctx)
+
+	err = c.sendPacket(int(click.ServerReadTaskRequest))
 	if err != nil {
 		return
 	}
 
-	for _, col := range meta {
-		err = c.e.String(col.Name)
-		if err != nil {
-			return
-		}
+	return c.e.Flush()
+}
 
-		err = c.e.String(col.Type)
-		if err != nil {
-			return
-		}
-	}
+func (c *Server) RecvReadTaskResponse(ctx context.Context) (resp string, err error) {
+	c.bind(ctx)
 
-	err = c.e.Flush()
+	ver, err := c.d.Uvarint()
 	if err != nil {
 		return
 	}
 
-	return nil
-}
+	if ver > click.DBMS_CLUSTER_PROCESSING_PROTOCOL_VERSION {
+		return "", errors.New("unsupported read task response version: %v", ver)
+	}
 
-func (c *Server) SendBlock(ctx context.Context, b *click.Block, compr bool) (err error) {
-	return c.sendBlock(ctx, int(click.ServerData), b, compr)
+	return c.d.String()
 }
 
 func (c *Server) SendEndOfStream(ctx context.Context) (err error) {
+	c.bind(ctx)
+
 	err = c.sendPacket(int(click.ServerEndOfStream))
 	if err != nil {
 		return
@@ -353,7 +440,9 @@ func (c *Server) SendEndOfStream(ctx context.Context) (err error) {
 	return c.e.Flush()
 }
 
-func (c *Server) sendPong(ctx context.Context) (err error) {
+func (c *Server) SendPong(ctx context.Context) (err error) {
+	c.bind(ctx)
+
 	err = c.sendPacket(int(click.ServerPong))
 	if err != nil {
 		return
@@ -363,6 +452,8 @@ func (c *Server) sendPong(ctx context.Context) (err error) {
 }
 
 func (c *Server) SendException(ctx context.Context, exc error) (err error) {
+	c.bind(ctx)
+
 	err = c.sendPacket(int(protocol.ServerException))
 	if err != nil {
 		return
@@ -425,6 +516,8 @@ func (c *Server) sendException(exc error) (err error) {
 }
 
 func (c *Server) SendProgress(ctx context.Context, p click.Progress) (err error) {
+	c.bind(ctx)
+
 	err = c.sendPacket(int(click.ServerProgress))
 	if err != nil {
 		return
@@ -445,6 +538,18 @@ func (c *Server) SendProgress(ctx context.Context, p click.Progress) (err error)
 		return
 	}
 
+	if c.rev >= click.DBMS_MIN_REVISION_WITH_CLIENT_WRITE_INFO {
+		err = c.e.Uvarint64(p.WrittenRows)
+		if err != nil {
+			return
+		}
+
+		err = c.e.Uvarint64(p.WrittenBytes)
+		if err != nil {
+			return
+		}
+	}
+
 	err = c.e.Flush()
 	if err != nil {
 		return errors.Wrap(err, "flush")
@@ -454,6 +559,8 @@ func (c *Server) SendProgress(ctx context.Context, p click.Progress) (err error)
 }
 
 func (c *Server) SendProfileInfo(ctx context.Context, p click.ProfileInfo) (err error) {
+	c.bind(ctx)
+
 	err = c.sendPacket(int(click.ServerProfileInfo))
 	if err != nil {
 		return
@@ -0,0 +1,199 @@
+package binary
+
+import (
+	"strconv"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+)
+
+type (
+	settingKind int
+)
+
+// Settings binary serialization used before DBMS_MIN_REVISION_WITH_SETTINGS_SERIALIZED_AS_STRINGS.
+// Numbers, bools and timespans are Uvarints, floats, strings and enums are strings.
+const (
+	settingString settingKind = iota
+	settingUInt
+	settingBool
+)
+
+// settingKinds are well-known settings types for the binary serialization.
+var settingKinds = map[string]settingKind{
+	"max_block_size":                          settingUInt,
+	"max_insert_block_size":                   settingUInt,
+	"min_insert_block_size_rows":              settingUInt,
+	"min_insert_block_size_bytes":             settingUInt,
+	"max_threads":                             settingUInt,
+	"max_execution_time":                      settingUInt,
+	"max_memory_usage":                        settingUInt,
+	"max_memory_usage_for_user":               settingUInt,
+	"max_rows_to_read":                        settingUInt,
+	"max_bytes_to_read":                       settingUInt,
+	"max_result_rows":                         settingUInt,
+	"max_result_bytes":                        settingUInt,
+	"max_rows_to_group_by":                    settingUInt,
+	"max_bytes_before_external_group_by":      settingUInt,
+	"max_bytes_before_external_sort":          settingUInt,
+	"max_query_size":                          settingUInt,
+	"max_ast_depth":                           settingUInt,
+	"max_ast_elements":                        settingUInt,
+	"max_parallel_replicas":                   settingUInt,
+	"max_partitions_per_insert_block":         settingUInt,
+	"max_concurrent_queries_for_user":         settingUInt,
+	"readonly":                                settingUInt,
+	"priority":                                settingUInt,
+	"insert_quorum":                           settingUInt,
+	"insert_quorum_timeout":                   settingUInt,
+	"select_sequential_consistency":           settingUInt,
+	"mutations_sync":                          settingUInt,
+	"replication_alter_partitions_sync":       settingUInt,
+	"connect_timeout":                         settingUInt,
+	"receive_timeout":                         settingUInt,
+	"send_timeout":                            settingUInt,
+	"input_format_allow_errors_num":           settingUInt,
+	"insert_deduplicate":                      settingBool,
+	"insert_distributed_sync":                 settingBool,
+	"async_insert":                            settingBool,
+	"wait_for_async_insert":                   settingBool,
+	"log_queries":                             settingBool,
+	"extremes":                                settingBool,
+	"use_uncompressed_cache":                  settingBool,
+	"join_use_nulls":                          settingBool,
+	"joined_subquery_requires_alias":          settingBool,
+	"skip_unavailable_shards":                 settingBool,
+	"optimize_skip_unused_shards":             settingBool,
+	"prefer_localhost_replica":                settingBool,
+	"flatten_nested":                          settingBool,
+	"input_format_skip_unknown_fields":        settingBool,
+	"input_format_null_as_default":            settingBool,
+	"output_format_json_quote_64bit_integers": settingBool,
+	"allow_experimental_map_type":             settingBool,
+	"input_format_allow_errors_ratio":         settingString,
+	"send_logs_level":                         settingString,
+	"distributed_product_mode":                settingString,
+	"network_compression_method":              settingString,
+	"load_balancing":                          settingString,
+	"totals_mode":                             settingString,
+	"group_by_overflow_mode":                  settingString,
+	"date_time_input_format":                  settingString,
+	"date_time_output_format":                 settingString,
+	"format_csv_delimiter":                    settingString,
+}
+
+func (c *conn) sendSettings(rev int, s click.Settings) (err error) {
+	for _, x := range s {
+		err = c.e.String(x.Name)
+		if err != nil {
+			return
+		}
+
+		if rev >= click.DBMS_MIN_REVISION_WITH_SETTINGS_SERIALIZED_AS_STRINGS {
+			err = c.e.Uvarint64(x.Flags)
+			if err != nil {
+				return
+			}
+
+			err = c.e.String(x.Value)
+			if err != nil {
+				return
+			}
+
+			continue
+		}
+
+		err = c.sendSettingBinary(x)
+		if err != nil {
+			return errors.Wrap(err, "setting %v", x.Name)
+		}
+	}
+
+	return c.e.String("")
+}
+
+func (c *conn) recvSettings(rev int) (s click.Settings, err error) {
+	for {
+		var x click.Setting
+
+		x.Name, err = c.d.String()
+		if err != nil {
+			return
+		}
+
+		if x.Name == "" {
+			return s, nil
+		}
+
+		if rev >= click.DBMS_MIN_REVISION_WITH_SETTINGS_SERIALIZED_AS_STRINGS {
+			x.Flags, err = c.d.Uvarint64()
+			if err != nil {
+				return
+			}
+
+			x.Value, err = c.d.String()
+			if err != nil {
+				return
+			}
+		} else {
+			x.Value, err = c.recvSettingBinary(x.Name)
+			if err != nil {
+				return nil, errors.Wrap(err, "setting %v", x.Name)
+			}
+		}
+
+		s = append(s, x)
+	}
+}
+
+func (c *conn) sendSettingBinary(x click.Setting) (err error) {
+	k, ok := settingKinds[x.Name]
+	if !ok {
+		// guess by the value
+		if _, err := strconv.ParseUint(x.Value, 10, 64); err == nil {
+			k = settingUInt
+		}
+	}
+
+	switch k {
+	case settingUInt:
+		v, err := strconv.ParseUint(x.Value, 10, 64)
+		if err != nil {
+			return errors.New("expected unsigned integer: %q", x.Value)
+		}
+
+		return c.e.Uvarint64(v)
+	case settingBool:
+		v, err := strconv.ParseBool(x.Value)
+		if err != nil {
+			return errors.New("expected bool: %q", x.Value)
+		}
+
+		if v {
+			return c.e.Uvarint(1)
+		}
+
+		return c.e.Uvarint(0)
+	default:
+		return c.e.String(x.Value)
+	}
+}
+
+func (c *conn) recvSettingBinary(name string) (v string, err error) {
+	k, ok := settingKinds[name]
+	if !ok {
+		return "", errors.New("unknown setting type")
+	}
+
+	switch k {
+	case settingUInt, settingBool:
+		x, err := c.d.Uvarint64()
+		if err != nil {
+			return "", err
+		}
+
+		return strconv.FormatUint(x, 10), nil
+	default:
+		return c.d.String()
+	}
+}
@@ -0,0 +1,48 @@
+package binary
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettings(t *testing.T) {
+	ctx := context.Background()
+
+	s := click.Settings{
+		{Name: "max_execution_time", Value: "10"},
+		{Name: "insert_quorum", Value: "2", Flags: click.SettingImportant},
+		{Name: "send_logs_level", Value: "trace"},
+		{Name: "async_insert", Value: "1"},
+	}
+
+	for _, rev := range []int{54213, 54450} {
+		var buf bytes.Buffer
+
+		c := conn{d: NewDecoder(ctx, &buf), e: NewEncoder(ctx, &buf)}
+
+		require.NoError(t, c.sendSettings(rev, s), rev)
+
+		r, err := c.recvSettings(rev)
+		require.NoError(t, err, rev)
+
+		exp := append(click.Settings{}, s...)
+
+		if rev < click.DBMS_MIN_REVISION_WITH_SETTINGS_SERIALIZED_AS_STRINGS {
+			exp[1].Flags = 0
+		}
+
+		assert.Equal(t, exp, r, rev)
+		assert.Zero(t, buf.Len(), rev)
+	}
+
+	var buf bytes.Buffer
+
+	c := conn{d: NewDecoder(ctx, &buf), e: NewEncoder(ctx, &buf)}
+
+	assert.Error(t, c.sendSettings(54213, click.Settings{{Name: "async_insert", Value: "maybe"}}))
+}
@@ -23,6 +23,14 @@ type (
 		RecvProgress(context.Context) (Progress, error)
 		RecvProfileInfo(context.Context) (ProfileInfo, error)
 
+		RecvTableColumns(context.Context) (TableColumns, error)
+		RecvPartUUIDs(context.Context) ([][16]byte, error)
+		SendReadTaskResponse(context.Context, string) error
+
+		// Buffered is the number of packets received before QueryMeta
+		// and not yet returned by NextPacket.
+		Buffered() int
+
 		//	io.Closer
 	}
 
@@ -43,7 +51,17 @@ type (
 		SendProgress(context.Context, Progress) error
 		SendProfileInfo(context.Context, ProfileInfo) error
 
-		//	SendPong(context.Context) error
+		SendTotals(ctx context.Context, b *Block, compr bool) error
+		SendExtremes(ctx context.Context, b *Block, compr bool) error
+		SendLog(context.Context, *Block) error
+		SendProfileEvents(context.Context, *Block) error
+		SendTableColumns(context.Context, TableColumns) error
+		SendPartUUIDs(context.Context, [][16]byte) error
+
+		SendReadTaskRequest(context.Context) error
+		RecvReadTaskResponse(context.Context) (string, error)
+
+		SendPong(context.Context) error
 
 		//	io.Closer
 	}
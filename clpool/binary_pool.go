@@ -2,7 +2,12 @@ package clpool
 
 import (
 	"context"
+	"crypto/tls"
+	"math/rand"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/nikandfor/clickhouse"
 	"github.com/nikandfor/clickhouse/binary"
@@ -11,28 +16,104 @@ import (
 )
 
 type (
+	// BinaryPool opens new binary protocol connections to one of the hosts.
+	// Hosts failed to dial or to handshake are excluded for a backoff period
+	// and probed in background until they are back.
 	BinaryPool struct {
-		addr string
-
 		AgentName string
 
 		Credentials clickhouse.Credentials
 
+		// Strategy selects the host for a new connection.
+		Strategy Strategy
+
+		// MinBackoff and MaxBackoff bound the period failed host is excluded for.
+		// It doubles with each consecutive failure.
+		MinBackoff time.Duration
+		MaxBackoff time.Duration
+
+		// ReadTimeout and WriteTimeout limit each connection read and write.
+		// Zero means no timeout, context deadline is respected anyway.
+		ReadTimeout  time.Duration
+		WriteTimeout time.Duration
+
+		// TLSConfig enables TLS if set.
+		// ServerName is set to the host address if empty.
+		TLSConfig *tls.Config
+
+		// Dialer.Timeout limits dial, TLS handshake and Hello together.
 		net.Dialer
+
+		mu    sync.Mutex
+		hosts []*host
+		conns map[clickhouse.Client]*host
+		next  int
+
+		closed bool
+		stopc  chan struct{}
+		wg     sync.WaitGroup
+
+		now func() time.Time
+	}
+
+	// Strategy is a host selection strategy.
+	Strategy int
+
+	// HostStats is a host state.
+	HostStats struct {
+		Addr      string
+		Conns     int
+		Healthy   bool
+		Fails     int
+		DownUntil time.Time
 	}
+
+	host struct {
+		addr  string
+		conns int
+
+		fails   int
+		down    time.Time // excluded until
+		probing bool
+	}
+)
+
+const (
+	InOrder Strategy = iota
+	Random
+	RoundRobin
+	LeastConns
+)
+
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+
+	// DefaultProbeTimeout limits probe connection if Dialer.Timeout is not set.
+	DefaultProbeTimeout = 10 * time.Second
 )
 
 var _ clickhouse.ClientPool = &BinaryPool{}
 
-func NewBinaryPool(addr string) *BinaryPool {
-	return &BinaryPool{
-		addr:      addr,
+func NewBinaryPool(addrs ...string) *BinaryPool {
+	p := &BinaryPool{
 		AgentName: "gh/nikandfor/clickhouse",
 		Credentials: clickhouse.Credentials{
 			Database: "default",
 			User:     "default",
 		},
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		conns:      make(map[clickhouse.Client]*host),
+		stopc:      make(chan struct{}),
+		now:        time.Now,
+	}
+
+	for _, a := range addrs {
+		p.hosts = append(p.hosts, &host{addr: a})
 	}
+
+	return p
 }
 
 func (p *BinaryPool) Get(ctx context.Context, opts ...clickhouse.ClientOption) (_ clickhouse.Client, err error) {
@@ -47,11 +128,63 @@ func (p *BinaryPool) Get(ctx context.Context, opts ...clickhouse.ClientOption) (
 		}
 	}
 
-	conn, err := net.Dial("tcp", p.addr)
+	hosts, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range hosts {
+		var cl *binary.Client
+
+		cl, err = p.connect(ctx, h.addr, creds)
+		if err != nil && ctxDone(ctx) {
+			return nil, errors.Wrap(err, "connect") // not the host fault
+		}
+
+		if _, ok := err.(*clickhouse.Exception); ok {
+			p.done(h)
+
+			return nil, err
+		}
+
+		if err != nil {
+			tlog.SpanFromContext(ctx).Printw("host failed", "addr", h.addr, "err", err)
+
+			p.fail(h)
+
+			continue
+		}
+
+		p.acquired(h, cl)
+
+		return cl, nil
+	}
+
+	return nil, errors.Wrap(err, "all hosts failed")
+}
+
+func (p *BinaryPool) connect(ctx context.Context, addr string, creds clickhouse.Credentials) (cl *binary.Client, err error) {
+	hctx := ctx
+
+	if p.Timeout > 0 {
+		var cancel func()
+
+		hctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	conn, err := p.DialContext(hctx, "tcp", addr)
 	if err != nil {
 		return nil, errors.Wrap(err, "dial")
 	}
 
+	if p.TLSConfig != nil {
+		conn, err = p.handshake(hctx, conn, addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "tls")
+		}
+	}
+
 	tr := tlog.SpanFromContext(ctx)
 
 	if tr.If("dump_client_conn,dump_conn") {
@@ -68,23 +201,370 @@ func (p *BinaryPool) Get(ctx context.Context, opts ...clickhouse.ClientOption) (
 		_ = conn.Close()
 	}()
 
-	cl := binary.NewClient(ctx, conn)
+	cl = binary.NewClient(ctx, conn)
 
 	cl.Client.Name = p.AgentName
 	cl.Credentials = creds
+	cl.SetTimeouts(p.ReadTimeout, p.WriteTimeout)
+
+	// reads don't respect context cancellation, only deadlines
+	stop := closeOnDone(hctx, conn)
 
-	err = cl.Hello(ctx)
+	err = cl.Hello(hctx)
+	if stop() {
+		err = hctx.Err()
+	}
+
+	if _, ok := err.(*clickhouse.Exception); ok {
+		return nil, err
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "hello")
 	}
 
-	tlog.SpanFromContext(ctx).V("hello").Printw("client hello", "server_conn", cl)
+	tr.V("hello").Printw("client hello", "addr", addr, "server_conn", cl)
 
 	return cl, nil
 }
 
+func (p *BinaryPool) handshake(ctx context.Context, conn net.Conn, addr string) (_ net.Conn, err error) {
+	cfg := p.TLSConfig
+
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+
+		cfg.ServerName, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			cfg.ServerName = addr
+		}
+	}
+
+	tc := tls.Client(conn, cfg)
+
+	err = tc.HandshakeContext(ctx)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
+
 func (p *BinaryPool) Put(ctx context.Context, cl clickhouse.Client, err error) error {
+	p.mu.Lock()
+
+	if h, ok := p.conns[cl]; ok {
+		h.conns--
+		delete(p.conns, cl)
+	}
+
+	p.mu.Unlock()
+
 	return cl.(*binary.Client).Close()
 }
 
-func (p *BinaryPool) Close() error { return nil }
+// Hosts returns hosts states.
+func (p *BinaryPool) Hosts() (s []HostStats) {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	now := p.now()
+
+	for _, h := range p.hosts {
+		s = append(s, HostStats{
+			Addr:      h.addr,
+			Conns:     h.conns,
+			Healthy:   h.healthy(now),
+			Fails:     h.fails,
+			DownUntil: h.down,
+		})
+	}
+
+	return s
+}
+
+// Close stops background probes.
+// Connections in use are closed when returned.
+func (p *BinaryPool) Close() error {
+	p.mu.Lock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.stopc)
+	}
+
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return nil
+}
+
+// pick returns hosts in the order to try them.
+// Healthy hosts are ordered by the Strategy, then excluded ones go
+// by the time they are excluded until.
+func (p *BinaryPool) pick() (hs []*host, err error) {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	if len(p.hosts) == 0 {
+		return nil, errors.New("no hosts")
+	}
+
+	now := p.now()
+
+	var down []*host
+
+	for _, h := range p.hosts {
+		if h.healthy(now) {
+			hs = append(hs, h)
+		} else {
+			down = append(down, h)
+		}
+	}
+
+	switch p.Strategy {
+	case InOrder:
+	case Random:
+		rand.Shuffle(len(hs), func(i, j int) {
+			hs[i], hs[j] = hs[j], hs[i]
+		})
+	case RoundRobin:
+		if len(hs) != 0 {
+			i := p.next % len(hs)
+			p.next++
+
+			hs = append(hs[i:], hs[:i]...)
+		}
+	case LeastConns:
+		sort.SliceStable(hs, func(i, j int) bool {
+			return hs[i].conns < hs[j].conns
+		})
+	}
+
+	sort.SliceStable(down, func(i, j int) bool {
+		return down[i].down.Before(down[j].down)
+	})
+
+	return append(hs, down...), nil
+}
+
+func (p *BinaryPool) acquired(h *host, cl clickhouse.Client) {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	h.conns++
+	p.conns[cl] = h
+
+	h.fails = 0
+	h.down = time.Time{}
+}
+
+// done marks host alive.
+func (p *BinaryPool) done(h *host) {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	h.fails = 0
+	h.down = time.Time{}
+}
+
+// fail excludes host for a backoff period and starts probing it.
+func (p *BinaryPool) fail(h *host) {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	h.fails++
+	h.down = p.now().Add(p.backoff(h.fails))
+
+	if h.probing || p.closed {
+		return
+	}
+
+	h.probing = true
+
+	p.wg.Add(1)
+
+	go p.probe(h)
+}
+
+func (p *BinaryPool) backoff(fails int) time.Duration {
+	d := p.MinBackoff
+	if d <= 0 {
+		d = DefaultMinBackoff
+	}
+
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	for i := 1; i < fails && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	return d
+}
+
+// probe checks excluded host each time its backoff expires until it's alive.
+func (p *BinaryPool) probe(h *host) {
+	defer p.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-p.stopc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		p.mu.Lock()
+		d := h.down.Sub(p.now())
+		alive := h.down.IsZero()
+
+		if alive {
+			h.probing = false
+		}
+
+		p.mu.Unlock()
+
+		if alive {
+			return
+		}
+
+		if d > 0 {
+			t := time.NewTimer(d)
+
+			select {
+			case <-t.C:
+			case <-p.stopc:
+				t.Stop()
+				return
+			}
+		}
+
+		cl, err := p.probeConnect(ctx, h.addr)
+		if cl != nil {
+			_ = cl.Close()
+		}
+
+		if ctx.Err() != nil {
+			return // closed
+		}
+
+		if _, ok := err.(*clickhouse.Exception); ok {
+			err = nil // server is responding
+		}
+
+		if err != nil {
+			tlog.V("probe").Printw("probe host", "addr", h.addr, "err", err)
+
+			p.mu.Lock()
+			h.fails++
+			h.down = p.now().Add(p.backoff(h.fails))
+			p.mu.Unlock()
+
+			continue
+		}
+
+		tlog.Printw("host is back", "addr", h.addr)
+
+		p.done(h)
+	}
+}
+
+func (p *BinaryPool) probeConnect(ctx context.Context, addr string) (*binary.Client, error) {
+	if p.Timeout <= 0 {
+		var cancel func()
+
+		ctx, cancel = context.WithTimeout(ctx, DefaultProbeTimeout)
+		defer cancel()
+	}
+
+	return p.connect(ctx, addr, p.Credentials)
+}
+
+// closeOnDone closes conn when ctx is done.
+// stop ends watching and reports if conn was closed.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	done := make(chan struct{})
+	res := make(chan bool, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			res <- true
+		case <-done:
+			res <- false
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return <-res
+	}
+}
+
+// ctxDone reports whether ctx is canceled or its deadline has passed.
+// Connection deadline may fire before the context timer.
+func ctxDone(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+
+	dl, ok := ctx.Deadline()
+
+	return ok && !time.Now().Before(dl)
+}
+
+func (h *host) healthy(now time.Time) bool {
+	return h.down.IsZero() || !now.Before(h.down)
+}
+
+// ParseStrategy parses strategy name.
+func ParseStrategy(s string) (Strategy, error) {
+	switch s {
+	case "", "in_order":
+		return InOrder, nil
+	case "random":
+		return Random, nil
+	case "round_robin":
+		return RoundRobin, nil
+	case "least_conns":
+		return LeastConns, nil
+	default:
+		return 0, errors.New("unknown strategy: %v", s)
+	}
+}
+
+func (s Strategy) String() string {
+	switch s {
+	case InOrder:
+		return "in_order"
+	case Random:
+		return "random"
+	case RoundRobin:
+		return "round_robin"
+	case LeastConns:
+		return "least_conns"
+	default:
+		return "unknown"
+	}
+}
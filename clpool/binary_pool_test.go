@@ -0,0 +1,250 @@
+package clpool
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/clickhouse/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryPoolFailover(t *testing.T) {
+	ctx := context.Background()
+
+	good := listenHello(t, "127.0.0.1:0")
+	defer good.Close()
+
+	bad := listenHello(t, "127.0.0.1:0")
+	badAddr := bad.Addr().String()
+	_ = bad.Close()
+
+	p := NewBinaryPool(badAddr, good.Addr().String())
+	defer p.Close()
+
+	p.MinBackoff = 50 * time.Millisecond
+	p.MaxBackoff = 50 * time.Millisecond
+
+	cl, err := p.Get(ctx)
+	require.NoError(t, err)
+
+	hs := p.Hosts()
+	assert.False(t, hs[0].Healthy)
+	assert.Equal(t, 1, hs[0].Fails)
+	assert.True(t, hs[1].Healthy)
+	assert.Equal(t, 1, hs[1].Conns)
+
+	assert.NoError(t, p.Put(ctx, cl, nil))
+	assert.Equal(t, 0, p.Hosts()[1].Conns)
+
+	// host is back
+	bad, err = net.Listen("tcp", badAddr)
+	if err != nil {
+		t.Skipf("relisten: %v", err)
+	}
+
+	go serveHello(bad)
+	defer bad.Close()
+
+	assert.Eventually(t, func() bool {
+		h := p.Hosts()[0]
+
+		return h.Healthy && h.Fails == 0
+	}, time.Second, 10*time.Millisecond)
+
+	cl, err = p.Get(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, p.Hosts()[0].Conns)
+	assert.NoError(t, p.Put(ctx, cl, nil))
+}
+
+func TestBinaryPoolCanceled(t *testing.T) {
+	ctx := context.Background()
+
+	hung := listenHung(t, "127.0.0.1:0")
+	defer hung.Close()
+
+	p := NewBinaryPool(hung.Addr().String())
+	defer p.Close()
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	_, err := p.Get(tctx)
+	assert.Error(t, err)
+
+	hs := p.Hosts()
+	assert.True(t, hs[0].Healthy)
+	assert.Equal(t, 0, hs[0].Fails)
+}
+
+func TestBinaryPoolCloseProbing(t *testing.T) {
+	ctx := context.Background()
+
+	bad := listenHello(t, "127.0.0.1:0")
+	badAddr := bad.Addr().String()
+	_ = bad.Close()
+
+	p := NewBinaryPool(badAddr)
+
+	p.MinBackoff = 10 * time.Millisecond
+	p.MaxBackoff = 10 * time.Millisecond
+
+	_, err := p.Get(ctx)
+	assert.Error(t, err)
+
+	// host accepts connections but never answers, probe hangs in Hello
+	bad, err = listenHungErr(badAddr)
+	if err != nil {
+		t.Skipf("relisten: %v", err)
+	}
+
+	defer bad.Close()
+
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		_ = p.Close()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("close hangs")
+	}
+}
+
+func TestBinaryPoolStrategy(t *testing.T) {
+	ctx := context.Background()
+
+	a := listenHello(t, "127.0.0.1:0")
+	defer a.Close()
+
+	b := listenHello(t, "127.0.0.1:0")
+	defer b.Close()
+
+	p := NewBinaryPool(a.Addr().String(), b.Addr().String())
+	defer p.Close()
+
+	conns := func() []int {
+		var r []int
+
+		for _, h := range p.Hosts() {
+			r = append(r, h.Conns)
+		}
+
+		return r
+	}
+
+	p.Strategy = RoundRobin
+
+	x, err := p.Get(ctx)
+	require.NoError(t, err)
+
+	y, err := p.Get(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, []int{1, 1}, conns())
+
+	assert.NoError(t, p.Put(ctx, y, nil))
+	assert.Equal(t, []int{1, 0}, conns())
+
+	p.Strategy = LeastConns
+
+	y, err = p.Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 1}, conns())
+
+	assert.NoError(t, p.Put(ctx, x, nil))
+	assert.NoError(t, p.Put(ctx, y, nil))
+
+	p.Strategy = InOrder
+
+	x, err = p.Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 0}, conns())
+	assert.NoError(t, p.Put(ctx, x, nil))
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, s := range []Strategy{InOrder, Random, RoundRobin, LeastConns} {
+		x, err := ParseStrategy(s.String())
+		assert.NoError(t, err)
+		assert.Equal(t, s, x)
+	}
+
+	_, err := ParseStrategy("first")
+	assert.Error(t, err)
+}
+
+func listenHello(t testing.TB, addr string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+
+	go serveHello(l)
+
+	return l
+}
+
+func serveHello(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer c.Close()
+
+			ctx := context.Background()
+			srv := binary.NewServerConn(ctx, c)
+
+			err := srv.Hello(ctx)
+			if err != nil {
+				return
+			}
+
+			_, _ = io.Copy(io.Discard, c)
+		}()
+	}
+}
+
+func listenHung(t testing.TB, addr string) net.Listener {
+	l, err := listenHungErr(addr)
+	require.NoError(t, err)
+
+	return l
+}
+
+// listenHungErr accepts connections and never answers.
+func listenHungErr(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				_, _ = io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+
+	return l, nil
+}
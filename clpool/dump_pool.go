@@ -119,6 +119,30 @@ func (c dumpClient) RecvProfileInfo(ctx context.Context) (p click.ProfileInfo, e
 	return c.Client.RecvProfileInfo(ctx)
 }
 
+func (c dumpClient) RecvTableColumns(ctx context.Context) (tc click.TableColumns, err error) {
+	defer func() {
+		tlog.SpanFromContext(ctx).Printw("RecvTableColumns", "table_columns", tc, "err", err, dumpFrom(c.Callers))
+	}()
+
+	return c.Client.RecvTableColumns(ctx)
+}
+
+func (c dumpClient) RecvPartUUIDs(ctx context.Context) (ids [][16]byte, err error) {
+	defer func() {
+		tlog.SpanFromContext(ctx).Printw("RecvPartUUIDs", "uuids", len(ids), "err", err, dumpFrom(c.Callers))
+	}()
+
+	return c.Client.RecvPartUUIDs(ctx)
+}
+
+func (c dumpClient) SendReadTaskResponse(ctx context.Context, resp string) (err error) {
+	defer func() {
+		tlog.SpanFromContext(ctx).Printw("SendReadTaskResponse", "resp", resp, "err", err, dumpFrom(c.Callers))
+	}()
+
+	return c.Client.SendReadTaskResponse(ctx, resp)
+}
+
 func dumpFrom(c int) (b tlog.RawMessage) {
 	if c <= 0 {
 		return nil
@@ -0,0 +1,36 @@
+package clpool
+
+import (
+	"context"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+)
+
+// Ping checks the pooled client connection is alive.
+// Clients not implementing click.Pinger are considered alive.
+func Ping(ctx context.Context, cl click.Client) (err error) {
+	p, ok := cl.(click.Pinger)
+	if !ok {
+		return nil
+	}
+
+	err = p.SendPing(ctx)
+	if err != nil {
+		return errors.Wrap(err, "send ping")
+	}
+
+	pk, err := cl.NextPacket(ctx)
+	if err != nil {
+		return errors.Wrap(err, "recv pong")
+	}
+
+	switch pk {
+	case click.ServerPong:
+		return nil
+	case click.ServerException:
+		return cl.RecvException(ctx)
+	default:
+		return errors.New("unexpected packet: %x", pk)
+	}
+}
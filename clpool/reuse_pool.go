@@ -2,46 +2,469 @@ package clpool
 
 import (
 	"context"
-	"sync/atomic"
+	"sync"
+	"time"
 
 	"github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
 )
 
 type (
+	// ReusePool keeps connections of the underlying pool open and reuses them.
+	// Connections are keyed by credentials.
 	ReusePool struct {
 		clickhouse.ClientPool
 
-		// TODO: reuse connections
+		// MaxIdle is the max number of idle connections per key.
+		// Zero means DefaultMaxIdle, negative means no idle connections.
+		MaxIdle int
 
-		closed int32
+		// MaxOpen is the max number of open connections per key.
+		// Get waits for a connection to be returned if the limit is reached.
+		// Zero means no limit.
+		MaxOpen int
+
+		// IdleTimeout closes connections idle for longer.
+		IdleTimeout time.Duration
+
+		// MaxLifetime closes connections created earlier.
+		MaxLifetime time.Duration
+
+		// HealthCheck is called for idle connection before reusing it.
+		// It's Ping by default.
+		HealthCheck func(context.Context, clickhouse.Client) error
+
+		mu     sync.Mutex
+		keys   map[clickhouse.Credentials]*reuseKey
+		inuse  map[clickhouse.Client]*reuseConn
+		stats  ReuseStats
+		closed bool
+
+		stopc chan struct{}
+
+		now func() time.Time
+	}
+
+	// ReuseStats are ReusePool statistics.
+	ReuseStats struct {
+		Open  int
+		Idle  int
+		InUse int
+
+		Hits      int64 // Get served by idle connection
+		Misses    int64 // Get opened new connection
+		Waits     int64 // Get waited for MaxOpen
+		Discarded int64 // closed because of error, unfinished stream or failed health check
+		Expired   int64 // closed by IdleTimeout or MaxLifetime
+	}
+
+	reuseKey struct {
+		idle []*reuseConn // the last is the most recently used
+		open int
+
+		wait chan struct{} // closed when a connection is released
+	}
+
+	reuseConn struct {
+		cl  clickhouse.Client
+		key *reuseKey
+
+		created  time.Time
+		returned time.Time
 	}
 )
 
+const DefaultMaxIdle = 2
+
+var ErrPoolClosed = errors.New("pool closed")
+
 var _ clickhouse.ClientPool = &ReusePool{}
 
 func NewReusePool(pool clickhouse.ClientPool) *ReusePool {
-	return &ReusePool{ClientPool: pool}
+	return &ReusePool{
+		ClientPool:  pool,
+		HealthCheck: Ping,
+		keys:        make(map[clickhouse.Credentials]*reuseKey),
+		inuse:       make(map[clickhouse.Client]*reuseConn),
+		now:         time.Now,
+	}
 }
 
 func (p *ReusePool) Get(ctx context.Context, opts ...clickhouse.ClientOption) (cl clickhouse.Client, err error) {
+	var creds clickhouse.Credentials
+
+	for _, o := range opts {
+		if o, ok := o.(clickhouse.ApplyToCredentialser); ok {
+			err = o.ApplyToCredentials(&creds)
+			if err != nil {
+				return nil, errors.Wrap(err, "credentials option")
+			}
+		}
+	}
+
+	for {
+		p.mu.Lock()
+
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		k := p.key(creds)
+		c, exp := p.popIdle(k)
+
+		var wait chan struct{}
+
+		switch {
+		case c != nil:
+			p.inuse[c.cl] = c
+			p.stats.Hits++
+		case p.MaxOpen <= 0 || k.open < p.MaxOpen:
+			k.open++
+			p.stats.Misses++
+		default:
+			p.stats.Waits++
+			wait = k.wait
+		}
+
+		p.mu.Unlock()
+
+		_ = p.closeAll(ctx, exp)
+
+		if c != nil {
+			if p.HealthCheck != nil {
+				err = p.HealthCheck(ctx, c.cl)
+				if err != nil {
+					p.discard(ctx, c, err)
+
+					continue
+				}
+			}
+
+			return c.cl, nil
+		}
+
+		if wait == nil {
+			return p.open(ctx, k, opts)
+		}
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// popIdle returns the most recently used not expired connection.
+// Expired ones are released and returned to be closed. p.mu must be held.
+func (p *ReusePool) popIdle(k *reuseKey) (c *reuseConn, exp []*reuseConn) {
+	now := p.now()
+
+	for len(k.idle) != 0 {
+		last := len(k.idle) - 1
+
+		c = k.idle[last]
+		k.idle[last] = nil
+		k.idle = k.idle[:last]
+
+		if !p.expired(c, now) {
+			return c, exp
+		}
+
+		p.release(c)
+		p.stats.Expired++
+
+		exp = append(exp, c)
+	}
+
+	return nil, exp
+}
+
+func (p *ReusePool) open(ctx context.Context, k *reuseKey, opts []clickhouse.ClientOption) (cl clickhouse.Client, err error) {
 	cl, err = p.ClientPool.Get(ctx, opts...)
+
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
 	if err != nil {
-		return
+		k.open--
+		p.signal(k)
+
+		return nil, err
+	}
+
+	p.inuse[cl] = &reuseConn{
+		cl:      cl,
+		key:     k,
+		created: p.now(),
 	}
 
 	return cl, nil
 }
 
+// Put returns the client to the idle list.
+// Client is closed if err is not nil (except *clickhouse.Exception)
+// or its response stream was not fully read.
 func (p *ReusePool) Put(ctx context.Context, cl clickhouse.Client, err error) error {
-	if atomic.LoadInt32(&p.closed) != 0 {
+	p.mu.Lock()
+
+	c, ok := p.inuse[cl]
+	if !ok {
+		p.mu.Unlock()
+
 		return p.ClientPool.Put(ctx, cl, err)
 	}
 
-	return p.ClientPool.Put(ctx, cl, err)
-}
+	delete(p.inuse, cl)
+
+	if !p.reusable(c, err) {
+		p.release(c)
+		p.mu.Unlock()
+
+		return p.ClientPool.Put(ctx, cl, err)
+	}
 
-func (p *ReusePool) Close() error {
-	atomic.StoreInt32(&p.closed, 1)
+	c.returned = p.now()
+	c.key.idle = append(c.key.idle, c)
+	p.signal(c.key)
+
+	p.startJanitor()
+
+	p.mu.Unlock()
 
 	return nil
 }
+
+// Stats returns pool statistics.
+func (p *ReusePool) Stats() (s ReuseStats) {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	s = p.stats
+
+	for _, k := range p.keys {
+		s.Open += k.open
+		s.Idle += len(k.idle)
+	}
+
+	s.InUse = len(p.inuse)
+
+	return s
+}
+
+// Close closes idle connections and the underlying pool.
+// Connections in use are closed when returned.
+func (p *ReusePool) Close() (err error) {
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+
+	p.closed = true
+
+	if p.stopc != nil {
+		close(p.stopc)
+	}
+
+	var idle []*reuseConn
+
+	for _, k := range p.keys {
+		for _, c := range k.idle {
+			p.release(c)
+			idle = append(idle, c)
+		}
+
+		k.idle = nil
+	}
+
+	p.mu.Unlock()
+
+	err = p.closeAll(context.Background(), idle)
+
+	e := p.ClientPool.Close()
+	if err == nil {
+		err = e
+	}
+
+	return err
+}
+
+func (p *ReusePool) reusable(c *reuseConn, err error) bool {
+	if p.closed {
+		return false
+	}
+
+	if p.expired(c, p.now()) {
+		p.stats.Expired++
+		return false
+	}
+
+	if err != nil {
+		if _, ok := err.(*clickhouse.Exception); !ok {
+			p.stats.Discarded++
+			return false
+		}
+	}
+
+	if s, ok := c.cl.(interface{ Streaming() bool }); ok && s.Streaming() {
+		p.stats.Discarded++
+		return false
+	}
+
+	if c.cl.Buffered() != 0 {
+		p.stats.Discarded++
+		return false
+	}
+
+	return len(c.key.idle) < p.maxIdle()
+}
+
+func (p *ReusePool) discard(ctx context.Context, c *reuseConn, err error) {
+	p.mu.Lock()
+
+	delete(p.inuse, c.cl)
+	p.release(c)
+	p.stats.Discarded++
+
+	p.mu.Unlock()
+
+	_ = p.ClientPool.Put(ctx, c.cl, err)
+}
+
+// release frees open connection slot. p.mu must be held.
+func (p *ReusePool) release(c *reuseConn) {
+	c.key.open--
+	p.signal(c.key)
+}
+
+// signal wakes up Get waiting for the key. p.mu must be held.
+func (p *ReusePool) signal(k *reuseKey) {
+	close(k.wait)
+	k.wait = make(chan struct{})
+}
+
+func (p *ReusePool) key(creds clickhouse.Credentials) *reuseKey {
+	k, ok := p.keys[creds]
+	if !ok {
+		k = &reuseKey{
+			wait: make(chan struct{}),
+		}
+
+		p.keys[creds] = k
+	}
+
+	return k
+}
+
+func (p *ReusePool) expired(c *reuseConn, now time.Time) bool {
+	if p.MaxLifetime > 0 && now.Sub(c.created) >= p.MaxLifetime {
+		return true
+	}
+
+	if p.IdleTimeout > 0 && !c.returned.IsZero() && now.Sub(c.returned) >= p.IdleTimeout {
+		return true
+	}
+
+	return false
+}
+
+func (p *ReusePool) maxIdle() int {
+	switch {
+	case p.MaxIdle == 0:
+		return DefaultMaxIdle
+	case p.MaxIdle < 0:
+		return 0
+	default:
+		return p.MaxIdle
+	}
+}
+
+// startJanitor starts closing expired idle connections in background. p.mu must be held.
+func (p *ReusePool) startJanitor() {
+	if p.stopc != nil || p.IdleTimeout <= 0 && p.MaxLifetime <= 0 {
+		return
+	}
+
+	d := p.IdleTimeout
+	if d <= 0 || p.MaxLifetime > 0 && p.MaxLifetime < d {
+		d = p.MaxLifetime
+	}
+
+	d /= 2
+	if d < time.Second {
+		d = time.Second
+	}
+
+	p.stopc = make(chan struct{})
+
+	go p.janitor(d, p.stopc)
+}
+
+func (p *ReusePool) janitor(d time.Duration, stopc chan struct{}) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-stopc:
+			return
+		}
+
+		p.closeExpired()
+	}
+}
+
+func (p *ReusePool) closeExpired() {
+	p.mu.Lock()
+
+	now := p.now()
+
+	var exp []*reuseConn
+
+	for creds, k := range p.keys {
+		i := 0
+
+		for _, c := range k.idle {
+			if p.expired(c, now) {
+				p.release(c)
+				p.stats.Expired++
+
+				exp = append(exp, c)
+
+				continue
+			}
+
+			k.idle[i] = c
+			i++
+		}
+
+		for j := i; j < len(k.idle); j++ {
+			k.idle[j] = nil
+		}
+
+		k.idle = k.idle[:i]
+
+		if k.open == 0 {
+			delete(p.keys, creds)
+		}
+	}
+
+	p.mu.Unlock()
+
+	_ = p.closeAll(context.Background(), exp)
+}
+
+func (p *ReusePool) closeAll(ctx context.Context, cs []*reuseConn) (err error) {
+	for _, c := range cs {
+		e := p.ClientPool.Put(ctx, c.cl, nil)
+		if err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,164 @@
+package clpool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	fakePool struct {
+		opened, closed int
+	}
+
+	fakeClient struct {
+		click.Client
+
+		id        int
+		streaming bool
+		bad       bool
+	}
+)
+
+func TestReusePool(t *testing.T) {
+	ctx := context.Background()
+
+	inner := &fakePool{}
+	p := NewReusePool(inner)
+
+	now := time.Unix(1000, 0)
+	p.now = func() time.Time { return now }
+
+	p.HealthCheck = func(ctx context.Context, cl click.Client) error {
+		if cl.(*fakeClient).bad {
+			return errors.New("bad")
+		}
+
+		return nil
+	}
+
+	p.MaxIdle = 1
+	p.IdleTimeout = time.Minute
+
+	a, err := p.Get(ctx)
+	require.NoError(t, err)
+
+	b, err := p.Get(ctx)
+	require.NoError(t, err)
+
+	assert.NoError(t, p.Put(ctx, a, nil))
+	assert.NoError(t, p.Put(ctx, b, nil)) // exceeds MaxIdle
+
+	assert.Equal(t, 1, inner.closed)
+
+	c, err := p.Get(ctx)
+	require.NoError(t, err)
+	assert.True(t, c == a, "reused")
+
+	// error
+	assert.NoError(t, p.Put(ctx, c, errors.New("broken")))
+	assert.Equal(t, 2, inner.closed)
+
+	// exception is fine
+	c, err = p.Get(ctx)
+	require.NoError(t, err)
+	assert.NoError(t, p.Put(ctx, c, &click.Exception{Code: 60}))
+
+	// unfinished stream
+	c, err = p.Get(ctx)
+	require.NoError(t, err)
+
+	c.(*fakeClient).streaming = true
+	assert.NoError(t, p.Put(ctx, c, nil))
+	assert.Equal(t, 3, inner.closed)
+
+	// failed health check
+	c, err = p.Get(ctx)
+	require.NoError(t, err)
+	assert.NoError(t, p.Put(ctx, c, nil))
+
+	c.(*fakeClient).bad = true
+
+	d, err := p.Get(ctx)
+	require.NoError(t, err)
+	assert.True(t, c != d)
+	assert.Equal(t, 4, inner.closed)
+
+	// idle timeout
+	assert.NoError(t, p.Put(ctx, d, nil))
+
+	now = now.Add(2 * time.Minute)
+
+	c, err = p.Get(ctx)
+	require.NoError(t, err)
+	assert.True(t, c != d)
+	assert.Equal(t, 5, inner.closed)
+
+	// other credentials
+	o, err := p.Get(ctx, click.WithCredentials(click.Credentials{User: "other"}))
+	require.NoError(t, err)
+	assert.NoError(t, p.Put(ctx, o, nil))
+	assert.NoError(t, p.Put(ctx, c, nil))
+
+	s := p.Stats()
+	assert.Equal(t, ReuseStats{Open: 2, Idle: 2, Hits: 3, Misses: 7, Discarded: 3, Expired: 1}, s)
+
+	require.NoError(t, p.Close())
+	assert.Equal(t, inner.opened, inner.closed)
+
+	_, err = p.Get(ctx)
+	assert.Equal(t, ErrPoolClosed, err)
+}
+
+func TestReusePoolMaxOpen(t *testing.T) {
+	ctx := context.Background()
+
+	inner := &fakePool{}
+	p := NewReusePool(inner)
+	p.HealthCheck = nil
+	p.MaxOpen = 1
+
+	a, err := p.Get(ctx)
+	require.NoError(t, err)
+
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	_, err = p.Get(tctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = p.Put(ctx, a, nil)
+	}()
+
+	b, err := p.Get(ctx)
+	require.NoError(t, err)
+	assert.True(t, a == b)
+
+	assert.Equal(t, 1, inner.opened)
+	assert.Equal(t, int64(2), p.Stats().Waits)
+}
+
+func (p *fakePool) Get(ctx context.Context, opts ...click.ClientOption) (click.Client, error) {
+	p.opened++
+
+	return &fakeClient{id: p.opened}, nil
+}
+
+func (p *fakePool) Put(ctx context.Context, cl click.Client, err error) error {
+	p.closed++
+
+	return nil
+}
+
+func (p *fakePool) Close() error { return nil }
+
+func (c *fakeClient) Streaming() bool { return c.streaming }
+
+func (c *fakeClient) Buffered() int { return 0 }
@@ -0,0 +1,251 @@
+package clpool
+
+import (
+	"context"
+	"regexp"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/tlog"
+)
+
+type (
+	// Router picks the underlying pool per query by the first matching Route.
+	// The pool is chosen on SendQuery, so the client returned by Get
+	// must not be used before that.
+	Router struct {
+		Routes []Route
+
+		// Default is used if no route matched.
+		// Unmatched queries are rejected if it's nil.
+		Default click.ClientPool
+	}
+
+	// Route matches the query if all of the set conditions match.
+	Route struct {
+		Name string
+
+		Kinds []click.StatementKind
+
+		Users    []string
+		Database *regexp.Regexp
+		Table    *regexp.Regexp
+
+		// Settings must have these values.
+		Settings map[string]string
+
+		// Pool to route the query to. The query is rejected if it's nil.
+		Pool click.ClientPool
+	}
+
+	routeClient struct {
+		click.Client
+
+		r    *Router
+		pool click.ClientPool
+
+		creds click.Credentials
+		opts  []click.ClientOption
+	}
+)
+
+var _ click.ClientPool = &Router{}
+
+func NewRouter(def click.ClientPool, routes ...Route) *Router {
+	return &Router{
+		Routes:  routes,
+		Default: def,
+	}
+}
+
+func (r *Router) Get(ctx context.Context, opts ...click.ClientOption) (_ click.Client, err error) {
+	var creds click.Credentials
+
+	for _, o := range opts {
+		if o, ok := o.(click.ApplyToCredentialser); ok {
+			err = o.ApplyToCredentials(&creds)
+			if err != nil {
+				return nil, errors.Wrap(err, "option: %v", o)
+			}
+		}
+	}
+
+	return &routeClient{
+		r:     r,
+		creds: creds,
+		opts:  opts,
+	}, nil
+}
+
+func (r *Router) Put(ctx context.Context, cl click.Client, err error) error {
+	c := cl.(*routeClient)
+
+	if c.Client == nil {
+		return nil
+	}
+
+	return c.pool.Put(ctx, c.Client, err)
+}
+
+// Close closes all the underlying pools.
+func (r *Router) Close() (err error) {
+	closed := map[click.ClientPool]struct{}{}
+
+	for _, p := range append([]click.ClientPool{r.Default}, r.pools()...) {
+		if p == nil {
+			continue
+		}
+
+		if _, ok := closed[p]; ok {
+			continue
+		}
+
+		closed[p] = struct{}{}
+
+		e := p.Close()
+		if err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+func (r *Router) pools() (ps []click.ClientPool) {
+	for _, rt := range r.Routes {
+		ps = append(ps, rt.Pool)
+	}
+
+	return ps
+}
+
+// Route returns the pool for the query.
+func (r *Router) Route(q *click.Query, creds click.Credentials) (*Route, click.ClientPool, error) {
+	st := q.Statement()
+
+	for i := range r.Routes {
+		rt := &r.Routes[i]
+
+		if !rt.Match(q, &st, creds) {
+			continue
+		}
+
+		if rt.Pool == nil {
+			return rt, nil, reject(rt.Name)
+		}
+
+		return rt, rt.Pool, nil
+	}
+
+	if r.Default == nil {
+		return nil, nil, reject("")
+	}
+
+	return nil, r.Default, nil
+}
+
+// Match reports whether the query matches the route.
+func (rt *Route) Match(q *click.Query, st *click.Statement, creds click.Credentials) bool {
+	if len(rt.Kinds) != 0 && !containsKind(rt.Kinds, st.Kind) {
+		return false
+	}
+
+	if len(rt.Users) != 0 && !contains(rt.Users, creds.User) {
+		return false
+	}
+
+	if rt.Database != nil || rt.Table != nil {
+		db, table := st.Database, st.Table
+		if db == "" {
+			db = creds.Database
+		}
+
+		if rt.Database != nil && !rt.Database.MatchString(db) {
+			return false
+		}
+
+		if rt.Table != nil && !rt.Table.MatchString(table) {
+			return false
+		}
+	}
+
+	for name, val := range rt.Settings {
+		if v, ok := q.Settings.Get(name); !ok || v != val {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *routeClient) SendQuery(ctx context.Context, q *click.Query) (meta click.QueryMeta, err error) {
+	rt, pool, err := c.r.Route(q, c.creds)
+	if err != nil {
+		return nil, err
+	}
+
+	if rt != nil {
+		tlog.SpanFromContext(ctx).V("route").Printw("route", "route", rt.Name)
+	}
+
+	if c.Client != nil && c.pool != pool {
+		err = c.pool.Put(ctx, c.Client, nil)
+		c.Client = nil
+
+		if err != nil {
+			return nil, errors.Wrap(err, "put client")
+		}
+	}
+
+	if c.Client == nil {
+		c.Client, err = pool.Get(ctx, c.opts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "get client")
+		}
+
+		c.pool = pool
+	}
+
+	return c.Client.SendQuery(ctx, q)
+}
+
+func (c *routeClient) Buffered() int {
+	if c.Client == nil {
+		return 0
+	}
+
+	return c.Client.Buffered()
+}
+
+func reject(route string) error {
+	msg := "query is not allowed by the proxy"
+	if route != "" {
+		msg += ": " + route
+	}
+
+	return &click.Exception{
+		Code:    click.ACCESS_DENIED,
+		Name:    "DB::Exception",
+		Message: msg,
+	}
+}
+
+func contains(l []string, s string) bool {
+	for _, x := range l {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsKind(l []click.StatementKind, k click.StatementKind) bool {
+	for _, x := range l {
+		if x == k {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package clpool
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	var exc *click.Exception
+
+	ctx := context.Background()
+
+	write := &fakePool{}
+	read := &fakePool{}
+	node := &fakePool{}
+
+	r := NewRouter(read,
+		Route{Name: "ddl_admin", Kinds: []click.StatementKind{click.StatementDDL}, Users: []string{"admin"}, Pool: node},
+		Route{Name: "ddl", Kinds: []click.StatementKind{click.StatementDDL}},
+		Route{Name: "inserts", Kinds: []click.StatementKind{click.StatementInsert}, Pool: write},
+		Route{Name: "logs", Database: regexp.MustCompile("^logs$"), Table: regexp.MustCompile("^events_"), Pool: write},
+		Route{Name: "primary", Settings: map[string]string{"select_sequential_consistency": "1"}, Pool: write},
+	)
+
+	for _, tc := range []struct {
+		q     string
+		user  string
+		db    string
+		sets  click.Settings
+		pool  *fakePool
+		route string
+	}{
+		{q: "SELECT 1", pool: read},
+		{q: "INSERT INTO t VALUES", pool: write, route: "inserts"},
+		{q: "/* batch */ INSERT INTO logs.events_1 FORMAT Native", pool: write, route: "inserts"},
+		{q: "SELECT * FROM `logs`.events_2021", pool: write, route: "logs"},
+		{q: "SELECT * FROM events_2021", db: "logs", pool: write, route: "logs"},
+		{q: "SELECT * FROM logs.other", pool: read},
+		{q: "SELECT * FROM t", sets: click.Settings{{Name: "select_sequential_consistency", Value: "1"}}, pool: write, route: "primary"},
+		{q: "CREATE TABLE t (a Int32) ENGINE = Memory", user: "admin", pool: node, route: "ddl_admin"},
+		{q: "DROP TABLE t", user: "bob", route: "ddl"},
+	} {
+		q := &click.Query{Query: tc.q, Settings: tc.sets}
+		creds := click.Credentials{User: tc.user, Database: tc.db}
+
+		rt, pool, err := r.Route(q, creds)
+
+		if tc.route == "" {
+			assert.Nil(t, rt, "%v", tc.q)
+		} else if assert.NotNil(t, rt, "%v", tc.q) {
+			assert.Equal(t, tc.route, rt.Name, "%v", tc.q)
+		}
+
+		if tc.pool == nil {
+			if assert.ErrorAs(t, err, &exc) {
+				assert.Equal(t, int32(click.ACCESS_DENIED), exc.Code)
+			}
+
+			continue
+		}
+
+		if assert.NoError(t, err, "%v", tc.q) {
+			assert.True(t, pool == tc.pool, "%v", tc.q)
+		}
+	}
+
+	// client goes back to the pool it was taken from
+	cl, err := r.Get(ctx, click.WithCredentials(click.Credentials{User: "admin"}))
+	require.NoError(t, err)
+
+	_, err = cl.SendQuery(ctx, &click.Query{Query: "SELECT 1"})
+	require.NoError(t, err)
+
+	_, err = cl.SendQuery(ctx, &click.Query{Query: "ALTER TABLE t DELETE WHERE 1"})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, read.opened)
+	assert.Equal(t, 1, read.closed)
+	assert.Equal(t, 1, node.opened)
+
+	require.NoError(t, r.Put(ctx, cl, nil))
+	assert.Equal(t, 1, node.closed)
+
+	// rejected query takes no connection
+	cl, err = r.Get(ctx)
+	require.NoError(t, err)
+
+	_, err = cl.SendQuery(ctx, &click.Query{Query: "DROP TABLE t"})
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(click.ACCESS_DENIED), exc.Code)
+	}
+
+	require.NoError(t, r.Put(ctx, cl, err))
+	assert.Equal(t, 1, node.opened)
+	assert.Equal(t, 0, write.opened)
+}
+
+func (c *fakeClient) SendQuery(ctx context.Context, q *click.Query) (click.QueryMeta, error) {
+	return nil, nil
+}
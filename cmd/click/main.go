@@ -20,10 +20,13 @@ import (
 	"github.com/nikandfor/tlog"
 	"github.com/nikandfor/tlog/ext/tlflag"
 
+	"github.com/nikandfor/clickhouse/auth"
 	"github.com/nikandfor/clickhouse/batcher"
 	"github.com/nikandfor/clickhouse/clpool"
 	"github.com/nikandfor/clickhouse/dsn"
+	"github.com/nikandfor/clickhouse/limiter"
 	"github.com/nikandfor/clickhouse/proxy"
+	"github.com/nikandfor/clickhouse/sqldriver"
 )
 
 func main() {
@@ -38,9 +41,30 @@ func main() {
 			cli.NewFlag("user", "default", ""),
 			cli.NewFlag("pass", "", ""),
 
-			cli.NewFlag("batch-max-interval", time.Minute, "max time to wait for batch to commit. 0 to no batching"),
+			cli.NewFlag("users", "", "users file. clients credentials are forwarded upstream if not set"),
+
+			cli.NewFlag("limits", "", "per user, quota key and host limits file"),
+
+			cli.NewFlag("routes", "", "query routing file. all queries go to dsn if not set"),
+
+			cli.NewFlag("tls-cert", "", "server certificate file. enables tls"),
+			cli.NewFlag("tls-key", "", "server certificate key file"),
+			cli.NewFlag("tls-client-ca", "", "client certificates ca file. requires client certificates"),
+			cli.NewFlag("tls-cert-user", false, "use client certificate common name as the user"),
+
+			cli.NewFlag("batch-max-interval", time.Second, "max time to wait for batch to commit. 0 to no batching"),
 			cli.NewFlag("batch-max-rows", 1000000, "max rows in the batch"),
 			cli.NewFlag("batch-max-size", "100MiB", "max batch size"),
+			cli.NewFlag("batch-ack", "wait", "when to acknowledge inserts: wait (committed) or async (buffered)"),
+			cli.NewFlag("batch-ack-tables", "", "per table ack modes: db.table=async,table=wait"),
+
+			cli.NewFlag("pool-max-idle", clpool.DefaultMaxIdle, "max idle connections per user. negative to not reuse connections"),
+			cli.NewFlag("pool-max-open", 0, "max open connections per user"),
+			cli.NewFlag("pool-idle-timeout", 10*time.Minute, "close connections idle for longer"),
+			cli.NewFlag("pool-max-lifetime", time.Hour, "close connections older than that"),
+			cli.NewFlag("pool-keepalive", 15*time.Second, "tcp keepalive period for upstream connections. negative to disable"),
+			cli.NewFlag("pool-min-backoff", clpool.DefaultMinBackoff, "exclude failed host for at least that"),
+			cli.NewFlag("pool-max-backoff", clpool.DefaultMaxBackoff, "exclude failed host for at most that"),
 		},
 	}
 
@@ -61,7 +85,7 @@ func main() {
 		Name:        "test",
 		Description: "test commands",
 		Flags: []*cli.Flag{
-			cli.NewFlag("driver", "clickhouse", "sql driver"),
+			cli.NewFlag("driver", sqldriver.DriverName, "sql driver (clickhouse for clickhouse-go)"),
 			cli.NewFlag("dsn,d", "tcp://:9000", "address to connect to"),
 		},
 		Commands: []*cli.Command{{
@@ -133,14 +157,17 @@ func proxyRun(c *cli.Command) (err error) {
 	ctx := context.Background()
 	ctx = tlog.ContextWithSpan(ctx, tr)
 
-	d, err := dsn.Parse(c.String("dsn"))
+	pool, err := newPool(c, c.String("dsn"))
 	if err != nil {
-		return errors.Wrap(err, "parse dsn")
+		return err
 	}
 
-	var pool click.ClientPool
-
-	pool = clpool.NewBinaryPool(d.Hosts[0])
+	if q := c.String("routes"); q != "" {
+		pool, err = loadRoutes(c, q, pool)
+		if err != nil {
+			return errors.Wrap(err, "load routes")
+		}
+	}
 
 	if q := c.Duration("batch-max-interval"); q != 0 {
 		b := batcher.New(ctx, pool)
@@ -153,11 +180,51 @@ func proxyRun(c *cli.Command) (err error) {
 			return errors.Wrap(err, "parse batch size")
 		}
 
+		b.Ack, err = batcher.ParseAckMode(c.String("batch-ack"))
+		if err != nil {
+			return errors.Wrap(err, "parse batch ack")
+		}
+
+		b.TableAck, err = parseTableAck(c.String("batch-ack-tables"))
+		if err != nil {
+			return errors.Wrap(err, "parse batch ack tables")
+		}
+
 		pool = b
 	}
 
 	p := proxy.New(ctx, pool)
 
+	if q := c.String("users"); q != "" {
+		p.Auth, err = auth.LoadFile(q)
+		if err != nil {
+			return errors.Wrap(err, "load users")
+		}
+	}
+
+	if q := c.String("limits"); q != "" {
+		p.Limiter, err = limiter.LoadFile(q)
+		if err != nil {
+			return errors.Wrap(err, "load limits")
+		}
+	}
+
+	if q := c.String("tls-cert"); q != "" {
+		cl, err := proxy.NewCertLoader(q, c.String("tls-key"))
+		if err != nil {
+			return errors.Wrap(err, "load certificate")
+		}
+
+		p.TLSConfig, err = proxy.ServerTLSConfig(cl, c.String("tls-client-ca"))
+		if err != nil {
+			return errors.Wrap(err, "tls config")
+		}
+
+		if c.Bool("tls-cert-user") {
+			p.CertCredentials = proxy.CommonNameUser
+		}
+	}
+
 	defer func() {
 		e := p.Close()
 		if err == nil {
@@ -186,6 +253,42 @@ func proxyRun(c *cli.Command) (err error) {
 	return err
 }
 
+func newPool(c *cli.Command, addr string) (_ click.ClientPool, err error) {
+	d, err := dsn.Parse(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse dsn")
+	}
+
+	bp := clpool.NewBinaryPool(d.Hosts...)
+
+	bp.Strategy, err = clpool.ParseStrategy(d.Strategy)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse dsn")
+	}
+
+	bp.TLSConfig, err = d.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "tls config")
+	}
+
+	bp.Timeout = d.DialTimeout
+	bp.ReadTimeout = d.ReadTimeout
+	bp.WriteTimeout = d.WriteTimeout
+	bp.KeepAlive = c.Duration("pool-keepalive")
+
+	bp.MinBackoff = c.Duration("pool-min-backoff")
+	bp.MaxBackoff = c.Duration("pool-max-backoff")
+
+	rp := clpool.NewReusePool(bp)
+
+	rp.MaxIdle = c.Int("pool-max-idle")
+	rp.MaxOpen = c.Int("pool-max-open")
+	rp.IdleTimeout = c.Duration("pool-idle-timeout")
+	rp.MaxLifetime = c.Duration("pool-max-lifetime")
+
+	return rp, nil
+}
+
 func testQuery(c *cli.Command) (err error) {
 	db, err := sql.Open(c.String("driver"), c.String("dsn"))
 	if err != nil {
@@ -339,3 +442,25 @@ func parseSize(s string) (sz int64, err error) {
 
 	return sz, nil
 }
+
+func parseTableAck(s string) (m map[string]batcher.AckMode, err error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	m = make(map[string]batcher.AckMode)
+
+	for _, x := range strings.Split(s, ",") {
+		p := strings.IndexByte(x, '=')
+		if p < 0 {
+			return nil, errors.New("bad table ack: %v", x)
+		}
+
+		m[x[:p]], err = batcher.ParseAckMode(x[p+1:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
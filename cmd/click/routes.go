@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/nikandfor/cli"
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/nikandfor/clickhouse/clpool"
+)
+
+type (
+	// routesConfig is a query routing file.
+	//
+	//	pools:
+	//	  write: tcp://ch-write:9000
+	//	  read: tcp://ch-read-1:9000,ch-read-2:9000
+	//	routes:
+	//	  - name: inserts
+	//	    kinds: [insert]
+	//	    pool: write
+	//	  - name: ddl # no pool means reject
+	//	    kinds: [ddl, system]
+	//	default: read
+	routesConfig struct {
+		// Pools are named dsns. The dsn flag pool is named "default".
+		Pools map[string]string `yaml:"pools"`
+
+		Routes []routeConfig `yaml:"routes"`
+
+		// Default pool name. The dsn flag pool is used if empty.
+		Default string `yaml:"default"`
+	}
+
+	routeConfig struct {
+		Name     string            `yaml:"name"`
+		Kinds    []string          `yaml:"kinds"`
+		Users    []string          `yaml:"users"`
+		Database string            `yaml:"database"`
+		Table    string            `yaml:"table"`
+		Settings map[string]string `yaml:"settings"`
+		Pool     string            `yaml:"pool"`
+	}
+)
+
+func loadRoutes(c *cli.Command, name string, def click.ClientPool) (_ click.ClientPool, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+
+	var conf routesConfig
+
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+
+	pools := map[string]click.ClientPool{
+		"default": def,
+	}
+
+	for name, addr := range conf.Pools {
+		pools[name], err = newPool(c, addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "pool %v", name)
+		}
+	}
+
+	pool := func(name string) (click.ClientPool, error) {
+		if name == "" {
+			return nil, nil
+		}
+
+		p, ok := pools[name]
+		if !ok {
+			return nil, errors.New("no such pool: %v", name)
+		}
+
+		return p, nil
+	}
+
+	r := clpool.NewRouter(nil)
+
+	r.Default, err = pool(conf.Default)
+	if err != nil {
+		return nil, errors.Wrap(err, "default")
+	}
+
+	if r.Default == nil {
+		r.Default = def
+	}
+
+	for i, rc := range conf.Routes {
+		rt := clpool.Route{
+			Name:     rc.Name,
+			Users:    rc.Users,
+			Settings: rc.Settings,
+		}
+
+		if rt.Name == "" {
+			rt.Name = strconv.Itoa(i)
+		}
+
+		for _, k := range rc.Kinds {
+			kind, err := click.ParseStatementKind(k)
+			if err != nil {
+				return nil, errors.Wrap(err, "route %v", rt.Name)
+			}
+
+			rt.Kinds = append(rt.Kinds, kind)
+		}
+
+		rt.Database, err = compile(rc.Database)
+		if err != nil {
+			return nil, errors.Wrap(err, "route %v: database", rt.Name)
+		}
+
+		rt.Table, err = compile(rc.Table)
+		if err != nil {
+			return nil, errors.Wrap(err, "route %v: table", rt.Name)
+		}
+
+		rt.Pool, err = pool(rc.Pool)
+		if err != nil {
+			return nil, errors.Wrap(err, "route %v", rt.Name)
+		}
+
+		r.Routes = append(r.Routes, rt)
+	}
+
+	return r, nil
+}
+
+func compile(re string) (*regexp.Regexp, error) {
+	if re == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + re + ")$")
+}
@@ -0,0 +1,612 @@
+package clickhouse
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nikandfor/errors"
+)
+
+type (
+	// ColType is a parsed column type.
+	// It knows how Column.RawData is laid out for the type.
+	ColType interface {
+		String() string
+
+		// Size is an encoded value size or 0 if it's variable.
+		Size() int
+
+		prefixLen() int
+		readPrefix(r Reader, raw []byte) ([]byte, error)
+		appendPrefix(b []byte) []byte
+
+		readData(r Reader, rows int, raw []byte) ([]byte, error)
+		dataLen(raw []byte, rows int) (int, error)
+		appendData(dst []byte, drows int, src []byte, srows int) ([]byte, error)
+	}
+
+	Reader interface {
+		io.Reader
+		io.ByteReader
+	}
+
+	typeFunc func(name string, args []string) (ColType, error)
+
+	baseType struct {
+		name string
+	}
+
+	fixedType struct {
+		baseType
+		size int
+	}
+
+	stringType struct {
+		baseType
+	}
+
+	nullableType struct {
+		baseType
+		elem ColType
+	}
+
+	arrayType struct {
+		baseType
+		elem ColType
+	}
+)
+
+// maxArrayElems limits the number of nested array elements in a block read from the wire.
+const maxArrayElems = 1 << 30
+
+// maxStringLen limits a single string value read from the wire.
+const maxStringLen = 1 << 30
+
+var (
+	types = map[string]typeFunc{}
+
+	typesCache sync.Map // string -> ColType
+)
+
+func init() {
+	for name, size := range map[string]int{
+		"Int8": 1, "UInt8": 1, "Bool": 1,
+		"Int16": 2, "UInt16": 2,
+		"Int32": 4, "UInt32": 4,
+		"Int64": 8, "UInt64": 8,
+		"Int128": 16, "UInt128": 16,
+		"Int256": 32, "UInt256": 32,
+		"Float32": 4, "Float64": 8,
+		"Date": 2, "Date32": 4,
+		"UUID": 16, "IPv4": 4, "IPv6": 16,
+	} {
+		types[name] = newFixed(size, 0)
+	}
+
+	for name, size := range map[string]int{
+		"Decimal32": 4, "Decimal64": 8, "Decimal128": 16, "Decimal256": 32,
+	} {
+		types[name] = newFixed(size, 1) // scale
+	}
+
+	types["String"] = newString
+	types["FixedString"] = newFixedString
+	types["DateTime"] = newDateTime
+	types["DateTime64"] = newDateTime64
+	types["Decimal"] = newDecimal
+
+	types["Nullable"] = newNullable
+	types["Array"] = newArray
+}
+
+// ParseColType parses column type as it's written in the schema.
+func ParseColType(s string) (t ColType, err error) {
+	if t, ok := typesCache.Load(s); ok {
+		return t.(ColType), nil
+	}
+
+	t, err = parseColType(s)
+	if err != nil {
+		return nil, err
+	}
+
+	typesCache.Store(s, t)
+
+	return t, nil
+}
+
+// ReadColumnData reads rows values of type t and appends them to raw as they were on the wire.
+func ReadColumnData(r Reader, t ColType, rows int, raw []byte) (_ []byte, err error) {
+	if rows == 0 {
+		return raw, nil
+	}
+
+	raw, err = t.readPrefix(r, raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "prefix")
+	}
+
+	return t.readData(r, rows, raw)
+}
+
+// AppendColumnData merges two columns of type t.
+// Simple types are just concatenated, composite ones are rearranged.
+func AppendColumnData(t ColType, dst []byte, drows int, src []byte, srows int) ([]byte, error) {
+	if srows == 0 {
+		return dst, nil
+	}
+
+	if drows == 0 {
+		return append(dst[:0], src...), nil
+	}
+
+	p := t.prefixLen()
+
+	if len(dst) < p || len(src) < p {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	data, err := t.appendData(dst[p:], drows, src[p:], srows)
+	if err != nil {
+		return nil, err
+	}
+
+	if p == 0 {
+		return data, nil
+	}
+
+	res := make([]byte, 0, p+len(data))
+
+	res = append(res, dst[:p]...)
+	res = append(res, data...)
+
+	return res, nil
+}
+
+// ColumnDataLen returns the size of rows values of type t at the beginning of raw.
+func ColumnDataLen(t ColType, raw []byte, rows int) (int, error) {
+	if rows == 0 {
+		return 0, nil
+	}
+
+	p := t.prefixLen()
+
+	if len(raw) < p {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	l, err := t.dataLen(raw[p:], rows)
+	if err != nil {
+		return 0, err
+	}
+
+	return p + l, nil
+}
+
+func parseColType(s string) (t ColType, err error) {
+	s = strings.TrimSpace(s)
+
+	name, args, err := splitType(s)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := types[name]
+	if !ok {
+		return nil, errors.New("unsupported type: %v", s)
+	}
+
+	t, err = f(s, args)
+	if err != nil {
+		return nil, errors.Wrap(err, "%v", s)
+	}
+
+	return t, nil
+}
+
+// splitType splits `Name(arg1, arg2)` into the name and top-level arguments.
+func splitType(s string) (name string, args []string, err error) {
+	p := strings.IndexByte(s, '(')
+	if p == -1 {
+		return s, nil, nil
+	}
+
+	if !strings.HasSuffix(s, ")") {
+		return "", nil, errors.New("bad type: %v", s)
+	}
+
+	name = strings.TrimSpace(s[:p])
+
+	depth := 0
+	quote := false
+	st := p + 1
+
+	for i := st; i < len(s)-1; i++ {
+		switch c := s[i]; {
+		case quote && c == '\\':
+			i++
+		case c == '\'':
+			quote = !quote
+		case quote:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+
+			if depth < 0 {
+				return "", nil, errors.New("bad type: %v", s)
+			}
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[st:i]))
+			st = i + 1
+		}
+	}
+
+	if depth != 0 || quote {
+		return "", nil, errors.New("bad type: %v", s)
+	}
+
+	if a := strings.TrimSpace(s[st : len(s)-1]); a != "" || len(args) != 0 {
+		args = append(args, a)
+	}
+
+	return name, args, nil
+}
+
+func newFixed(size, nargs int) typeFunc {
+	return func(name string, args []string) (ColType, error) {
+		if len(args) != nargs {
+			return nil, errors.New("expected %d args", nargs)
+		}
+
+		return fixedType{baseType: baseType{name: name}, size: size}, nil
+	}
+}
+
+func newString(name string, args []string) (ColType, error) {
+	if len(args) != 0 {
+		return nil, errors.New("unexpected args")
+	}
+
+	return stringType{baseType: baseType{name: name}}, nil
+}
+
+func newFixedString(name string, args []string) (ColType, error) {
+	if len(args) != 1 {
+		return nil, errors.New("expected length")
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return nil, errors.New("bad length: %v", args[0])
+	}
+
+	return fixedType{baseType: baseType{name: name}, size: n}, nil
+}
+
+func newDateTime(name string, args []string) (ColType, error) {
+	if len(args) > 1 {
+		return nil, errors.New("too many args")
+	}
+
+	return fixedType{baseType: baseType{name: name}, size: 4}, nil
+}
+
+func newDateTime64(name string, args []string) (ColType, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return nil, errors.New("expected precision and optional timezone")
+	}
+
+	if p, err := strconv.Atoi(args[0]); err != nil || p < 0 || p > 9 {
+		return nil, errors.New("bad precision: %v", args[0])
+	}
+
+	return fixedType{baseType: baseType{name: name}, size: 8}, nil
+}
+
+func newDecimal(name string, args []string) (ColType, error) {
+	if len(args) != 2 {
+		return nil, errors.New("expected precision and scale")
+	}
+
+	p, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("bad precision: %v", args[0])
+	}
+
+	var size int
+
+	switch {
+	case p <= 0:
+		return nil, errors.New("bad precision: %v", args[0])
+	case p <= 9:
+		size = 4
+	case p <= 18:
+		size = 8
+	case p <= 38:
+		size = 16
+	case p <= 76:
+		size = 32
+	default:
+		return nil, errors.New("bad precision: %v", args[0])
+	}
+
+	return fixedType{baseType: baseType{name: name}, size: size}, nil
+}
+
+func newNullable(name string, args []string) (_ ColType, err error) {
+	if len(args) != 1 {
+		return nil, errors.New("expected one arg")
+	}
+
+	t := nullableType{baseType: baseType{name: name}}
+
+	t.elem, err = ParseColType(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func newArray(name string, args []string) (_ ColType, err error) {
+	if len(args) != 1 {
+		return nil, errors.New("expected one arg")
+	}
+
+	t := arrayType{baseType: baseType{name: name}}
+
+	t.elem, err = ParseColType(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t baseType) String() string { return t.name }
+
+func (t baseType) Size() int { return 0 }
+
+func (t baseType) prefixLen() int { return 0 }
+
+func (t baseType) readPrefix(r Reader, raw []byte) ([]byte, error) { return raw, nil }
+
+func (t baseType) appendPrefix(b []byte) []byte { return b }
+
+func (t baseType) appendData(dst []byte, drows int, src []byte, srows int) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (t fixedType) Size() int { return t.size }
+
+func (t fixedType) readData(r Reader, rows int, raw []byte) (_ []byte, err error) {
+	st := len(raw)
+	raw = grow(raw, t.size*rows)
+
+	_, err = io.ReadFull(r, raw[st:])
+	if err != nil {
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+func (t fixedType) dataLen(raw []byte, rows int) (int, error) {
+	l := t.size * rows
+
+	if len(raw) < l {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	return l, nil
+}
+
+func (t stringType) readData(r Reader, rows int, raw []byte) (_ []byte, err error) {
+	for i := 0; i < rows; i++ {
+		var l uint64
+
+		l, err = binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if l > maxStringLen {
+			return nil, errors.New("string is too long: %d", l)
+		}
+
+		raw = appendUvarint(raw, l)
+
+		st := len(raw)
+		raw = grow(raw, int(l))
+
+		_, err = io.ReadFull(r, raw[st:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return raw, nil
+}
+
+func (t stringType) dataLen(raw []byte, rows int) (i int, err error) {
+	for row := 0; row < rows; row++ {
+		l, n := binary.Uvarint(raw[i:])
+		if n <= 0 || l > uint64(len(raw)-i-n) {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		i += n + int(l)
+	}
+
+	return i, nil
+}
+
+func (t nullableType) prefixLen() int { return t.elem.prefixLen() }
+
+func (t nullableType) readPrefix(r Reader, raw []byte) ([]byte, error) {
+	return t.elem.readPrefix(r, raw)
+}
+
+func (t nullableType) appendPrefix(b []byte) []byte { return t.elem.appendPrefix(b) }
+
+func (t nullableType) readData(r Reader, rows int, raw []byte) (_ []byte, err error) {
+	st := len(raw)
+	raw = grow(raw, rows)
+
+	_, err = io.ReadFull(r, raw[st:])
+	if err != nil {
+		return nil, errors.Wrap(err, "nulls")
+	}
+
+	return t.elem.readData(r, rows, raw)
+}
+
+func (t nullableType) dataLen(raw []byte, rows int) (int, error) {
+	if len(raw) < rows {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	l, err := t.elem.dataLen(raw[rows:], rows)
+	if err != nil {
+		return 0, err
+	}
+
+	return rows + l, nil
+}
+
+func (t nullableType) appendData(dst []byte, drows int, src []byte, srows int) (_ []byte, err error) {
+	if len(dst) < drows || len(src) < srows {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	data, err := t.elem.appendData(dst[drows:len(dst):len(dst)], drows, src[srows:], srows)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 0, drows+srows+len(data))
+
+	res = append(res, dst[:drows]...)
+	res = append(res, src[:srows]...)
+	res = append(res, data...)
+
+	return res, nil
+}
+
+func (t arrayType) prefixLen() int { return t.elem.prefixLen() }
+
+func (t arrayType) readPrefix(r Reader, raw []byte) ([]byte, error) {
+	return t.elem.readPrefix(r, raw)
+}
+
+func (t arrayType) appendPrefix(b []byte) []byte { return t.elem.appendPrefix(b) }
+
+func (t arrayType) readData(r Reader, rows int, raw []byte) (_ []byte, err error) {
+	st := len(raw)
+	raw = grow(raw, 8*rows)
+
+	_, err = io.ReadFull(r, raw[st:])
+	if err != nil {
+		return nil, errors.Wrap(err, "offsets")
+	}
+
+	n, err := lastOffset(raw[st:], rows, maxArrayElems)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.elem.readData(r, n, raw)
+}
+
+func (t arrayType) dataLen(raw []byte, rows int) (int, error) {
+	if len(raw) < 8*rows {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n, err := lastOffset(raw, rows, len(raw)-8*rows)
+	if err != nil {
+		return 0, err
+	}
+
+	l, err := t.elem.dataLen(raw[8*rows:], n)
+	if err != nil {
+		return 0, err
+	}
+
+	return 8*rows + l, nil
+}
+
+func (t arrayType) appendData(dst []byte, drows int, src []byte, srows int) (_ []byte, err error) {
+	if len(dst) < 8*drows || len(src) < 8*srows {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	dn, err := lastOffset(dst, drows, len(dst)-8*drows)
+	if err != nil {
+		return nil, err
+	}
+
+	sn, err := lastOffset(src, srows, len(src)-8*srows)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := t.elem.appendData(dst[8*drows:len(dst):len(dst)], dn, src[8*srows:], sn)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 8*(drows+srows), 8*(drows+srows)+len(data))
+
+	copy(res, dst[:8*drows])
+
+	for i := 0; i < srows; i++ {
+		off := binary.LittleEndian.Uint64(src[8*i:])
+
+		binary.LittleEndian.PutUint64(res[8*(drows+i):], off+uint64(dn))
+	}
+
+	res = append(res, data...)
+
+	return res, nil
+}
+
+// lastOffset checks array offsets and returns the number of nested elements.
+// Each element takes at least one byte, so max is the size of the nested data if known.
+func lastOffset(offsets []byte, rows, max int) (int, error) {
+	var prev uint64
+
+	for i := 0; i < rows; i++ {
+		off := binary.LittleEndian.Uint64(offsets[8*i:])
+
+		if off < prev || off > uint64(max) {
+			return 0, errors.New("bad array offset %d: %d (prev %d, max %d)", i, off, prev, max)
+		}
+
+		prev = off
+	}
+
+	return int(prev), nil
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(buf[:], x)
+
+	return append(b, buf[:n]...)
+}
+
+func grow(b []byte, n int) []byte {
+	l := len(b)
+
+	if cap(b)-l < n {
+		b = append(b[:cap(b)], make([]byte, l+n-cap(b))...)
+	}
+
+	return b[:l+n]
+}
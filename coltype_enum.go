@@ -0,0 +1,226 @@
+package clickhouse
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/nikandfor/errors"
+)
+
+type (
+	// Enum is Enum8 or Enum16 name-value mapping.
+	Enum struct {
+		Size int // 1 for Enum8, 2 for Enum16
+
+		Names  map[int16]string
+		Values map[string]int16
+	}
+
+	enumType struct {
+		fixedType
+
+		enum *Enum
+	}
+)
+
+func init() {
+	types["Enum8"] = newEnum(1)
+	types["Enum16"] = newEnum(2)
+}
+
+// ParseEnum parses Enum8 or Enum16 column type.
+func ParseEnum(tp string) (*Enum, error) {
+	t, err := ParseColType(tp)
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := t.(enumType)
+	if !ok {
+		return nil, errors.New("not an enum: %v", tp)
+	}
+
+	return e.enum, nil
+}
+
+func newEnum(size int) typeFunc {
+	return func(name string, args []string) (ColType, error) {
+		if len(args) == 0 {
+			return nil, errors.New("expected values")
+		}
+
+		e := &Enum{
+			Size:   size,
+			Names:  make(map[int16]string, len(args)),
+			Values: make(map[string]int16, len(args)),
+		}
+
+		lo, hi := -1<<(8*size-1), 1<<(8*size-1)-1
+
+		next := 1
+
+		for _, a := range args {
+			n, v, err := parseEnumElem(a, next)
+			if err != nil {
+				return nil, errors.Wrap(err, "%v", a)
+			}
+
+			if v < lo || v > hi {
+				return nil, errors.New("value out of range: %v", a)
+			}
+
+			if _, ok := e.Values[n]; ok {
+				return nil, errors.New("duplicate name: %v", n)
+			}
+
+			if _, ok := e.Names[int16(v)]; ok {
+				return nil, errors.New("duplicate value: %v", v)
+			}
+
+			e.Names[int16(v)] = n
+			e.Values[n] = int16(v)
+
+			next = v + 1
+		}
+
+		return enumType{
+			fixedType: fixedType{baseType: baseType{name: name}, size: size},
+			enum:      e,
+		}, nil
+	}
+}
+
+// parseEnumElem parses `'name' = value` or just `'name'`.
+func parseEnumElem(s string, next int) (name string, v int, err error) {
+	if !strings.HasPrefix(s, "'") {
+		return "", 0, errors.New("expected quoted name")
+	}
+
+	var b strings.Builder
+	i := 1
+
+loop:
+	for ; i < len(s); i++ {
+		c := s[i]
+
+		switch c {
+		case '\'':
+			break loop
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", 0, errors.New("bad escape")
+			}
+
+			c = s[i]
+
+			switch c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			case '0':
+				c = 0
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			}
+		}
+
+		b.WriteByte(c)
+	}
+
+	if i == len(s) {
+		return "", 0, errors.New("unterminated name")
+	}
+
+	rest := strings.TrimSpace(s[i+1:])
+	if rest == "" {
+		return b.String(), next, nil
+	}
+
+	if rest[0] != '=' {
+		return "", 0, errors.New("expected =")
+	}
+
+	v, err = strconv.Atoi(strings.TrimSpace(rest[1:]))
+	if err != nil {
+		return "", 0, errors.New("bad value")
+	}
+
+	return b.String(), v, nil
+}
+
+// Name returns name of the value.
+func (e *Enum) Name(v int16) (n string, ok bool) {
+	n, ok = e.Names[v]
+	return
+}
+
+// Value returns value of the name.
+func (e *Enum) Value(n string) (v int16, ok bool) {
+	v, ok = e.Values[n]
+	return
+}
+
+// DecodeNames converts raw column data into names.
+func (e *Enum) DecodeNames(raw []byte) (names []string, err error) {
+	if len(raw)%e.Size != 0 {
+		return nil, errors.New("bad data size: %d", len(raw))
+	}
+
+	names = make([]string, len(raw)/e.Size)
+
+	for i := range names {
+		v := e.value(raw[i*e.Size:])
+
+		n, ok := e.Names[v]
+		if !ok {
+			return nil, errors.New("unknown enum value: %d (row %d)", v, i)
+		}
+
+		names[i] = n
+	}
+
+	return names, nil
+}
+
+// AppendNames encodes names and appends them to raw column data.
+func (e *Enum) AppendNames(raw []byte, names ...string) ([]byte, error) {
+	for _, n := range names {
+		v, ok := e.Values[n]
+		if !ok {
+			return nil, errors.New("unknown enum name: %q", n)
+		}
+
+		raw = e.appendValue(raw, v)
+	}
+
+	return raw, nil
+}
+
+// Validate checks all the values in raw column data are known.
+func (e *Enum) Validate(raw []byte) error {
+	_, err := e.DecodeNames(raw)
+	return err
+}
+
+func (e *Enum) value(b []byte) int16 {
+	if e.Size == 1 {
+		return int16(int8(b[0]))
+	}
+
+	return int16(binary.LittleEndian.Uint16(b))
+}
+
+func (e *Enum) appendValue(b []byte, v int16) []byte {
+	if e.Size == 1 {
+		return append(b, byte(v))
+	}
+
+	return append(b, byte(v), byte(v>>8))
+}
@@ -0,0 +1,421 @@
+package clickhouse
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/nikandfor/errors"
+)
+
+type (
+	lowCardType struct {
+		baseType
+		elem ColType
+
+		dict     ColType // elem without Nullable
+		nullable bool
+	}
+
+	// lowCardData is decoded LowCardinality column.
+	// keys are raw dict encoded values, keys[0] is NULL for nullable type.
+	lowCardData struct {
+		nullable bool
+
+		keys    [][]byte
+		indexes []int
+
+		idx map[string]int
+	}
+)
+
+// LowCardinality serialization.
+const (
+	lowCardSharedDicts = 1 // keys serialization version
+
+	lowCardKeyTypeMask       = 0xff
+	lowCardNeedGlobalDict    = 1 << 8
+	lowCardHasAdditionalKeys = 1 << 9
+	lowCardNeedUpdateDict    = 1 << 10
+)
+
+func init() {
+	types["LowCardinality"] = newLowCard
+}
+
+func newLowCard(name string, args []string) (_ ColType, err error) {
+	if len(args) != 1 {
+		return nil, errors.New("expected one arg")
+	}
+
+	t := lowCardType{baseType: baseType{name: name}}
+
+	t.elem, err = ParseColType(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	t.dict = t.elem
+
+	if n, ok := t.elem.(nullableType); ok {
+		t.dict = n.elem
+		t.nullable = true
+	}
+
+	if t.dict.prefixLen() != 0 {
+		return nil, errors.New("unsupported dictionary type: %v", t.dict)
+	}
+
+	return t, nil
+}
+
+func (t lowCardType) prefixLen() int { return 8 }
+
+func (t lowCardType) readPrefix(r Reader, raw []byte) (_ []byte, err error) {
+	st := len(raw)
+	raw = grow(raw, 8)
+
+	_, err = io.ReadFull(r, raw[st:])
+	if err != nil {
+		return nil, err
+	}
+
+	if v := binary.LittleEndian.Uint64(raw[st:]); v != lowCardSharedDicts {
+		return nil, errors.New("unsupported LowCardinality keys version: %v", v)
+	}
+
+	return raw, nil
+}
+
+func (t lowCardType) appendPrefix(b []byte) []byte {
+	return appendUInt64(b, lowCardSharedDicts)
+}
+
+func (t lowCardType) readData(r Reader, rows int, raw []byte) (_ []byte, err error) {
+	var keys int
+
+	for rows > 0 {
+		var typ, n uint64
+
+		raw, typ, err = readUInt64(r, raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "index type")
+		}
+
+		if typ&lowCardNeedGlobalDict != 0 {
+			return nil, errors.New("global dictionary is not supported")
+		}
+
+		if typ&lowCardKeyTypeMask > 3 {
+			return nil, errors.New("bad index type: %x", typ)
+		}
+
+		if typ&lowCardHasAdditionalKeys != 0 {
+			raw, n, err = readUInt64(r, raw)
+			if err != nil {
+				return nil, errors.Wrap(err, "keys")
+			}
+
+			if n > maxArrayElems {
+				return nil, errors.New("dictionary is too big: %d", n)
+			}
+
+			keys = int(n)
+
+			raw, err = t.dict.readData(r, keys, raw)
+			if err != nil {
+				return nil, errors.Wrap(err, "keys")
+			}
+		}
+
+		raw, n, err = readUInt64(r, raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "indexes")
+		}
+
+		if n > uint64(rows) {
+			return nil, errors.New("too many indexes: %d > %d", n, rows)
+		}
+
+		if n != 0 && keys == 0 {
+			return nil, errors.New("no dictionary")
+		}
+
+		st := len(raw)
+		raw = grow(raw, int(n)*lowCardKeySize(typ))
+
+		_, err = io.ReadFull(r, raw[st:])
+		if err != nil {
+			return nil, errors.Wrap(err, "indexes")
+		}
+
+		rows -= int(n)
+	}
+
+	return raw, nil
+}
+
+func (t lowCardType) dataLen(raw []byte, rows int) (int, error) {
+	_, l, err := t.decode(raw, rows)
+
+	return l, err
+}
+
+func (t lowCardType) appendData(dst []byte, drows int, src []byte, srows int) (_ []byte, err error) {
+	if drows == 0 && srows == 0 {
+		return nil, nil // no rows, no header
+	}
+
+	d, _, err := t.decode(dst, drows)
+	if err != nil {
+		return nil, err
+	}
+
+	s, _, err := t.decode(src, srows)
+	if err != nil {
+		return nil, err
+	}
+
+	d.merge(s)
+
+	return d.encode(make([]byte, 0, len(dst)+len(src))), nil
+}
+
+// decode parses column data into one dictionary and per row indexes.
+func (t lowCardType) decode(raw []byte, rows int) (d lowCardData, i int, err error) {
+	d.nullable = t.nullable
+	d.indexes = make([]int, 0, rows)
+
+	var dict [][]byte
+
+	for len(d.indexes) < rows {
+		if len(raw) < i+8 {
+			return d, 0, io.ErrUnexpectedEOF
+		}
+
+		typ := binary.LittleEndian.Uint64(raw[i:])
+		i += 8
+
+		if typ&lowCardNeedGlobalDict != 0 {
+			return d, 0, errors.New("global dictionary is not supported")
+		}
+
+		if typ&lowCardKeyTypeMask > 3 {
+			return d, 0, errors.New("bad index type: %x", typ)
+		}
+
+		if typ&lowCardHasAdditionalKeys != 0 {
+			if len(raw) < i+8 {
+				return d, 0, io.ErrUnexpectedEOF
+			}
+
+			n := binary.LittleEndian.Uint64(raw[i:])
+			i += 8
+
+			if n > uint64(len(raw)-i) {
+				return d, 0, errors.New("dictionary is too big: %d", n)
+			}
+
+			dict = make([][]byte, n)
+
+			for k := range dict {
+				l, err := t.dict.dataLen(raw[i:], 1)
+				if err != nil {
+					return d, 0, errors.Wrap(err, "key %d", k)
+				}
+
+				dict[k] = raw[i : i+l]
+				i += l
+			}
+
+			if d.nullable && len(d.keys) == 0 && n != 0 {
+				d.keys = append(d.keys, dict[0])
+			}
+		}
+
+		if len(raw) < i+8 {
+			return d, 0, io.ErrUnexpectedEOF
+		}
+
+		un := binary.LittleEndian.Uint64(raw[i:])
+		i += 8
+
+		if un > uint64(rows-len(d.indexes)) {
+			return d, 0, errors.New("too many indexes: %d > %d", uint64(len(d.indexes))+un, rows)
+		}
+
+		n := int(un)
+
+		size := lowCardKeySize(typ)
+
+		if len(raw) < i+n*size {
+			return d, 0, io.ErrUnexpectedEOF
+		}
+
+		// each chunk may have its own dictionary, bring them together
+		remap := make(map[int]int, len(dict))
+
+		for j := 0; j < n; j++ {
+			var x int
+
+			switch size {
+			case 1:
+				x = int(raw[i])
+			case 2:
+				x = int(binary.LittleEndian.Uint16(raw[i:]))
+			case 4:
+				x = int(binary.LittleEndian.Uint32(raw[i:]))
+			default:
+				x = int(binary.LittleEndian.Uint64(raw[i:]))
+			}
+
+			i += size
+
+			if x >= len(dict) {
+				return d, 0, errors.New("index out of dictionary: %d >= %d", x, len(dict))
+			}
+
+			y, ok := remap[x]
+			if !ok {
+				y = d.key(dict[x], d.nullable && x == 0)
+				remap[x] = y
+			}
+
+			d.indexes = append(d.indexes, y)
+		}
+	}
+
+	return d, i, nil
+}
+
+// key returns key index adding it if needed.
+// For nullable types keys[0] is reserved for NULL.
+func (d *lowCardData) key(k []byte, null bool) int {
+	if null {
+		return 0
+	}
+
+	if i, ok := d.idx[string(k)]; ok {
+		return i
+	}
+
+	if d.idx == nil {
+		d.idx = make(map[string]int)
+	}
+
+	i := len(d.keys)
+
+	d.keys = append(d.keys, k)
+	d.idx[string(k)] = i
+
+	return i
+}
+
+// full decodes rows into elem type data.
+func (t lowCardType) full(raw []byte, rows int) (full []byte, err error) {
+	d, _, err := t.decode(raw, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.nullable {
+		full = make([]byte, rows)
+
+		for i, x := range d.indexes {
+			if x == 0 {
+				full[i] = 1
+			}
+		}
+	}
+
+	for _, x := range d.indexes {
+		full = append(full, d.keys[x]...)
+	}
+
+	return full, nil
+}
+
+func (d *lowCardData) merge(s lowCardData) {
+	if d.nullable && len(d.keys) == 0 && len(s.keys) != 0 {
+		d.keys = append(d.keys, s.keys[0])
+	}
+
+	remap := make([]int, len(s.keys))
+
+	for i, k := range s.keys {
+		remap[i] = d.key(k, d.nullable && i == 0)
+	}
+
+	for _, x := range s.indexes {
+		d.indexes = append(d.indexes, remap[x])
+	}
+}
+
+func (d *lowCardData) encode(b []byte) []byte {
+	var typ uint64
+
+	switch n := uint64(len(d.keys)); {
+	case n <= 1<<8:
+		typ = 0
+	case n <= 1<<16:
+		typ = 1
+	case n <= 1<<32:
+		typ = 2
+	default:
+		typ = 3
+	}
+
+	b = appendUInt64(b, typ|lowCardHasAdditionalKeys|lowCardNeedUpdateDict)
+
+	b = appendUInt64(b, uint64(len(d.keys)))
+
+	for _, k := range d.keys {
+		b = append(b, k...)
+	}
+
+	b = appendUInt64(b, uint64(len(d.indexes)))
+
+	size := lowCardKeySize(typ)
+
+	for _, x := range d.indexes {
+		st := len(b)
+		b = grow(b, size)
+
+		switch size {
+		case 1:
+			b[st] = byte(x)
+		case 2:
+			binary.LittleEndian.PutUint16(b[st:], uint16(x))
+		case 4:
+			binary.LittleEndian.PutUint32(b[st:], uint32(x))
+		default:
+			binary.LittleEndian.PutUint64(b[st:], uint64(x))
+		}
+	}
+
+	return b
+}
+
+func lowCardKeySize(typ uint64) int {
+	return 1 << (typ & lowCardKeyTypeMask)
+}
+
+func readUInt64(r Reader, raw []byte) (_ []byte, x uint64, err error) {
+	st := len(raw)
+	raw = grow(raw, 8)
+
+	_, err = io.ReadFull(r, raw[st:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return raw, binary.LittleEndian.Uint64(raw[st:]), nil
+}
+
+func appendUInt64(b []byte, x uint64) []byte {
+	st := len(b)
+	b = grow(b, 8)
+
+	binary.LittleEndian.PutUint64(b[st:], x)
+
+	return b
+}
@@ -0,0 +1,385 @@
+package clickhouse
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestColTypeSize(t *testing.T) {
+	for tp, size := range map[string]int{
+		"UInt8":                     1,
+		"Int64":                     8,
+		"Float32":                   4,
+		"Float64":                   8,
+		"Bool":                      1,
+		"Date":                      2,
+		"Date32":                    4,
+		"DateTime":                  4,
+		"DateTime('Europe/Moscow')": 4,
+		"DateTime64(3)":             8,
+		"DateTime64(9, 'UTC')":      8,
+		"UUID":                      16,
+		"IPv4":                      4,
+		"IPv6":                      16,
+		"Int128":                    16,
+		"UInt256":                   32,
+		"FixedString(3)":            3,
+		"Decimal32(2)":              4,
+		"Decimal128(10)":            16,
+		"Decimal(9, 2)":             4,
+		"Decimal(18, 2)":            8,
+		"Decimal(38, 10)":           16,
+		"Decimal(76, 10)":           32,
+		"String":                    0,
+	} {
+		ct, err := ParseColType(tp)
+		if assert.NoError(t, err, tp) {
+			assert.Equal(t, size, ct.Size(), tp)
+			assert.Equal(t, tp, ct.String())
+		}
+	}
+
+	for _, tp := range []string{
+		"Unknown",
+		"FixedString",
+		"FixedString(x)",
+		"Decimal(100, 2)",
+		"DateTime64",
+		"String(",
+		"Int8(1)",
+		"Decimal32",
+	} {
+		_, err := ParseColType(tp)
+		assert.Error(t, err, tp)
+	}
+}
+
+func TestColTypeSplit(t *testing.T) {
+	name, args, err := splitType("Enum8('a,b' = 1, 'c\\'' = 2)")
+	require.NoError(t, err)
+	assert.Equal(t, "Enum8", name)
+	assert.Equal(t, []string{"'a,b' = 1", "'c\\'' = 2"}, args)
+
+	name, args, err = splitType("Decimal(P(1, 2), 3)")
+	require.NoError(t, err)
+	assert.Equal(t, "Decimal", name)
+	assert.Equal(t, []string{"P(1, 2)", "3"}, args)
+}
+
+func TestColTypeReadData(t *testing.T) {
+	data := []byte{1, 'a', 0, 3, 'b', 'c', 'd', 0xff}
+
+	ct, err := ParseColType("String")
+	require.NoError(t, err)
+
+	raw, err := ReadColumnData(bytes.NewReader(data), ct, 3, nil)
+	require.NoError(t, err)
+	assert.Equal(t, data[:7], raw)
+
+	ct, err = ParseColType("Float64")
+	require.NoError(t, err)
+
+	data = make([]byte, 17)
+
+	raw, err = ReadColumnData(bytes.NewReader(data), ct, 2, []byte{9})
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{9}, data[:16]...), raw)
+
+	_, err = ReadColumnData(bytes.NewReader(data), ct, 3, nil)
+	assert.Error(t, err)
+
+	ct, err = ParseColType("String")
+	require.NoError(t, err)
+
+	for _, l := range []uint64{1 << 40, ^uint64(0)} { // too long, negative int
+		data = append(appendUvarint(nil, l), 'a')
+
+		_, err = ReadColumnData(bytes.NewReader(data), ct, 1, nil)
+		assert.Error(t, err)
+
+		_, err = ColumnDataLen(ct, data, 1)
+		assert.Error(t, err)
+	}
+}
+
+func TestColTypeNullableArray(t *testing.T) {
+	ct, err := ParseColType("Array(Nullable(String))")
+	require.NoError(t, err)
+
+	// [["a", NULL], []]
+	a := []byte{
+		2, 0, 0, 0, 0, 0, 0, 0, // offsets
+		2, 0, 0, 0, 0, 0, 0, 0,
+		0, 1, // nulls
+		1, 'a', 0, // strings
+	}
+
+	// [[NULL, "bc"]]
+	b := []byte{
+		2, 0, 0, 0, 0, 0, 0, 0, // offsets
+		1, 0, // nulls
+		0, 2, 'b', 'c', // strings
+	}
+
+	raw, err := ReadColumnData(bytes.NewReader(append(a, 0xff)), ct, 2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, a, raw)
+
+	raw, err = AppendColumnData(ct, raw, 2, b, 1)
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{
+		2, 0, 0, 0, 0, 0, 0, 0, // offsets
+		2, 0, 0, 0, 0, 0, 0, 0,
+		4, 0, 0, 0, 0, 0, 0, 0,
+		0, 1, 1, 0, // nulls
+		1, 'a', 0, 0, 2, 'b', 'c', // strings
+	}, raw)
+
+	raw, err = AppendColumnData(ct, nil, 0, b, 1)
+	require.NoError(t, err)
+	assert.Equal(t, b, raw)
+}
+
+func TestColTypeBadArrayOffsets(t *testing.T) {
+	ct, err := ParseColType("Array(UInt8)")
+	require.NoError(t, err)
+
+	good := []byte{
+		1, 0, 0, 0, 0, 0, 0, 0, // offsets
+		2, 0, 0, 0, 0, 0, 0, 0,
+		5, 6, // data
+	}
+
+	for _, tc := range []struct {
+		raw  []byte
+		rows int
+	}{
+		{[]byte{ // negative
+			0x0c, 0, 0, 0, 0, 0, 0, 0x80,
+			1, 2, 3,
+		}, 1},
+		{[]byte{ // decreasing
+			2, 0, 0, 0, 0, 0, 0, 0,
+			1, 0, 0, 0, 0, 0, 0, 0,
+			1, 2,
+		}, 2},
+		{[]byte{ // too large
+			0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0,
+			1, 2,
+		}, 1},
+	} {
+		_, err = ReadColumnData(bytes.NewReader(tc.raw), ct, tc.rows, nil)
+		assert.Error(t, err)
+
+		_, err = ColumnDataLen(ct, tc.raw, tc.rows)
+		assert.Error(t, err)
+
+		_, err = AppendColumnData(ct, good, 2, tc.raw, tc.rows)
+		assert.Error(t, err)
+
+		_, err = AppendColumnData(ct, tc.raw, tc.rows, good, 2)
+		assert.Error(t, err)
+	}
+
+	// truncated data
+	_, err = ColumnDataLen(ct, good[:17], 2)
+	assert.Error(t, err)
+}
+
+func TestColTypeLowCardinality(t *testing.T) {
+	ct, err := ParseColType("LowCardinality(String)")
+	require.NoError(t, err)
+
+	a := lowCardRaw([]string{"a", "b"}, 1, 0)
+	b := lowCardRaw([]string{"c", "b"}, 1, 0, 0)
+
+	raw, err := ReadColumnData(bytes.NewReader(append(a, 0xff)), ct, 2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, a, raw)
+
+	l, err := ColumnDataLen(ct, raw, 2)
+	require.NoError(t, err)
+	assert.Equal(t, len(a), l)
+
+	raw, err = AppendColumnData(ct, raw, 2, b, 3)
+	require.NoError(t, err)
+	assert.Equal(t, lowCardRaw([]string{"b", "a", "c"}, 0, 1, 0, 2, 2), raw)
+
+	ct, err = ParseColType("LowCardinality(Nullable(String))")
+	require.NoError(t, err)
+
+	a = lowCardRaw([]string{"", "a"}, 0, 1)
+	b = lowCardRaw([]string{"", "b", "a"}, 2, 0, 1)
+
+	raw, err = AppendColumnData(ct, a, 2, b, 3)
+	require.NoError(t, err)
+	assert.Equal(t, lowCardRaw([]string{"", "a", "b"}, 0, 1, 1, 0, 2), raw)
+
+	ct, err = ParseColType("LowCardinality(String)")
+	require.NoError(t, err)
+
+	for _, n := range []uint64{1 << 40, ^uint64(0)} {
+		raw = appendUInt64(nil, lowCardSharedDicts)
+		raw = appendUInt64(raw, lowCardHasAdditionalKeys)
+		raw = appendUInt64(raw, n)
+
+		_, err = ReadColumnData(bytes.NewReader(raw), ct, 2, nil)
+		assert.Error(t, err, "keys %x", n)
+
+		raw = lowCardRaw([]string{"a"})
+		raw = appendUInt64(raw[:len(raw)-8], n)
+
+		_, err = ReadColumnData(bytes.NewReader(raw), ct, 2, nil)
+		assert.Error(t, err, "indexes %x", n)
+	}
+}
+
+func TestColTypeLowCardinalityEmptyNested(t *testing.T) {
+	off := func(x ...byte) (b []byte) {
+		for _, x := range x {
+			b = appendUInt64(b, uint64(x))
+		}
+
+		return b
+	}
+
+	for _, tc := range []struct {
+		tp  string
+		res []byte // merged data with only used keys
+	}{
+		{tp: "Array(LowCardinality(String))", res: lowCardRaw([]string{"x"}, 0)[8:]},
+		{tp: "Array(LowCardinality(Nullable(String)))", res: lowCardRaw([]string{"", "x"}, 1)[8:]},
+	} {
+		tp := tc.tp
+
+		ct, err := ParseColType(tp)
+		require.NoError(t, err)
+
+		prefix := appendUInt64(nil, lowCardSharedDicts)
+
+		// [] + []
+		empty := append(prefix, off(0)...)
+
+		raw, err := AppendColumnData(ct, empty, 1, empty, 1)
+		require.NoError(t, err, tp)
+		assert.Equal(t, append(prefix, off(0, 0)...), raw, tp)
+
+		l, err := ColumnDataLen(ct, raw, 2)
+		require.NoError(t, err, tp)
+		assert.Equal(t, len(raw), l, tp)
+
+		// [] + ["x"]
+		x := append(prefix, off(1)...)
+		x = append(x, lowCardRaw([]string{"", "x"}, 1)[8:]...)
+
+		raw, err = AppendColumnData(ct, empty, 1, x, 1)
+		require.NoError(t, err, tp)
+
+		exp := append(prefix, off(0, 1)...)
+		exp = append(exp, tc.res...)
+
+		assert.Equal(t, exp, raw, tp)
+
+		// ["x"] + []
+		raw, err = AppendColumnData(ct, x, 1, empty, 1)
+		require.NoError(t, err, tp)
+
+		exp = append(prefix, off(1, 1)...)
+		exp = append(exp, tc.res...)
+
+		assert.Equal(t, exp, raw, tp)
+	}
+}
+
+func lowCardRaw(keys []string, idx ...byte) (b []byte) {
+	b = appendUInt64(b, lowCardSharedDicts)
+	b = appendUInt64(b, lowCardHasAdditionalKeys|lowCardNeedUpdateDict)
+	b = appendUInt64(b, uint64(len(keys)))
+
+	for _, k := range keys {
+		b = appendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+	}
+
+	b = appendUInt64(b, uint64(len(idx)))
+	b = append(b, idx...)
+
+	return b
+}
+
+func TestColTypeTupleMap(t *testing.T) {
+	ct, err := ParseColType("Tuple(a UInt8, b Array(String))")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ct.(tupleType).names)
+
+	// (1, ["x"])
+	a := []byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 1, 'x'}
+	// (2, []), (3, ["y"])
+	b := []byte{2, 3, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 'y'}
+
+	raw, err := AppendColumnData(ct, a, 1, b, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		1, 2, 3,
+		1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0,
+		1, 'x', 1, 'y',
+	}, raw)
+
+	ct, err = ParseColType("Map(String, UInt8)")
+	require.NoError(t, err)
+	assert.Equal(t, "Map(String, UInt8)", ct.String())
+
+	// {"a": 1, "b": 2}
+	a = []byte{2, 0, 0, 0, 0, 0, 0, 0, 1, 'a', 1, 'b', 1, 2}
+	// {"c": 3}
+	b = []byte{1, 0, 0, 0, 0, 0, 0, 0, 1, 'c', 3}
+
+	raw, err = ReadColumnData(bytes.NewReader(a), ct, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, a, raw)
+
+	raw, err = AppendColumnData(ct, raw, 1, b, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		2, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0,
+		1, 'a', 1, 'b', 1, 'c',
+		1, 2, 3,
+	}, raw)
+
+	_, err = ParseColType("Nested(a UInt8, b String)")
+	assert.NoError(t, err)
+
+	_, err = ParseColType("Tuple(a UInt8, String)")
+	assert.Error(t, err)
+}
+
+func TestColTypeEnum(t *testing.T) {
+	e, err := ParseEnum("Enum8('a' = 1, 'b\\'c' = -2, 'd,e' = 3)")
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]int16{"a": 1, "b'c": -2, "d,e": 3}, e.Values)
+
+	raw, err := e.AppendNames(nil, "a", "b'c", "d,e")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 0xfe, 3}, raw)
+
+	names, err := e.DecodeNames(raw)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b'c", "d,e"}, names)
+
+	assert.Error(t, e.Validate([]byte{4}))
+
+	e, err = ParseEnum("Enum16('x', 'y' = 1000)")
+	require.NoError(t, err)
+
+	raw, err = e.AppendNames(nil, "x", "y")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 0, 0xe8, 0x03}, raw)
+
+	_, err = ParseEnum("Enum8('x' = 200)")
+	assert.Error(t, err)
+}
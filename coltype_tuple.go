@@ -0,0 +1,199 @@
+package clickhouse
+
+import (
+	"strings"
+
+	"github.com/nikandfor/errors"
+)
+
+type (
+	tupleType struct {
+		baseType
+
+		names []string // empty for unnamed tuple
+		elems []ColType
+	}
+
+	// mapType is serialized as Array(Tuple(K, V)).
+	mapType struct {
+		arrayType
+	}
+)
+
+func init() {
+	types["Tuple"] = newTuple
+	types["Map"] = newMap
+	types["Nested"] = newNested
+}
+
+func newTuple(name string, args []string) (_ ColType, err error) {
+	if len(args) == 0 {
+		return nil, errors.New("expected elements")
+	}
+
+	t := tupleType{
+		baseType: baseType{name: name},
+		elems:    make([]ColType, len(args)),
+	}
+
+	for i, a := range args {
+		n, tp := splitTupleElem(a)
+
+		if i == 0 && n != "" {
+			t.names = make([]string, len(args))
+		}
+
+		if (n != "") != (t.names != nil) {
+			return nil, errors.New("mixed named and unnamed elements")
+		}
+
+		if t.names != nil {
+			t.names[i] = n
+		}
+
+		t.elems[i], err = ParseColType(tp)
+		if err != nil {
+			return nil, errors.Wrap(err, "elem %d", i)
+		}
+	}
+
+	return t, nil
+}
+
+func newMap(name string, args []string) (_ ColType, err error) {
+	if len(args) != 2 {
+		return nil, errors.New("expected key and value")
+	}
+
+	elem, err := newTuple("Tuple("+args[0]+", "+args[1]+")", args)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapType{
+		arrayType: arrayType{
+			baseType: baseType{name: name},
+			elem:     elem,
+		},
+	}, nil
+}
+
+// newNested parses Nested(a T, b U) which is sent as Array(Tuple(a T, b U))
+// if flatten_nested is disabled. Otherwise columns are already flattened into arrays.
+func newNested(name string, args []string) (_ ColType, err error) {
+	if len(args) == 0 {
+		return nil, errors.New("expected elements")
+	}
+
+	elem, err := newTuple("Tuple("+strings.Join(args, ", ")+")", args)
+	if err != nil {
+		return nil, err
+	}
+
+	if elem.(tupleType).names == nil {
+		return nil, errors.New("expected named elements")
+	}
+
+	return arrayType{
+		baseType: baseType{name: name},
+		elem:     elem,
+	}, nil
+}
+
+// splitTupleElem splits `name Type` named tuple element.
+func splitTupleElem(s string) (name, tp string) {
+	if strings.HasPrefix(s, "`") {
+		p := strings.IndexByte(s[1:], '`')
+		if p == -1 {
+			return "", s
+		}
+
+		return s[1 : 1+p], strings.TrimSpace(s[2+p:])
+	}
+
+	p := strings.IndexAny(s, " (")
+	if p == -1 || s[p] == '(' {
+		return "", s
+	}
+
+	return s[:p], strings.TrimSpace(s[p+1:])
+}
+
+func (t tupleType) prefixLen() (l int) {
+	for _, e := range t.elems {
+		l += e.prefixLen()
+	}
+
+	return l
+}
+
+func (t tupleType) readPrefix(r Reader, raw []byte) (_ []byte, err error) {
+	for i, e := range t.elems {
+		raw, err = e.readPrefix(r, raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "elem %d", i)
+		}
+	}
+
+	return raw, nil
+}
+
+func (t tupleType) appendPrefix(b []byte) []byte {
+	for _, e := range t.elems {
+		b = e.appendPrefix(b)
+	}
+
+	return b
+}
+
+func (t tupleType) readData(r Reader, rows int, raw []byte) (_ []byte, err error) {
+	for i, e := range t.elems {
+		raw, err = e.readData(r, rows, raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "elem %d", i)
+		}
+	}
+
+	return raw, nil
+}
+
+func (t tupleType) dataLen(raw []byte, rows int) (i int, err error) {
+	for j, e := range t.elems {
+		l, err := e.dataLen(raw[i:], rows)
+		if err != nil {
+			return 0, errors.Wrap(err, "elem %d", j)
+		}
+
+		i += l
+	}
+
+	return i, nil
+}
+
+func (t tupleType) appendData(dst []byte, drows int, src []byte, srows int) (_ []byte, err error) {
+	res := make([]byte, 0, len(dst)+len(src))
+
+	for j, e := range t.elems {
+		dl, err := e.dataLen(dst, drows)
+		if err != nil {
+			return nil, errors.Wrap(err, "elem %d", j)
+		}
+
+		sl, err := e.dataLen(src, srows)
+		if err != nil {
+			return nil, errors.Wrap(err, "elem %d", j)
+		}
+
+		data, err := e.appendData(dst[:dl:dl], drows, src[:sl], srows)
+		if err != nil {
+			return nil, errors.Wrap(err, "elem %d", j)
+		}
+
+		res = append(res, data...)
+
+		dst = dst[dl:]
+		src = src[sl:]
+	}
+
+	return res, nil
+}
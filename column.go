@@ -0,0 +1,1007 @@
+package clickhouse
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikandfor/errors"
+)
+
+// Typed accessors and builders for Column.RawData.
+//
+// Accessors of simple types figure out the number of rows from the data size.
+// Composite types need it to be passed explicitly, usually it's Block.Rows.
+//
+// Nested LowCardinality keys version prefix goes first in the composite column data,
+// so it's moved between the composite column and its elements.
+
+// NewColumn creates empty column.
+func NewColumn(name, tp string) Column {
+	return Column{Name: name, Type: tp}
+}
+
+// NewNullable makes Nullable column of values.
+// vals must have some value in place of each NULL.
+func NewNullable(name string, nulls []bool, vals Column) Column {
+	c := Column{
+		Name: name,
+		Type: "Nullable(" + vals.Type + ")",
+	}
+
+	if len(nulls) == 0 {
+		return c
+	}
+
+	prefix, data := vals.splitPrefix()
+
+	c.RawData = make([]byte, len(prefix)+len(nulls), len(prefix)+len(nulls)+len(data))
+	copy(c.RawData, prefix)
+
+	for i, n := range nulls {
+		if n {
+			c.RawData[len(prefix)+i] = 1
+		}
+	}
+
+	c.RawData = append(c.RawData, data...)
+
+	return c
+}
+
+// NewArray makes Array column.
+// offsets are cumulative end offsets of each row in elems.
+func NewArray(name string, offsets []int, elems Column) Column {
+	c := Column{
+		Name: name,
+		Type: "Array(" + elems.Type + ")",
+	}
+
+	if len(offsets) == 0 {
+		return c
+	}
+
+	prefix, data := elems.splitPrefix()
+
+	c.RawData = make([]byte, 0, len(prefix)+8*len(offsets)+len(data))
+	c.RawData = append(c.RawData, prefix...)
+	c.RawData = appendOffsets(c.RawData, offsets)
+	c.RawData = append(c.RawData, data...)
+
+	return c
+}
+
+// NewTuple makes Tuple column of elems.
+func NewTuple(name string, elems ...Column) Column {
+	c := Column{
+		Name: name,
+	}
+
+	var tps []string
+	var prefix, data []byte
+
+	for _, e := range elems {
+		tps = append(tps, e.Type)
+
+		p, d := e.splitPrefix()
+
+		prefix = append(prefix, p...)
+		data = append(data, d...)
+	}
+
+	c.Type = "Tuple(" + strings.Join(tps, ", ") + ")"
+
+	if len(data) == 0 { // no rows
+		return c
+	}
+
+	c.RawData = append(prefix, data...)
+
+	return c
+}
+
+// NewMap makes Map column.
+// offsets are cumulative end offsets of each row in keys and vals.
+func NewMap(name string, offsets []int, keys, vals Column) Column {
+	c := Column{
+		Name: name,
+		Type: "Map(" + keys.Type + ", " + vals.Type + ")",
+	}
+
+	if len(offsets) == 0 {
+		return c
+	}
+
+	kp, kd := keys.splitPrefix()
+	vp, vd := vals.splitPrefix()
+
+	c.RawData = make([]byte, 0, len(kp)+len(vp)+8*len(offsets)+len(kd)+len(vd))
+	c.RawData = append(c.RawData, kp...)
+	c.RawData = append(c.RawData, vp...)
+	c.RawData = appendOffsets(c.RawData, offsets)
+	c.RawData = append(c.RawData, kd...)
+	c.RawData = append(c.RawData, vd...)
+
+	return c
+}
+
+// ColType parses column type.
+func (c Column) ColType() (ColType, error) {
+	return ParseColType(c.Type)
+}
+
+// Nullable splits Nullable column into null map and values.
+func (c Column) Nullable(rows int) (nulls []bool, vals Column, err error) {
+	t, err := c.colType("Nullable")
+	if err != nil {
+		return
+	}
+
+	p := t.prefixLen()
+
+	if rows != 0 && len(c.RawData) < p+rows {
+		return nil, vals, c.sizeErr()
+	}
+
+	nulls = make([]bool, rows)
+	prefix, data := c.RawData[:0], c.RawData
+
+	if rows != 0 {
+		prefix, data = c.RawData[:p], c.RawData[p:]
+	}
+
+	for i := range nulls {
+		nulls[i] = data[i] != 0
+	}
+
+	vals = Column{
+		Name:    c.Name,
+		Type:    t.(nullableType).elem.String(),
+		RawData: joinPrefix(prefix, data[rows:], rows),
+	}
+
+	return nulls, vals, nil
+}
+
+// Array splits Array column into offsets and elements.
+// offsets are cumulative end offsets of each row, elems has offsets[rows-1] rows.
+func (c Column) Array(rows int) (offsets []int, elems Column, err error) {
+	t, err := c.colType("Array")
+	if err != nil {
+		return
+	}
+
+	offsets, prefix, data, err := c.offsets(t, rows)
+	if err != nil {
+		return
+	}
+
+	elems = Column{
+		Name:    c.Name,
+		Type:    t.(arrayType).elem.String(),
+		RawData: joinPrefix(prefix, data, lastOf(offsets)),
+	}
+
+	return offsets, elems, nil
+}
+
+// Tuple splits Tuple column into elements.
+func (c Column) Tuple(rows int) (elems []Column, err error) {
+	t, err := c.colType("Tuple")
+	if err != nil {
+		return
+	}
+
+	if rows == 0 {
+		return splitTuple(t.(tupleType), c.Name, nil, c.RawData, rows)
+	}
+
+	p := t.prefixLen()
+
+	if len(c.RawData) < p {
+		return nil, c.sizeErr()
+	}
+
+	return splitTuple(t.(tupleType), c.Name, c.RawData[:p], c.RawData[p:], rows)
+}
+
+// Map splits Map column into offsets, keys and values.
+// offsets are cumulative end offsets of each row.
+func (c Column) Map(rows int) (offsets []int, keys, vals Column, err error) {
+	t, err := c.colType("Map")
+	if err != nil {
+		return
+	}
+
+	offsets, prefix, data, err := c.offsets(t, rows)
+	if err != nil {
+		return
+	}
+
+	elems, err := splitTuple(t.(mapType).elem.(tupleType), c.Name, prefix, data, lastOf(offsets))
+	if err != nil {
+		return
+	}
+
+	return offsets, elems[0], elems[1], nil
+}
+
+// LowCardinality converts LowCardinality column into the full type.
+func (c Column) LowCardinality(rows int) (full Column, err error) {
+	t, err := c.colType("LowCardinality")
+	if err != nil {
+		return
+	}
+
+	lt := t.(lowCardType)
+
+	full = Column{
+		Name: c.Name,
+		Type: lt.elem.String(),
+	}
+
+	if rows == 0 {
+		return full, nil
+	}
+
+	p := lt.prefixLen()
+
+	if len(c.RawData) < p {
+		return full, c.sizeErr()
+	}
+
+	full.RawData, err = lt.full(c.RawData[p:], rows)
+	if err != nil {
+		return full, errors.Wrap(err, "col %v", c.Name)
+	}
+
+	return full, nil
+}
+
+func (c Column) Int8s() (r []int8, err error) {
+	raw, err := c.fixed(1, "Int8")
+	if err != nil {
+		return
+	}
+
+	r = make([]int8, len(raw))
+
+	for i := range r {
+		r[i] = int8(raw[i])
+	}
+
+	return r, nil
+}
+
+func (c Column) Int16s() (r []int16, err error) {
+	raw, err := c.fixed(2, "Int16")
+	if err != nil {
+		return
+	}
+
+	r = make([]int16, len(raw)/2)
+
+	for i := range r {
+		r[i] = int16(binary.LittleEndian.Uint16(raw[2*i:]))
+	}
+
+	return r, nil
+}
+
+func (c Column) Int32s() (r []int32, err error) {
+	raw, err := c.fixed(4, "Int32")
+	if err != nil {
+		return
+	}
+
+	r = make([]int32, len(raw)/4)
+
+	for i := range r {
+		r[i] = int32(binary.LittleEndian.Uint32(raw[4*i:]))
+	}
+
+	return r, nil
+}
+
+func (c Column) Int64s() (r []int64, err error) {
+	raw, err := c.fixed(8, "Int64")
+	if err != nil {
+		return
+	}
+
+	r = make([]int64, len(raw)/8)
+
+	for i := range r {
+		r[i] = int64(binary.LittleEndian.Uint64(raw[8*i:]))
+	}
+
+	return r, nil
+}
+
+func (c Column) UInt8s() (r []uint8, err error) {
+	raw, err := c.fixed(1, "UInt8")
+	if err != nil {
+		return
+	}
+
+	return append([]uint8{}, raw...), nil
+}
+
+func (c Column) UInt16s() (r []uint16, err error) {
+	raw, err := c.fixed(2, "UInt16")
+	if err != nil {
+		return
+	}
+
+	r = make([]uint16, len(raw)/2)
+
+	for i := range r {
+		r[i] = binary.LittleEndian.Uint16(raw[2*i:])
+	}
+
+	return r, nil
+}
+
+func (c Column) UInt32s() (r []uint32, err error) {
+	raw, err := c.fixed(4, "UInt32")
+	if err != nil {
+		return
+	}
+
+	r = make([]uint32, len(raw)/4)
+
+	for i := range r {
+		r[i] = binary.LittleEndian.Uint32(raw[4*i:])
+	}
+
+	return r, nil
+}
+
+func (c Column) UInt64s() (r []uint64, err error) {
+	raw, err := c.fixed(8, "UInt64")
+	if err != nil {
+		return
+	}
+
+	r = make([]uint64, len(raw)/8)
+
+	for i := range r {
+		r[i] = binary.LittleEndian.Uint64(raw[8*i:])
+	}
+
+	return r, nil
+}
+
+func (c Column) Float32s() (r []float32, err error) {
+	raw, err := c.fixed(4, "Float32")
+	if err != nil {
+		return
+	}
+
+	r = make([]float32, len(raw)/4)
+
+	for i := range r {
+		r[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[4*i:]))
+	}
+
+	return r, nil
+}
+
+func (c Column) Float64s() (r []float64, err error) {
+	raw, err := c.fixed(8, "Float64")
+	if err != nil {
+		return
+	}
+
+	r = make([]float64, len(raw)/8)
+
+	for i := range r {
+		r[i] = math.Float64frombits(binary.LittleEndian.Uint64(raw[8*i:]))
+	}
+
+	return r, nil
+}
+
+func (c Column) Bools() (r []bool, err error) {
+	raw, err := c.fixed(1, "Bool")
+	if err != nil {
+		return
+	}
+
+	r = make([]bool, len(raw))
+
+	for i := range r {
+		r[i] = raw[i] != 0
+	}
+
+	return r, nil
+}
+
+// Strings decodes String and FixedString columns.
+func (c Column) Strings() (r []string, err error) {
+	t, err := c.colType("String", "FixedString")
+	if err != nil {
+		return
+	}
+
+	if size := t.Size(); size != 0 {
+		if len(c.RawData)%size != 0 {
+			return nil, c.sizeErr()
+		}
+
+		r = make([]string, len(c.RawData)/size)
+
+		for i := range r {
+			r[i] = string(c.RawData[i*size : (i+1)*size])
+		}
+
+		return r, nil
+	}
+
+	for i := 0; i < len(c.RawData); {
+		l, n := binary.Uvarint(c.RawData[i:])
+		if n <= 0 || i+n+int(l) > len(c.RawData) {
+			return nil, c.sizeErr()
+		}
+
+		i += n
+
+		r = append(r, string(c.RawData[i:i+int(l)]))
+
+		i += int(l)
+	}
+
+	return r, nil
+}
+
+// Times decodes Date, Date32, DateTime and DateTime64 columns.
+func (c Column) Times() (r []time.Time, err error) {
+	t, err := c.colType("Date", "Date32", "DateTime", "DateTime64")
+	if err != nil {
+		return
+	}
+
+	name, args, _ := splitType(t.String())
+
+	tz, err := typeLocation(name, args)
+	if err != nil {
+		return nil, errors.Wrap(err, "col %v", c.Name)
+	}
+
+	size := t.Size()
+
+	if len(c.RawData)%size != 0 {
+		return nil, c.sizeErr()
+	}
+
+	r = make([]time.Time, len(c.RawData)/size)
+
+	for i := range r {
+		b := c.RawData[i*size:]
+
+		switch name {
+		case "Date":
+			r[i] = time.Unix(int64(binary.LittleEndian.Uint16(b))*86400, 0).UTC()
+		case "Date32":
+			r[i] = time.Unix(int64(int32(binary.LittleEndian.Uint32(b)))*86400, 0).UTC()
+		case "DateTime":
+			r[i] = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0).In(tz)
+		case "DateTime64":
+			p := datetime64Scale(args)
+			x := int64(binary.LittleEndian.Uint64(b))
+
+			r[i] = time.Unix(x/p, x%p*(1e9/p)).In(tz)
+		}
+	}
+
+	return r, nil
+}
+
+// UUIDs decodes UUID column. UUIDs are returned in the canonical byte order.
+func (c Column) UUIDs() (r [][16]byte, err error) {
+	raw, err := c.fixed(16, "UUID")
+	if err != nil {
+		return
+	}
+
+	r = make([][16]byte, len(raw)/16)
+
+	for i := range r {
+		binary.BigEndian.PutUint64(r[i][:], binary.LittleEndian.Uint64(raw[16*i:]))
+		binary.BigEndian.PutUint64(r[i][8:], binary.LittleEndian.Uint64(raw[16*i+8:]))
+	}
+
+	return r, nil
+}
+
+// IPs decodes IPv4 and IPv6 columns.
+func (c Column) IPs() (r []net.IP, err error) {
+	t, err := c.colType("IPv4", "IPv6")
+	if err != nil {
+		return
+	}
+
+	size := t.Size()
+
+	if len(c.RawData)%size != 0 {
+		return nil, c.sizeErr()
+	}
+
+	r = make([]net.IP, len(c.RawData)/size)
+
+	for i := range r {
+		if size == 4 {
+			r[i] = make(net.IP, 4)
+			binary.BigEndian.PutUint32(r[i], binary.LittleEndian.Uint32(c.RawData[4*i:]))
+		} else {
+			r[i] = append(net.IP{}, c.RawData[16*i:16*(i+1)]...)
+		}
+	}
+
+	return r, nil
+}
+
+// Enums decodes Enum8 and Enum16 columns into names.
+func (c Column) Enums() (r []string, err error) {
+	t, err := c.colType("Enum8", "Enum16")
+	if err != nil {
+		return
+	}
+
+	return t.(enumType).enum.DecodeNames(c.RawData)
+}
+
+func (c *Column) AppendInt8s(vs ...int8) error {
+	if _, err := c.colType("Int8"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = append(c.RawData, byte(v))
+	}
+
+	return nil
+}
+
+func (c *Column) AppendInt16s(vs ...int16) error {
+	if _, err := c.colType("Int16"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = appendUInt16(c.RawData, uint16(v))
+	}
+
+	return nil
+}
+
+func (c *Column) AppendInt32s(vs ...int32) error {
+	if _, err := c.colType("Int32"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = appendUInt32(c.RawData, uint32(v))
+	}
+
+	return nil
+}
+
+func (c *Column) AppendInt64s(vs ...int64) error {
+	if _, err := c.colType("Int64"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = appendUInt64(c.RawData, uint64(v))
+	}
+
+	return nil
+}
+
+func (c *Column) AppendUInt8s(vs ...uint8) error {
+	if _, err := c.colType("UInt8"); err != nil {
+		return err
+	}
+
+	c.RawData = append(c.RawData, vs...)
+
+	return nil
+}
+
+func (c *Column) AppendUInt16s(vs ...uint16) error {
+	if _, err := c.colType("UInt16"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = appendUInt16(c.RawData, v)
+	}
+
+	return nil
+}
+
+func (c *Column) AppendUInt32s(vs ...uint32) error {
+	if _, err := c.colType("UInt32"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = appendUInt32(c.RawData, v)
+	}
+
+	return nil
+}
+
+func (c *Column) AppendUInt64s(vs ...uint64) error {
+	if _, err := c.colType("UInt64"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = appendUInt64(c.RawData, v)
+	}
+
+	return nil
+}
+
+func (c *Column) AppendFloat32s(vs ...float32) error {
+	if _, err := c.colType("Float32"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = appendUInt32(c.RawData, math.Float32bits(v))
+	}
+
+	return nil
+}
+
+func (c *Column) AppendFloat64s(vs ...float64) error {
+	if _, err := c.colType("Float64"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = appendUInt64(c.RawData, math.Float64bits(v))
+	}
+
+	return nil
+}
+
+func (c *Column) AppendBools(vs ...bool) error {
+	if _, err := c.colType("Bool"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		var x byte
+		if v {
+			x = 1
+		}
+
+		c.RawData = append(c.RawData, x)
+	}
+
+	return nil
+}
+
+// AppendStrings appends to String or FixedString column.
+// FixedString values are padded with zeros.
+func (c *Column) AppendStrings(vs ...string) error {
+	t, err := c.colType("String", "FixedString")
+	if err != nil {
+		return err
+	}
+
+	size := t.Size()
+
+	for _, v := range vs {
+		if size == 0 {
+			c.RawData = appendUvarint(c.RawData, uint64(len(v)))
+			c.RawData = append(c.RawData, v...)
+
+			continue
+		}
+
+		if len(v) > size {
+			return errors.New("string is too long for %v: %q", c.Type, v)
+		}
+
+		st := len(c.RawData)
+		c.RawData = grow(c.RawData, size)
+
+		n := copy(c.RawData[st:], v)
+
+		for i := st + n; i < len(c.RawData); i++ {
+			c.RawData[i] = 0
+		}
+	}
+
+	return nil
+}
+
+// AppendTimes appends to Date, Date32, DateTime or DateTime64 column.
+func (c *Column) AppendTimes(vs ...time.Time) error {
+	t, err := c.colType("Date", "Date32", "DateTime", "DateTime64")
+	if err != nil {
+		return err
+	}
+
+	name, args, _ := splitType(t.String())
+
+	for _, v := range vs {
+		switch name {
+		case "Date":
+			c.RawData = appendUInt16(c.RawData, uint16(dateDays(v)))
+		case "Date32":
+			c.RawData = appendUInt32(c.RawData, uint32(int32(dateDays(v))))
+		case "DateTime":
+			c.RawData = appendUInt32(c.RawData, uint32(v.Unix()))
+		case "DateTime64":
+			p := datetime64Scale(args)
+
+			c.RawData = appendUInt64(c.RawData, uint64(v.Unix()*p+int64(v.Nanosecond())/(1e9/p)))
+		}
+	}
+
+	return nil
+}
+
+// AppendUUIDs appends UUIDs given in the canonical byte order.
+func (c *Column) AppendUUIDs(vs ...[16]byte) error {
+	if _, err := c.colType("UUID"); err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		c.RawData = appendUInt64(c.RawData, binary.BigEndian.Uint64(v[:]))
+		c.RawData = appendUInt64(c.RawData, binary.BigEndian.Uint64(v[8:]))
+	}
+
+	return nil
+}
+
+// AppendIPs appends to IPv4 or IPv6 column.
+func (c *Column) AppendIPs(vs ...net.IP) error {
+	t, err := c.colType("IPv4", "IPv6")
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		if t.Size() == 4 {
+			v4 := v.To4()
+			if v4 == nil {
+				return errors.New("not an IPv4: %v", v)
+			}
+
+			c.RawData = appendUInt32(c.RawData, binary.BigEndian.Uint32(v4))
+
+			continue
+		}
+
+		v16 := v.To16()
+		if v16 == nil {
+			return errors.New("bad IP: %v", v)
+		}
+
+		c.RawData = append(c.RawData, v16...)
+	}
+
+	return nil
+}
+
+// AppendEnums appends Enum8 or Enum16 values by names.
+func (c *Column) AppendEnums(names ...string) (err error) {
+	t, err := c.colType("Enum8", "Enum16")
+	if err != nil {
+		return err
+	}
+
+	c.RawData, err = t.(enumType).enum.AppendNames(c.RawData, names...)
+
+	return err
+}
+
+// colType parses column type and checks it's one of the names.
+func (c Column) colType(names ...string) (ColType, error) {
+	t, err := ParseColType(c.Type)
+	if err != nil {
+		return nil, errors.Wrap(err, "col %v", c.Name)
+	}
+
+	name, _, _ := splitType(t.String())
+
+	for _, n := range names {
+		if n == name {
+			return t, nil
+		}
+	}
+
+	return nil, errors.New("col %v: type mismatch: %v, expected %v", c.Name, c.Type, strings.Join(names, " or "))
+}
+
+func (c Column) fixed(size int, names ...string) ([]byte, error) {
+	_, err := c.colType(names...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.RawData)%size != 0 {
+		return nil, c.sizeErr()
+	}
+
+	return c.RawData, nil
+}
+
+// offsets splits Array or Map column data into nested types prefix, offsets and elements data.
+func (c Column) offsets(t ColType, rows int) (offsets []int, prefix, data []byte, err error) {
+	if rows == 0 {
+		return []int{}, nil, c.RawData, nil
+	}
+
+	p := t.prefixLen()
+
+	if len(c.RawData) < p+8*rows {
+		return nil, nil, nil, c.sizeErr()
+	}
+
+	offsets, data = splitOffsets(c.RawData[p:], rows)
+
+	return offsets, c.RawData[:p], data, nil
+}
+
+// splitOffsets splits array data without prefix into offsets and elements data.
+// raw must be at least 8*rows long.
+func splitOffsets(raw []byte, rows int) (offsets []int, data []byte) {
+	offsets = make([]int, rows)
+
+	for i := range offsets {
+		offsets[i] = int(binary.LittleEndian.Uint64(raw[8*i:]))
+	}
+
+	return offsets, raw[8*rows:]
+}
+
+func lastOf(offsets []int) int {
+	if len(offsets) == 0 {
+		return 0
+	}
+
+	return offsets[len(offsets)-1]
+}
+
+// splitPrefix splits column data into nested types prefix and the values data.
+// The prefix is made up if the column has no rows.
+func (c Column) splitPrefix() (prefix, data []byte) {
+	t, err := c.ColType()
+	if err != nil {
+		return nil, c.RawData
+	}
+
+	p := t.prefixLen()
+
+	switch {
+	case p == 0:
+		return nil, c.RawData
+	case len(c.RawData) == 0:
+		return t.appendPrefix(nil), nil
+	case len(c.RawData) < p:
+		return nil, c.RawData // broken, keep as is
+	}
+
+	return c.RawData[:p], c.RawData[p:]
+}
+
+func (c Column) sizeErr() error {
+	return errors.New("col %v: bad data size: %d", c.Name, len(c.RawData))
+}
+
+// dataLen is ColumnDataLen for the data without prefix.
+func dataLen(t ColType, raw []byte, rows int) (int, error) {
+	if rows == 0 {
+		return 0, nil
+	}
+
+	return t.dataLen(raw, rows)
+}
+
+// splitTuple splits tuple data of rows values.
+// prefix is all the elements prefixes followed by all the elements data in raw.
+func splitTuple(t tupleType, name string, prefix, raw []byte, rows int) (elems []Column, err error) {
+	elems = make([]Column, len(t.elems))
+
+	for i, e := range t.elems {
+		l, err := dataLen(e, raw, rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "col %v: elem %d", name, i)
+		}
+
+		var p int
+		if rows != 0 {
+			p = e.prefixLen()
+		}
+
+		elems[i] = Column{
+			Name:    name,
+			Type:    e.String(),
+			RawData: joinPrefix(prefix[:p], raw[:l], rows),
+		}
+
+		if t.names != nil {
+			elems[i].Name = name + "." + t.names[i]
+		}
+
+		prefix = prefix[p:]
+		raw = raw[l:]
+	}
+
+	return elems, nil
+}
+
+// joinPrefix makes column data of rows values from the nested types prefix and the values data.
+func joinPrefix(prefix, data []byte, rows int) []byte {
+	if rows == 0 || len(prefix) == 0 {
+		return data
+	}
+
+	res := make([]byte, 0, len(prefix)+len(data))
+
+	res = append(res, prefix...)
+	res = append(res, data...)
+
+	return res
+}
+
+func typeLocation(name string, args []string) (*time.Location, error) {
+	var tz string
+
+	switch {
+	case name == "DateTime" && len(args) == 1:
+		tz = args[0]
+	case name == "DateTime64" && len(args) == 2:
+		tz = args[1]
+	default:
+		return time.UTC, nil
+	}
+
+	return time.LoadLocation(strings.Trim(tz, "'"))
+}
+
+func datetime64Scale(args []string) (p int64) {
+	n, _ := strconv.Atoi(args[0]) // checked by ParseColType
+
+	p = 1
+
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+
+	return p
+}
+
+func dateDays(t time.Time) int64 {
+	y, m, d := t.Date()
+
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+func appendOffsets(b []byte, offsets []int) []byte {
+	for _, o := range offsets {
+		b = appendUInt64(b, uint64(o))
+	}
+
+	return b
+}
+
+func appendUInt32(b []byte, x uint32) []byte {
+	return append(b, byte(x), byte(x>>8), byte(x>>16), byte(x>>24))
+}
+
+func appendUInt16(b []byte, x uint16) []byte {
+	return append(b, byte(x), byte(x>>8))
+}
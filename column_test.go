@@ -0,0 +1,211 @@
+package clickhouse
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestColumnSimple(t *testing.T) {
+	c := NewColumn("a", "UInt64")
+	require.NoError(t, c.AppendUInt64s(1, 2, 1<<40))
+
+	u64, err := c.UInt64s()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 1 << 40}, u64)
+
+	_, err = c.Int64s()
+	assert.Error(t, err)
+
+	c = NewColumn("f", "Float64")
+	require.NoError(t, c.AppendFloat64s(1.5, -2))
+
+	f64, err := c.Float64s()
+	require.NoError(t, err)
+	assert.Equal(t, []float64{1.5, -2}, f64)
+
+	c = NewColumn("s", "String")
+	require.NoError(t, c.AppendStrings("", "abc"))
+
+	ss, err := c.Strings()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "abc"}, ss)
+
+	c = NewColumn("s", "FixedString(3)")
+	require.NoError(t, c.AppendStrings("ab", "abc"))
+	assert.Error(t, c.AppendStrings("abcd"))
+
+	ss, err = c.Strings()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ab\x00", "abc"}, ss)
+
+	c = NewColumn("e", "Enum8('a' = 1, 'b' = 2)")
+	require.NoError(t, c.AppendEnums("b", "a"))
+	assert.Equal(t, []byte{2, 1}, c.RawData)
+
+	ss, err = c.Enums()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "a"}, ss)
+
+	c = NewColumn("ip", "IPv4")
+	require.NoError(t, c.AppendIPs(net.IPv4(1, 2, 3, 4)))
+	assert.Equal(t, []byte{4, 3, 2, 1}, c.RawData)
+
+	ips, err := c.IPs()
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.IPv4(1, 2, 3, 4).To4()}, ips)
+
+	c = NewColumn("id", "UUID")
+	id := [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	require.NoError(t, c.AppendUUIDs(id))
+	assert.Equal(t, []byte{7, 6, 5, 4, 3, 2, 1, 0, 15, 14, 13, 12, 11, 10, 9, 8}, c.RawData)
+
+	ids, err := c.UUIDs()
+	require.NoError(t, err)
+	assert.Equal(t, [][16]byte{id}, ids)
+}
+
+func TestColumnTimes(t *testing.T) {
+	ts := time.Date(2021, 11, 30, 12, 34, 56, 789000000, time.UTC)
+
+	for tp, exp := range map[string]time.Time{
+		"Date":                 ts.Truncate(24 * time.Hour),
+		"Date32":               ts.Truncate(24 * time.Hour),
+		"DateTime":             ts.Truncate(time.Second),
+		"DateTime64(3)":        ts,
+		"DateTime64(6, 'UTC')": ts,
+	} {
+		c := NewColumn("t", tp)
+		require.NoError(t, c.AppendTimes(ts), tp)
+
+		r, err := c.Times()
+		require.NoError(t, err, tp)
+		assert.Equal(t, []time.Time{exp}, r, tp)
+	}
+}
+
+func TestColumnComposite(t *testing.T) {
+	s := NewColumn("s", "String")
+	require.NoError(t, s.AppendStrings("a", "", "c"))
+
+	c := NewNullable("n", []bool{false, true, false}, s)
+	assert.Equal(t, "Nullable(String)", c.Type)
+
+	nulls, vals, err := c.Nullable(3)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true, false}, nulls)
+	assert.Equal(t, s.RawData, vals.RawData)
+
+	u := NewColumn("u", "UInt8")
+	require.NoError(t, u.AppendUInt8s(1, 2, 3))
+
+	c = NewArray("a", []int{2, 2, 3}, u)
+
+	offsets, elems, err := c.Array(3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 2, 3}, offsets)
+	assert.Equal(t, u.RawData, elems.RawData)
+	assert.Equal(t, "UInt8", elems.Type)
+
+	c = NewTuple("t", s, u)
+
+	tup, err := c.Tuple(3)
+	require.NoError(t, err)
+	assert.Equal(t, []Column{{Name: "t", Type: "String", RawData: s.RawData}, {Name: "t", Type: "UInt8", RawData: u.RawData}}, tup)
+
+	c = NewMap("m", []int{1, 3}, s, u)
+
+	offsets, keys, mvals, err := c.Map(2)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, offsets)
+	assert.Equal(t, s.RawData, keys.RawData)
+	assert.Equal(t, u.RawData, mvals.RawData)
+
+	c = Column{Name: "lc", Type: "LowCardinality(Nullable(String))", RawData: lowCardRaw([]string{"", "a"}, 1, 0, 1)}
+
+	full, err := c.LowCardinality(3)
+	require.NoError(t, err)
+	assert.Equal(t, "Nullable(String)", full.Type)
+
+	nulls, vals, err = full.Nullable(3)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true, false}, nulls)
+
+	ss, err := vals.Strings()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "", "a"}, ss)
+}
+
+func TestColumnNestedLowCardinality(t *testing.T) {
+	lc := Column{Name: "lc", Type: "LowCardinality(String)", RawData: lowCardRaw([]string{"a", "b"}, 0, 1, 0)}
+
+	u := NewColumn("u", "UInt8")
+	require.NoError(t, u.AppendUInt8s(1, 2, 3))
+
+	checkLen := func(c Column, rows int) {
+		t.Helper()
+
+		ct, err := c.ColType()
+		require.NoError(t, err)
+
+		l, err := ColumnDataLen(ct, c.RawData, rows)
+		require.NoError(t, err, c.Type)
+		assert.Equal(t, len(c.RawData), l, c.Type)
+	}
+
+	checkStrings := func(c Column, rows int, exp ...string) {
+		t.Helper()
+
+		full, err := c.LowCardinality(rows)
+		require.NoError(t, err)
+
+		ss, err := full.Strings()
+		require.NoError(t, err)
+		assert.Equal(t, exp, ss)
+	}
+
+	c := NewArray("a", []int{2, 2, 3}, lc)
+	assert.Equal(t, "Array(LowCardinality(String))", c.Type)
+	checkLen(c, 3)
+
+	offsets, elems, err := c.Array(3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 2, 3}, offsets)
+	assert.Equal(t, lc.RawData, elems.RawData)
+	checkStrings(elems, 3, "a", "b", "a")
+
+	c = NewArray("a", []int{0, 0}, NewColumn("lc", lc.Type))
+	assert.Equal(t, append(appendUInt64(nil, lowCardSharedDicts), make([]byte, 16)...), c.RawData)
+	checkLen(c, 2)
+
+	offsets, elems, err = c.Array(2)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 0}, offsets)
+	assert.Empty(t, elems.RawData)
+
+	c = NewTuple("t", u, lc, lc)
+	checkLen(c, 3)
+
+	tup, err := c.Tuple(3)
+	require.NoError(t, err)
+
+	if assert.Len(t, tup, 3) {
+		assert.Equal(t, u.RawData, tup[0].RawData)
+		assert.Equal(t, lc.RawData, tup[1].RawData)
+		assert.Equal(t, lc.RawData, tup[2].RawData)
+	}
+
+	c = NewMap("m", []int{1, 3}, lc, u)
+	assert.Equal(t, "Map(LowCardinality(String), UInt8)", c.Type)
+	checkLen(c, 2)
+
+	offsets, keys, mvals, err := c.Map(2)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, offsets)
+	assert.Equal(t, lc.RawData, keys.RawData)
+	assert.Equal(t, u.RawData, mvals.RawData)
+	checkStrings(keys, 3, "a", "b", "a")
+}
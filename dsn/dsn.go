@@ -1,8 +1,15 @@
 package dsn
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/nikandfor/errors"
 )
 
 type DSN struct {
@@ -16,6 +23,20 @@ type DSN struct {
 
 	Compress bool
 
+	// Strategy is a host selection strategy name (connection_open_strategy).
+	Strategy string
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// TLS
+	Secure     bool
+	SkipVerify bool
+	CAFile     string // tls_ca
+	CertFile   string // tls_cert
+	KeyFile    string // tls_key
+
 	Query url.Values
 }
 
@@ -69,9 +90,92 @@ func Parse(dsn string) (d *DSN, err error) {
 		d.Compress = true
 	}
 
+	d.Strategy = q.Get("connection_open_strategy")
+
+	d.Secure = flag(q, "secure") || d.Scheme == "tls"
+	d.SkipVerify = flag(q, "skip_verify")
+	d.CAFile = q.Get("tls_ca")
+	d.CertFile = q.Get("tls_cert")
+	d.KeyFile = q.Get("tls_key")
+
+	for _, x := range []struct {
+		name string
+		d    *time.Duration
+	}{
+		{"dial_timeout", &d.DialTimeout},
+		{"read_timeout", &d.ReadTimeout},
+		{"write_timeout", &d.WriteTimeout},
+	} {
+		*x.d, err = parseDuration(q.Get(x.name))
+		if err != nil {
+			return nil, errors.Wrap(err, "%v", x.name)
+		}
+	}
+
 	if x := q.Get("alt_hosts"); x != "" {
 		d.Hosts = append(d.Hosts, strings.Split(x, ",")...)
 	}
 
 	return d, nil
 }
+
+// TLSConfig makes client TLS config. It's nil if the connection is not secure.
+func (d *DSN) TLSConfig() (c *tls.Config, err error) {
+	if !d.Secure {
+		return nil, nil
+	}
+
+	c = &tls.Config{
+		InsecureSkipVerify: d.SkipVerify,
+	}
+
+	if d.CAFile != "" {
+		ca, err := os.ReadFile(d.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read ca")
+		}
+
+		c.RootCAs = x509.NewCertPool()
+
+		if !c.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates in %v", d.CAFile)
+		}
+	}
+
+	if d.CertFile != "" || d.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(d.CertFile, d.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+func flag(q url.Values, name string) bool {
+	if !q.Has(name) {
+		return false
+	}
+
+	switch q.Get(name) {
+	case "0", "false":
+		return false
+	default:
+		return true
+	}
+}
+
+// parseDuration parses Go duration or number of seconds.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	if x, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(x * float64(time.Second)), nil
+	}
+
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,104 @@
+package dsn
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHosts(t *testing.T) {
+	for _, tc := range []struct {
+		dsn      string
+		hosts    []string
+		strategy string
+	}{
+		{"tcp://a:9000", []string{"a:9000"}, ""},
+		{"tcp://a:9000?alt_hosts=b:9000,c:9000", []string{"a:9000", "b:9000", "c:9000"}, ""},
+		{"tcp://a:9000?alt_hosts=b:9000&connection_open_strategy=round_robin", []string{"a:9000", "b:9000"}, "round_robin"},
+	} {
+		d, err := Parse(tc.dsn)
+		require.NoError(t, err, tc.dsn)
+
+		assert.Equal(t, tc.hosts, d.Hosts, tc.dsn)
+		assert.Equal(t, tc.strategy, d.Strategy, tc.dsn)
+	}
+}
+
+func TestParseTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		dsn               string
+		dial, read, write time.Duration
+	}{
+		{"tcp://a:9000", 0, 0, 0},
+		{"tcp://a:9000?read_timeout=1.5", 0, 1500 * time.Millisecond, 0},
+		{"tcp://a:9000?read_timeout=2s", 0, 2 * time.Second, 0},
+		{"tcp://a:9000?dial_timeout=100ms&write_timeout=3", 100 * time.Millisecond, 0, 3 * time.Second},
+	} {
+		d, err := Parse(tc.dsn)
+		require.NoError(t, err, tc.dsn)
+
+		assert.Equal(t, tc.dial, d.DialTimeout, tc.dsn)
+		assert.Equal(t, tc.read, d.ReadTimeout, tc.dsn)
+		assert.Equal(t, tc.write, d.WriteTimeout, tc.dsn)
+	}
+
+	_, err := Parse("tcp://a:9000?read_timeout=2x")
+	assert.Error(t, err)
+}
+
+func TestParseTLS(t *testing.T) {
+	for _, tc := range []struct {
+		dsn        string
+		secure     bool
+		skipVerify bool
+	}{
+		{"tcp://a:9000", false, false},
+		{"tcp://a:9000?secure", true, false},
+		{"tcp://a:9000?secure=1", true, false},
+		{"tcp://a:9000?secure=0", false, false},
+		{"tcp://a:9000?secure=false&skip_verify=true", false, true},
+		{"tls://a:9440", true, false},
+		{"tls://a:9440?skip_verify", true, true},
+	} {
+		d, err := Parse(tc.dsn)
+		require.NoError(t, err, tc.dsn)
+
+		assert.Equal(t, tc.secure, d.Secure, tc.dsn)
+		assert.Equal(t, tc.skipVerify, d.SkipVerify, tc.dsn)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	d, err := Parse("tcp://a:9000")
+	require.NoError(t, err)
+
+	c, err := d.TLSConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	d, err = Parse("tls://a:9440?skip_verify=1")
+	require.NoError(t, err)
+
+	c, err = d.TLSConfig()
+	require.NoError(t, err)
+	assert.True(t, c.InsecureSkipVerify)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, []byte("not a certificate"), 0o600))
+
+	d, err = Parse("tls://a:9440?tls_ca=" + ca)
+	require.NoError(t, err)
+
+	_, err = d.TLSConfig()
+	assert.Error(t, err)
+
+	d, err = Parse("tls://a:9440?tls_ca=" + filepath.Join(t.TempDir(), "missing.pem"))
+	require.NoError(t, err)
+
+	_, err = d.TLSConfig()
+	assert.Error(t, err)
+}
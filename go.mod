@@ -12,7 +12,9 @@ require (
 	github.com/nikandfor/netpoll v0.0.0-20211124145858-9739b0b763d8
 	github.com/nikandfor/tlog v0.12.2-0.20211123200322-8880f72871a2
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	google.golang.org/genproto v0.0.0-20210831024726-fe130286e0e2
+	gopkg.in/yaml.v3 v3.0.0-20200605160147-a5ece683394c
 )
 
 require (
@@ -33,7 +35,6 @@ require (
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20200605160147-a5ece683394c // indirect
 )
 
 replace github.com/ClickHouse/clickhouse-go => github.com/nikandfor/clickhouse-go v1.5.2-0.20211123125730-7b296aa1f0ea
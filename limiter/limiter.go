@@ -0,0 +1,372 @@
+package limiter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// Limiter limits connections, queries and inserts
+	// per user, per quota key and per remote host.
+	// Each scope limits are applied independently.
+	Limiter struct {
+		User     Scope `yaml:"user"`
+		QuotaKey Scope `yaml:"quota_key"`
+		Host     Scope `yaml:"host"`
+
+		mu    sync.Mutex
+		swept time.Time
+
+		now func() time.Time
+	}
+
+	// Scope is a set of limits for keys of the same kind.
+	Scope struct {
+		// Default limits are used for keys not listed in Keys.
+		Default Limits            `yaml:"default"`
+		Keys    map[string]Limits `yaml:"keys"`
+
+		name  string
+		state map[string]*state
+	}
+
+	// Limits for a single key. Zero means no limit.
+	Limits struct {
+		MaxConnections       int     `yaml:"max_connections"`
+		MaxConcurrentQueries int     `yaml:"max_concurrent_queries"`
+		MaxQPS               float64 `yaml:"max_qps"`
+
+		// Inserted rows and bytes are limited per Interval.
+		// Query is rejected if the limit is already reached,
+		// running inserts are not interrupted.
+		MaxInsertRows  int64         `yaml:"max_insert_rows"`
+		MaxInsertBytes int64         `yaml:"max_insert_bytes"`
+		Interval       time.Duration `yaml:"interval"`
+	}
+
+	// Keys identify the client.
+	Keys struct {
+		User     string
+		QuotaKey string
+		Host     string
+	}
+
+	state struct {
+		conns   int
+		queries int
+
+		tokens float64
+		refill time.Time
+
+		window time.Time
+		rows   int64
+		bytes  int64
+	}
+
+	scopeState struct {
+		s *Scope
+		l *Limits
+		k string
+	}
+)
+
+const DefaultInterval = time.Minute
+
+func New() *Limiter {
+	l := &Limiter{}
+
+	l.init()
+
+	return l
+}
+
+// LoadFile loads limits from yaml file.
+func LoadFile(name string) (*Limiter, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+
+	return Parse(data)
+}
+
+// Parse parses limits yaml.
+func Parse(data []byte) (l *Limiter, err error) {
+	l = &Limiter{}
+
+	err = yaml.Unmarshal(data, l)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+
+	l.init()
+
+	return l, nil
+}
+
+func (l *Limiter) init() {
+	l.User.name = "user"
+	l.QuotaKey.name = "quota key"
+	l.Host.name = "host"
+
+	for _, s := range l.scopes() {
+		s.state = make(map[string]*state)
+	}
+
+	l.now = time.Now
+}
+
+// Connect accounts a new connection.
+// release must be called when the connection is closed.
+// Quota key is not known at this point and is ignored.
+func (l *Limiter) Connect(k Keys) (release func(), err error) {
+	defer l.mu.Unlock()
+	l.mu.Lock()
+
+	ss := l.states(Keys{User: k.User, Host: k.Host})
+
+	for _, x := range ss {
+		if x.l.MaxConnections > 0 && x.state().conns >= x.l.MaxConnections {
+			return nil, tooMany("connections", x, x.l.MaxConnections)
+		}
+	}
+
+	for _, x := range ss {
+		x.state().conns++
+	}
+
+	return func() {
+		defer l.mu.Unlock()
+		l.mu.Lock()
+
+		now := l.now()
+
+		for _, x := range ss {
+			x.state().conns--
+			x.gc(now)
+		}
+	}, nil
+}
+
+// Query accounts a new query.
+// done must be called when the query is finished with the number of inserted rows and bytes.
+func (l *Limiter) Query(k Keys) (done func(rows, bytes int64), err error) {
+	defer l.mu.Unlock()
+	l.mu.Lock()
+
+	now := l.now()
+
+	l.sweep(now)
+
+	ss := l.states(k)
+
+	for _, x := range ss {
+		err = x.checkQuery(now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, x := range ss {
+		st := x.state()
+
+		st.queries++
+
+		if x.l.MaxQPS > 0 {
+			st.tokens--
+		}
+	}
+
+	return func(rows, bytes int64) {
+		defer l.mu.Unlock()
+		l.mu.Lock()
+
+		now := l.now()
+
+		for _, x := range ss {
+			st := x.state()
+
+			st.queries--
+
+			if x.l.MaxInsertRows > 0 || x.l.MaxInsertBytes > 0 {
+				x.resetWindow(now)
+
+				st.rows += rows
+				st.bytes += bytes
+			}
+
+			x.gc(now)
+		}
+	}, nil
+}
+
+// sweep removes idle states once in a while. l.mu must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < DefaultInterval {
+		return
+	}
+
+	l.swept = now
+
+	for _, s := range l.scopes() {
+		for k := range s.state {
+			x := scopeState{s: s, l: s.limits(k), k: k}
+
+			x.gc(now)
+		}
+	}
+}
+
+func (l *Limiter) states(k Keys) (ss []scopeState) {
+	for _, x := range []struct {
+		s   *Scope
+		key string
+	}{
+		{&l.User, k.User},
+		{&l.QuotaKey, k.QuotaKey},
+		{&l.Host, k.Host},
+	} {
+		if x.s == &l.QuotaKey && x.key == "" {
+			continue
+		}
+
+		lim := x.s.limits(x.key)
+		if *lim == (Limits{}) {
+			continue
+		}
+
+		ss = append(ss, scopeState{s: x.s, l: lim, k: x.key})
+	}
+
+	return ss
+}
+
+func (l *Limiter) scopes() []*Scope {
+	return []*Scope{&l.User, &l.QuotaKey, &l.Host}
+}
+
+func (s *Scope) limits(key string) *Limits {
+	if l, ok := s.Keys[key]; ok {
+		return &l
+	}
+
+	return &s.Default
+}
+
+func (x scopeState) state() *state {
+	st, ok := x.s.state[x.k]
+	if !ok {
+		st = &state{
+			tokens: x.burst(),
+		}
+
+		x.s.state[x.k] = st
+	}
+
+	return st
+}
+
+func (x scopeState) checkQuery(now time.Time) error {
+	st := x.state()
+
+	if x.l.MaxConcurrentQueries > 0 && st.queries >= x.l.MaxConcurrentQueries {
+		return tooMany("queries", x, x.l.MaxConcurrentQueries)
+	}
+
+	if x.l.MaxInsertRows > 0 || x.l.MaxInsertBytes > 0 {
+		x.resetWindow(now)
+
+		if x.l.MaxInsertRows > 0 && st.rows >= x.l.MaxInsertRows {
+			return quotaExceeded("inserted rows", x, x.l.MaxInsertRows)
+		}
+
+		if x.l.MaxInsertBytes > 0 && st.bytes >= x.l.MaxInsertBytes {
+			return quotaExceeded("inserted bytes", x, x.l.MaxInsertBytes)
+		}
+	}
+
+	if x.l.MaxQPS > 0 {
+		st.tokens += now.Sub(st.refill).Seconds() * x.l.MaxQPS
+		st.refill = now
+
+		if b := x.burst(); st.tokens > b {
+			st.tokens = b
+		}
+
+		if st.tokens < 1 {
+			return quotaExceeded("queries per second", x, x.l.MaxQPS)
+		}
+	}
+
+	return nil
+}
+
+func (x scopeState) resetWindow(now time.Time) {
+	st := x.state()
+
+	d := x.l.Interval
+	if d <= 0 {
+		d = DefaultInterval
+	}
+
+	if now.Sub(st.window) < d {
+		return
+	}
+
+	st.window = now
+	st.rows = 0
+	st.bytes = 0
+}
+
+func (x scopeState) burst() float64 {
+	if x.l.MaxQPS < 1 {
+		return 1
+	}
+
+	return x.l.MaxQPS
+}
+
+// gc removes key state if it's indistinguishable from the new one.
+func (x scopeState) gc(now time.Time) {
+	st := x.state()
+
+	if st.conns != 0 || st.queries != 0 {
+		return
+	}
+
+	if x.l.MaxQPS > 0 && st.tokens+now.Sub(st.refill).Seconds()*x.l.MaxQPS < x.burst() {
+		return
+	}
+
+	if st.rows != 0 || st.bytes != 0 {
+		x.resetWindow(now)
+
+		if st.rows != 0 || st.bytes != 0 {
+			return
+		}
+	}
+
+	delete(x.s.state, x.k)
+}
+
+func tooMany(what string, x scopeState, max int) error {
+	return &click.Exception{
+		Code:    click.TOO_MANY_SIMULTANEOUS_QUERIES,
+		Name:    "DB::Exception",
+		Message: fmt.Sprintf("Too many simultaneous %v for %v %q. Maximum: %v", what, x.s.name, x.k, max),
+	}
+}
+
+func quotaExceeded(what string, x scopeState, max interface{}) error {
+	return &click.Exception{
+		Code:    click.QUOTA_EXCEEDED,
+		Name:    "DB::Exception",
+		Message: fmt.Sprintf("Quota for %v %q is exceeded: %v. Maximum: %v", x.s.name, x.k, what, max),
+	}
+}
@@ -0,0 +1,113 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	var exc *click.Exception
+
+	l, err := Parse([]byte(`
+user:
+  default:
+    max_connections: 2
+    max_concurrent_queries: 1
+  keys:
+    bulk:
+      max_insert_rows: 100
+      interval: 1m
+quota_key:
+  default:
+    max_qps: 2
+host:
+  keys:
+    10.0.0.1:
+      max_connections: 1
+`))
+	require.NoError(t, err)
+
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	// connections
+	r1, err := l.Connect(Keys{User: "alice", Host: "10.0.0.2"})
+	require.NoError(t, err)
+
+	r2, err := l.Connect(Keys{User: "alice", Host: "10.0.0.1"})
+	require.NoError(t, err)
+
+	_, err = l.Connect(Keys{User: "alice", Host: "10.0.0.3"})
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(click.TOO_MANY_SIMULTANEOUS_QUERIES), exc.Code)
+	}
+
+	_, err = l.Connect(Keys{User: "bob", Host: "10.0.0.1"})
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(click.TOO_MANY_SIMULTANEOUS_QUERIES), exc.Code)
+	}
+
+	r1()
+	r2()
+
+	// concurrent queries
+	d1, err := l.Query(Keys{User: "alice"})
+	require.NoError(t, err)
+
+	_, err = l.Query(Keys{User: "alice"})
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(click.TOO_MANY_SIMULTANEOUS_QUERIES), exc.Code)
+	}
+
+	d1(0, 0)
+
+	// qps
+	for i := 0; i < 2; i++ {
+		d, err := l.Query(Keys{User: "bob", QuotaKey: "k"})
+		require.NoError(t, err)
+
+		d(0, 0)
+	}
+
+	_, err = l.Query(Keys{User: "bob", QuotaKey: "k"})
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(click.QUOTA_EXCEEDED), exc.Code)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+
+	d, err := l.Query(Keys{User: "bob", QuotaKey: "k"})
+	require.NoError(t, err)
+	d(0, 0)
+
+	// inserted rows
+	d, err = l.Query(Keys{User: "bulk"})
+	require.NoError(t, err)
+	d(150, 1000)
+
+	_, err = l.Query(Keys{User: "bulk"})
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(click.QUOTA_EXCEEDED), exc.Code)
+	}
+
+	now = now.Add(time.Minute)
+
+	d, err = l.Query(Keys{User: "bulk"})
+	require.NoError(t, err)
+	d(10, 100)
+
+	// states are cleaned up
+	now = now.Add(time.Hour)
+
+	d, err = l.Query(Keys{User: "alice"})
+	require.NoError(t, err)
+	d(0, 0)
+
+	assert.Len(t, l.User.state, 0)
+	assert.Len(t, l.QuotaKey.state, 0)
+	assert.Len(t, l.Host.state, 0)
+}
@@ -22,6 +22,8 @@ type (
 		p *Processor
 
 		cl click.Client
+
+		pk click.ServerPacket // last packet
 	}
 )
 
@@ -59,7 +61,9 @@ func (p *Processor) Close() (err error) {
 //
 
 func (c *client) NextPacket(ctx context.Context) (tp click.ServerPacket, err error) {
-	return c.cl.NextPacket(ctx)
+	c.pk, err = c.cl.NextPacket(ctx)
+
+	return c.pk, err
 }
 
 func (c *client) SendQuery(ctx context.Context, q *click.Query) (meta click.QueryMeta, err error) {
@@ -95,7 +99,7 @@ func (c *client) RecvBlock(ctx context.Context, compr bool) (b *click.Block, err
 		return
 	}
 
-	if c.p.OnRecvBlock != nil {
+	if c.p.OnRecvBlock != nil && c.pk == click.ServerData {
 		b, err = c.p.OnRecvBlock(ctx, b)
 		if err != nil {
 			return nil, err
@@ -128,4 +132,18 @@ func (c *client) RecvProfileInfo(ctx context.Context) (click.ProfileInfo, error)
 	return c.cl.RecvProfileInfo(ctx)
 }
 
+func (c *client) RecvTableColumns(ctx context.Context) (click.TableColumns, error) {
+	return c.cl.RecvTableColumns(ctx)
+}
+
+func (c *client) RecvPartUUIDs(ctx context.Context) ([][16]byte, error) {
+	return c.cl.RecvPartUUIDs(ctx)
+}
+
+func (c *client) SendReadTaskResponse(ctx context.Context, resp string) error {
+	return c.cl.SendReadTaskResponse(ctx, resp)
+}
+
+func (c *client) Buffered() int { return c.cl.Buffered() }
+
 func (c *client) Close() error { panic("nah") }
@@ -11,6 +11,11 @@ const (
 	ClientData
 	ClientCancel
 	ClientPing
+	ClientTablesStatusRequest
+	ClientKeepAlive
+	ClientScalar
+	ClientIgnoredPartUUIDs
+	ClientReadTaskResponse
 )
 
 const (
@@ -23,9 +28,72 @@ const (
 	ServerProfileInfo
 	ServerTotals
 	ServerExtremes
+	ServerTablesStatusResponse
+	ServerLog
+	ServerTableColumns
+	ServerPartUUIDs
+	ServerReadTaskRequest
+	ServerProfileEvents
 )
 
+// Protocol revisions introducing optional fields and packets.
+// Both sides use the minimal of their revisions after Hello.
 const (
-	DBMS_MIN_REVISION_WITH_SERVER_TIMEZONE          = 54058
-	DBMS_MIN_REVISION_WITH_QUOTA_KEY_IN_CLIENT_INFO = 54060
+	DBMS_MIN_REVISION_WITH_TEMPORARY_TABLES       = 50264
+	DBMS_MIN_REVISION_WITH_TOTAL_ROWS_IN_PROGRESS = 51554
+	DBMS_MIN_REVISION_WITH_BLOCK_INFO             = 51903
+
+	DBMS_MIN_REVISION_WITH_CLIENT_INFO                               = 54032
+	DBMS_MIN_REVISION_WITH_SERVER_TIMEZONE                           = 54058
+	DBMS_MIN_REVISION_WITH_QUOTA_KEY_IN_CLIENT_INFO                  = 54060
+	DBMS_MIN_REVISION_WITH_TABLES_STATUS                             = 54226
+	DBMS_MIN_REVISION_WITH_TIME_ZONE_PARAMETER_IN_DATETIME_DATA_TYPE = 54337
+	DBMS_MIN_REVISION_WITH_SERVER_DISPLAY_NAME                       = 54372
+	DBMS_MIN_REVISION_WITH_VERSION_PATCH                             = 54401
+	DBMS_MIN_REVISION_WITH_LOW_CARDINALITY_TYPE                      = 54405
+	DBMS_MIN_REVISION_WITH_SERVER_LOGS                               = 54406
+	DBMS_MIN_REVISION_WITH_COLUMN_DEFAULTS_METADATA                  = 54410
+	DBMS_MIN_REVISION_WITH_CLIENT_WRITE_INFO                         = 54420
+
+	DBMS_MIN_REVISION_WITH_SETTINGS_SERIALIZED_AS_STRINGS = 54429
+	DBMS_MIN_REVISION_WITH_SCALARS                        = 54429
+
+	DBMS_MIN_REVISION_WITH_INTERSERVER_SECRET                 = 54441
+	DBMS_MIN_REVISION_WITH_OPENTELEMETRY                      = 54442
+	DBMS_MIN_REVISION_WITH_X_FORWARDED_FOR_IN_CLIENT_INFO     = 54443
+	DBMS_MIN_REVISION_WITH_REFERER_IN_CLIENT_INFO             = 54447
+	DBMS_MIN_PROTOCOL_VERSION_WITH_DISTRIBUTED_DEPTH          = 54448
+	DBMS_MIN_PROTOCOL_VERSION_WITH_INITIAL_QUERY_START_TIME   = 54449
+	DBMS_MIN_PROTOCOL_VERSION_WITH_INCREMENTAL_PROFILE_EVENTS = 54451
+	DBMS_MIN_REVISION_WITH_AGGREGATE_FUNCTIONS_VERSIONING     = 54452
+	DBMS_MIN_REVISION_WITH_PARALLEL_REPLICAS                  = 54453
+
+	// not implemented yet
+	DBMS_MIN_REVISION_WITH_CUSTOM_SERIALIZATION                  = 54454
+	DBMS_MIN_PROTOCOL_VERSION_WITH_PROFILE_EVENTS_IN_INSERT      = 54456
+	DBMS_MIN_PROTOCOL_VERSION_WITH_VIEW_IF_PERMITTED             = 54457
+	DBMS_MIN_PROTOCOL_VERSION_WITH_ADDENDUM                      = 54458
+	DBMS_MIN_PROTOCOL_VERSION_WITH_QUOTA_KEY                     = 54458
+	DBMS_MIN_PROTOCOL_VERSION_WITH_PARAMETERS                    = 54459
+	DBMS_MIN_PROTOCOL_VERSION_WITH_SERVER_QUERY_TIME_IN_PROGRESS = 54460
+)
+
+const (
+	// DBMS_MIN_SUPPORTED_REVISION is the oldest revision we can talk to.
+	DBMS_MIN_SUPPORTED_REVISION = DBMS_MIN_REVISION_WITH_CLIENT_INFO
+
+	// DBMS_CLUSTER_PROCESSING_PROTOCOL_VERSION is ReadTaskResponse version.
+	DBMS_CLUSTER_PROCESSING_PROTOCOL_VERSION = 1
+
+	// DBMS_TCP_PROTOCOL_VERSION is the newest revision we implement.
+	DBMS_TCP_PROTOCOL_VERSION = DBMS_MIN_REVISION_WITH_PARALLEL_REPLICAS
+)
+
+// Exception codes.
+const (
+	QUOTA_EXCEEDED                = 201
+	TOO_MANY_SIMULTANEOUS_QUERIES = 202
+	NETWORK_ERROR                 = 210
+	ACCESS_DENIED                 = 497
+	AUTHENTICATION_FAILED         = 516
 )
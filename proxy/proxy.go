@@ -2,13 +2,17 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"time"
 
 	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/clickhouse/auth"
 	"github.com/nikandfor/clickhouse/binary"
 	"github.com/nikandfor/clickhouse/clpool"
+	"github.com/nikandfor/clickhouse/limiter"
 	"github.com/nikandfor/errors"
 	"github.com/nikandfor/loc"
 	"github.com/nikandfor/tlog"
@@ -19,6 +23,19 @@ import (
 type (
 	Proxy struct {
 		pool click.ClientPool
+
+		// TLSConfig enables TLS termination if set.
+		TLSConfig *tls.Config
+
+		// CertCredentials maps verified client certificate to upstream credentials.
+		// Connections with no client certificate are rejected if it's set.
+		CertCredentials func(cert *x509.Certificate, creds *click.Credentials) error
+
+		// Auth authenticates clients. Client credentials are forwarded as is if nil.
+		Auth auth.Authenticator
+
+		// Limiter limits connections and queries if set.
+		Limiter *limiter.Limiter
 	}
 
 	netCounter struct {
@@ -31,6 +48,7 @@ type (
 	blocksRows struct {
 		blocks int
 		rows   int
+		bytes  int64
 	}
 )
 
@@ -124,6 +142,19 @@ func (p *Proxy) HandleConn(ctx context.Context, conn net.Conn) (err error) {
 
 	ctx = tlog.ContextWithSpan(ctx, tr)
 
+	var tc *tls.Conn
+
+	if p.TLSConfig != nil {
+		tc = tls.Server(conn, p.TLSConfig)
+		conn = tc
+
+		err = tc.HandshakeContext(ctx)
+		if err != nil {
+			_ = conn.Close()
+			return errors.Wrap(err, "tls handshake")
+		}
+	}
+
 	if tr.If("dump_server_conn,dump_conn") {
 		dc := binary.NewDumpConn(conn, tr)
 		dc.Callers = 5
@@ -140,19 +171,59 @@ func (p *Proxy) HandleConn(ctx context.Context, conn net.Conn) (err error) {
 
 	srv.Server.Name = "gh/nikandfor/clickhouse"
 
-	srv.Auth = nil // TODO
+	upstream := click.Credentials{}
+
+	var release func()
+
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+
+	srv.Auth = func(ctx context.Context, srv *binary.Server) (err error) {
+		if tc != nil && p.CertCredentials != nil {
+			certs := tc.ConnectionState().PeerCertificates
+			if len(certs) == 0 {
+				return errors.New("no client certificate")
+			}
+
+			err = p.CertCredentials(certs[0], &srv.Credentials)
+			if err != nil {
+				return err
+			}
+		}
+
+		upstream = srv.Credentials
+
+		if p.Auth != nil {
+			upstream, err = p.Auth.Authenticate(ctx, srv.Credentials, conn.RemoteAddr())
+			if err != nil {
+				return err
+			}
+		}
+
+		if p.Limiter != nil {
+			release, err = p.Limiter.Connect(limiter.Keys{User: srv.Credentials.User, Host: host(conn.RemoteAddr())})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
 
 	err = srv.Hello(ctx)
 	if err != nil {
 		return errors.Wrap(err, "hello")
 	}
 
-	tr.Printw("hello", "db", srv.Credentials.Database, "user", srv.Credentials.User, "agent", srv.Client.Name, "agent_ver", srv.Client.Ver)
+	tr.Printw("hello", "db", srv.Credentials.Database, "user", srv.Credentials.User, "agent", srv.Client.Name, "agent_ver", srv.Client.Ver, "rev", srv.Revision())
 
 	var clopts []click.ClientOption
 
 	//	clopts = append(clopts, click.WithDatabase(srv.Database))
-	clopts = append(clopts, click.WithCredentials(srv.Credentials))
+	clopts = append(clopts, click.WithCredentials(upstream))
 
 	for err == nil {
 		select {
@@ -177,6 +248,20 @@ func (p *Proxy) HandleRequest(ctx context.Context, srv click.ServerConn, clopts
 		return errors.Wrap(err, "reading next request")
 	}
 
+	switch pk {
+	case click.ClientQuery:
+	case click.ClientPing:
+		// keepalive, no need to bother the upstream
+		err = srv.SendPong(ctx)
+		if err != nil {
+			return errors.Wrap(err, "send pong")
+		}
+
+		return nil
+	default:
+		return errors.New("client: unexpected packet: %x", pk)
+	}
+
 	tr := tlog.SpawnFromContext(ctx, "request")
 	defer func() { tr.Finish("err", err, "", loc.Caller(1)) }()
 
@@ -229,31 +314,64 @@ func (p *Proxy) HandleRequest(ctx context.Context, srv click.ServerConn, clopts
 		_ = srv.SendException(ctx, err)
 	}()
 
-	cl, err := p.pool.Get(ctx, clopts...)
+	q, err := srv.RecvQuery(ctx)
 	if err != nil {
-		return errors.Wrap(err, "client")
+		return errors.Wrap(err, "recv query")
 	}
 
-	defer func() { p.pool.Put(ctx, cl, err) }()
+	tr.Printw("query", "query", q.Query, "kind", q.Statement().Kind.String(), "compressed", q.Compressed, "qid", q.ID, "quota_key", q.Info.QuotaKey, "initial_user", q.Info.InitialUser, "initial_address", q.Info.InitialAddress, "client", q.Info.Client, "settings", q.Settings.Key(), "ext_tables", len(q.Tables))
 
-	switch pk {
-	case click.ClientQuery:
-	default:
-		return errors.New("client: unexpected packet: %x", pk)
+	if p.Limiter != nil {
+		var user string
+		if s, ok := srv.(*binary.Server); ok {
+			user = s.Credentials.User
+		}
+
+		done, err := p.Limiter.Query(limiter.Keys{User: user, QuotaKey: q.Info.QuotaKey, Host: remoteHost})
+		if err != nil {
+			tr.Printw("query rejected", "err", err)
+
+			// the connection is fine, just the query is rejected
+			return srv.SendException(ctx, err)
+		}
+
+		defer func() { done(int64(mm.rows), mm.bytes) }()
 	}
 
-	q, err := srv.RecvQuery(ctx)
+	cl, err := p.pool.Get(ctx, clopts...)
 	if err != nil {
-		return errors.Wrap(err, "recv query")
+		return errors.Wrap(err, "client")
 	}
 
-	tr.Printw("query", "query", q.Query, "compressed", q.Compressed, "qid", q.ID, "quota_key", q.QuotaKey)
+	defer func() { p.pool.Put(ctx, cl, err) }()
 
 	meta, err := cl.SendQuery(ctx, q)
+	var exc *click.Exception
+	if errors.As(err, &exc) {
+		tr.Printw("query failed", "err", err)
+
+		// the query is rejected, but both connections are fine
+		err = srv.SendException(ctx, exc)
+
+		return errors.Wrap(err, "send exception")
+	}
 	if err != nil {
 		return errors.Wrap(err, "send query")
 	}
 
+	// logs and table columns received before the header
+	for n := cl.Buffered(); n > 0; n-- {
+		pk, err := cl.NextPacket(ctx)
+		if err != nil {
+			return errors.Wrap(err, "server: recv packet")
+		}
+
+		_, err = p.forwardPacket(ctx, srv, cl, q, pk)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = srv.SendQueryMeta(ctx, meta, q.Compressed)
 	if err != nil {
 		return errors.Wrap(err, "send query meta")
@@ -280,13 +398,15 @@ func (p *Proxy) sendData(ctx context.Context, srv click.ServerConn, cl click.Cli
 	tr := tlog.SpanFromContext(ctx)
 
 	var blocks, rows int
+	var size int64
 
 	defer func() {
-		tr.Printw("client-to-server blocks", "blocks", blocks, "rows", rows)
+		tr.Printw("client-to-server blocks", "blocks", blocks, "rows", rows, "size", size)
 
 		if mm != nil {
 			mm.blocks = blocks
 			mm.rows = rows
+			mm.bytes = size
 		}
 	}()
 
@@ -325,6 +445,7 @@ func (p *Proxy) sendData(ctx context.Context, srv click.ServerConn, cl click.Cli
 
 		blocks++
 		rows += b.Rows
+		size += b.DataSize()
 
 		tr.V("blocks").Printw("client block", "rows", b.Rows)
 	}
@@ -347,55 +468,145 @@ func (p *Proxy) recvResponse(ctx context.Context, srv click.ServerConn, cl click
 			return errors.Wrap(err, "server: recv packet")
 		}
 
-		switch pk {
-		case click.ServerEndOfStream:
+		if pk == click.ServerEndOfStream {
 			err = srv.SendEndOfStream(ctx)
 
 			// end of request
 			return errors.Wrap(err, "client: send eos")
-		case click.ServerData:
-			b, err := cl.RecvBlock(ctx, q.Compressed)
-			if err != nil {
-				return errors.Wrap(err, "server: recv block")
-			}
+		}
 
-			err = srv.SendBlock(ctx, b, q.Compressed)
+		b, err := p.forwardPacket(ctx, srv, cl, q, pk)
+		if err != nil {
+			return err
+		}
 
-			if !b.IsEmpty() {
-				tr.V("blocks").Printw("server block", "rows", b.Rows)
+		if pk == click.ServerException {
+			// end of request
+			return nil
+		}
 
-				blocks++
-				rows += b.Rows
-			}
-		case click.ServerException:
-			err = cl.RecvException(ctx)
-			if _, ok := err.(*click.Exception); !ok {
-				return errors.Wrap(err, "server: recv exception")
-			}
+		if pk == click.ServerData && !b.IsEmpty() {
+			tr.V("blocks").Printw("server block", "rows", b.Rows)
 
-			err = srv.SendException(ctx, err)
-		case click.ServerProgress:
-			p, err := cl.RecvProgress(ctx)
-			if err != nil {
-				return errors.Wrap(err, "server: recv progress")
-			}
+			blocks++
+			rows += b.Rows
+		}
+	}
+}
 
-			err = srv.SendProgress(ctx, p)
-		case click.ServerProfileInfo:
-			p, err := cl.RecvProfileInfo(ctx)
-			if err != nil {
-				return errors.Wrap(err, "server: recv profile info")
-			}
+// forwardPacket passes server packet pk to the client. Data block is returned for stats.
+func (p *Proxy) forwardPacket(ctx context.Context, srv click.ServerConn, cl click.Client, q *click.Query, pk click.ServerPacket) (b *click.Block, err error) {
+	switch pk {
+	case click.ServerData, click.ServerTotals, click.ServerExtremes:
+		b, err = cl.RecvBlock(ctx, q.Compressed)
+		if err != nil {
+			return nil, errors.Wrap(err, "server: recv block %x", pk)
+		}
 
-			err = srv.SendProfileInfo(ctx, p)
+		switch pk {
+		case click.ServerData:
+			err = srv.SendBlock(ctx, b, q.Compressed)
+		case click.ServerTotals:
+			err = srv.SendTotals(ctx, b, q.Compressed)
 		default:
-			return errors.New("server: unexpected packet: %x", pk)
+			err = srv.SendExtremes(ctx, b, q.Compressed)
+		}
+	case click.ServerLog, click.ServerProfileEvents:
+		b, err = cl.RecvBlock(ctx, false)
+		if err != nil {
+			return nil, errors.Wrap(err, "server: recv block %x", pk)
+		}
+
+		if pk == click.ServerLog {
+			err = srv.SendLog(ctx, b)
+		} else {
+			err = srv.SendProfileEvents(ctx, b)
+		}
+	case click.ServerException:
+		err = cl.RecvException(ctx)
+		if _, ok := err.(*click.Exception); !ok {
+			return nil, errors.Wrap(err, "server: recv exception")
 		}
 
+		err = srv.SendException(ctx, err)
+	case click.ServerProgress:
+		var pr click.Progress
+
+		pr, err = cl.RecvProgress(ctx)
 		if err != nil {
-			return errors.Wrap(err, "client: send %x", pk)
+			return nil, errors.Wrap(err, "server: recv progress")
 		}
+
+		err = srv.SendProgress(ctx, pr)
+	case click.ServerProfileInfo:
+		var pi click.ProfileInfo
+
+		pi, err = cl.RecvProfileInfo(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "server: recv profile info")
+		}
+
+		err = srv.SendProfileInfo(ctx, pi)
+	case click.ServerTableColumns:
+		var tc click.TableColumns
+
+		tc, err = cl.RecvTableColumns(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "server: recv table columns")
+		}
+
+		err = srv.SendTableColumns(ctx, tc)
+	case click.ServerPartUUIDs:
+		var ids [][16]byte
+
+		ids, err = cl.RecvPartUUIDs(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "server: recv part uuids")
+		}
+
+		err = srv.SendPartUUIDs(ctx, ids)
+	case click.ServerReadTaskRequest:
+		err = p.forwardReadTask(ctx, srv, cl)
+		if err != nil {
+			return nil, errors.Wrap(err, "read task")
+		}
+	default:
+		return nil, errors.New("server: unexpected packet: %x", pk)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "client: send %x", pk)
+	}
+
+	return b, nil
+}
+
+func (p *Proxy) forwardReadTask(ctx context.Context, srv click.ServerConn, cl click.Client) (err error) {
+	err = srv.SendReadTaskRequest(ctx)
+	if err != nil {
+		return errors.Wrap(err, "client: send request")
+	}
+
+	pk, err := srv.NextPacket(ctx)
+	if err != nil {
+		return errors.Wrap(err, "client: recv packet")
+	}
+
+	if pk != click.ClientReadTaskResponse {
+		return errors.New("client: unexpected packet: %x", pk)
 	}
+
+	resp, err := srv.RecvReadTaskResponse(ctx)
+	if err != nil {
+		return errors.Wrap(err, "client: recv response")
+	}
+
+	err = cl.SendReadTaskResponse(ctx, resp)
+	if err != nil {
+		return errors.Wrap(err, "server: send response")
+	}
+
+	return nil
 }
 
 func (p *Proxy) Close() (err error) {
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/clickhouse/auth"
+	"github.com/nikandfor/clickhouse/binary"
+	"github.com/nikandfor/clickhouse/clpool"
+	"github.com/nikandfor/clickhouse/limiter"
+	"github.com/nikandfor/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	noPool struct {
+		t testing.TB
+	}
+)
+
+func TestProxyPing(t *testing.T) {
+	ctx := context.Background()
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+
+	p := New(ctx, noPool{t: t})
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- p.HandleConn(ctx, sc)
+	}()
+
+	cl := binary.NewClient(ctx, cc)
+	require.NoError(t, cl.Hello(ctx))
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, clpool.Ping(ctx, cl))
+	}
+
+	require.NoError(t, cl.Close())
+	assert.NoError(t, <-errc)
+}
+
+func (p noPool) Get(ctx context.Context, opts ...click.ClientOption) (click.Client, error) {
+	p.t.Errorf("unexpected pool.Get")
+
+	return nil, errors.New("no pool")
+}
+
+func (p noPool) Put(ctx context.Context, cl click.Client, err error) error { return nil }
+
+func (p noPool) Close() error { return nil }
+
+func TestProxyAuth(t *testing.T) {
+	var exc *click.Exception
+
+	ctx := context.Background()
+
+	users, err := auth.Parse([]byte("users: {alice: {password: pass}}"))
+	require.NoError(t, err)
+
+	p := New(ctx, noPool{t: t})
+	p.Auth = users
+
+	for _, pass := range []string{"pass", "bad"} {
+		cc, sc := net.Pipe()
+
+		errc := make(chan error, 1)
+
+		go func() {
+			errc <- p.HandleConn(ctx, sc)
+		}()
+
+		cl := binary.NewClient(ctx, cc)
+		cl.Credentials.User = "alice"
+		cl.Credentials.Password = pass
+
+		err = cl.Hello(ctx)
+
+		if pass == "pass" {
+			assert.NoError(t, err)
+			assert.NoError(t, cl.Close())
+			assert.NoError(t, <-errc)
+
+			continue
+		}
+
+		if assert.ErrorAs(t, err, &exc) {
+			assert.Equal(t, int32(click.AUTHENTICATION_FAILED), exc.Code)
+		}
+
+		assert.Error(t, <-errc)
+		assert.NoError(t, cl.Close())
+	}
+}
+
+func TestProxyLimiter(t *testing.T) {
+	var exc *click.Exception
+
+	ctx := context.Background()
+
+	lim, err := limiter.Parse([]byte("user: {default: {max_connections: 1, max_qps: 1}}"))
+	require.NoError(t, err)
+
+	p := New(ctx, noPool{t: t})
+	p.Limiter = lim
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- p.HandleConn(ctx, sc)
+	}()
+
+	cl := binary.NewClient(ctx, cc)
+	require.NoError(t, cl.Hello(ctx))
+
+	// the second connection
+	cc2, sc2 := net.Pipe()
+	defer cc2.Close()
+
+	go func() {
+		_ = p.HandleConn(ctx, sc2)
+	}()
+
+	err = binary.NewClient(ctx, cc2).Hello(ctx)
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(click.TOO_MANY_SIMULTANEOUS_QUERIES), exc.Code)
+	}
+
+	// use up the token so the query is rejected before reaching the pool
+	_, err = lim.Query(limiter.Keys{User: "default"})
+	require.NoError(t, err)
+
+	_, err = cl.SendQuery(ctx, &click.Query{Query: "SELECT 1"})
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, int32(click.QUOTA_EXCEEDED), exc.Code)
+	}
+
+	// connection is still alive
+	assert.NoError(t, clpool.Ping(ctx, cl))
+
+	require.NoError(t, cl.Close())
+	assert.NoError(t, <-errc)
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/tlog"
+)
+
+type (
+	// CertLoader serves TLS certificate and reloads it when its files are modified.
+	CertLoader struct {
+		CertFile string
+		KeyFile  string
+
+		// CheckInterval is how often files are checked for modification.
+		CheckInterval time.Duration
+
+		mu      sync.Mutex
+		cert    *tls.Certificate
+		mod     time.Time
+		checked time.Time
+	}
+)
+
+const DefaultCertCheckInterval = 10 * time.Second
+
+// NewCertLoader loads the certificate.
+func NewCertLoader(certFile, keyFile string) (*CertLoader, error) {
+	l := &CertLoader{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CheckInterval: DefaultCertCheckInterval,
+	}
+
+	err := l.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Reload loads the certificate from files.
+// The previous one is kept on error.
+func (l *CertLoader) Reload() error {
+	mod, err := l.modTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "load certificate")
+	}
+
+	defer l.mu.Unlock()
+	l.mu.Lock()
+
+	l.cert = &cert
+	l.mod = mod
+
+	return nil
+}
+
+// GetCertificate is a tls.Config.GetCertificate hook.
+func (l *CertLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+
+	now := time.Now()
+	check := now.Sub(l.checked) >= l.CheckInterval
+
+	if check {
+		l.checked = now
+	}
+
+	l.mu.Unlock()
+
+	if check {
+		l.reloadIfModified()
+	}
+
+	defer l.mu.Unlock()
+	l.mu.Lock()
+
+	return l.cert, nil
+}
+
+func (l *CertLoader) reloadIfModified() {
+	mod, err := l.modTime()
+	if err != nil {
+		tlog.Printw("check certificate", "err", err)
+		return
+	}
+
+	l.mu.Lock()
+	same := !mod.After(l.mod)
+	l.mu.Unlock()
+
+	if same {
+		return
+	}
+
+	err = l.Reload()
+
+	tlog.Printw("reload certificate", "cert", l.CertFile, "err", err)
+}
+
+func (l *CertLoader) modTime() (mod time.Time, err error) {
+	for _, f := range []string{l.CertFile, l.KeyFile} {
+		inf, err := os.Stat(f)
+		if err != nil {
+			return mod, errors.Wrap(err, "stat")
+		}
+
+		if inf.ModTime().After(mod) {
+			mod = inf.ModTime()
+		}
+	}
+
+	return mod, nil
+}
+
+// ServerTLSConfig makes server config with reloadable certificate.
+// Client certificates are required and verified against clientCA if it's set.
+func ServerTLSConfig(l *CertLoader, clientCA string) (c *tls.Config, err error) {
+	c = &tls.Config{
+		GetCertificate: l.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCA == "" {
+		return c, nil
+	}
+
+	ca, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, errors.Wrap(err, "read client ca")
+	}
+
+	c.ClientCAs = x509.NewCertPool()
+
+	if !c.ClientCAs.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in %v", clientCA)
+	}
+
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return c, nil
+}
+
+// CommonNameUser uses client certificate common name as the user.
+func CommonNameUser(cert *x509.Certificate, creds *click.Credentials) error {
+	if cert.Subject.CommonName == "" {
+		return errors.New("no common name in client certificate")
+	}
+
+	creds.User = cert.Subject.CommonName
+
+	return nil
+}
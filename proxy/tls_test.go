@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/clickhouse/binary"
+	"github.com/nikandfor/clickhouse/clpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	testCert struct {
+		cert *x509.Certificate
+		key  *ecdsa.PrivateKey
+		pem  []byte
+		kpem []byte
+	}
+)
+
+func TestProxyTLS(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "ca", nil)
+	srvCert := newTestCert(t, "localhost", ca)
+	clCert := newTestCert(t, "alice", ca)
+
+	writeFile(t, dir, "ca.pem", ca.pem)
+	writeFile(t, dir, "srv.pem", srvCert.pem)
+	writeFile(t, dir, "srv.key", srvCert.kpem)
+
+	l, err := NewCertLoader(filepath.Join(dir, "srv.pem"), filepath.Join(dir, "srv.key"))
+	require.NoError(t, err)
+
+	p := New(ctx, noPool{t: t})
+
+	p.TLSConfig, err = ServerTLSConfig(l, filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+
+	var creds click.Credentials
+
+	p.CertCredentials = func(cert *x509.Certificate, c *click.Credentials) error {
+		err := CommonNameUser(cert, c)
+		creds = *c
+
+		return err
+	}
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- p.HandleConn(ctx, sc)
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tc := tls.Client(cc, &tls.Config{
+		ServerName:   "localhost",
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clCert.tls()},
+	})
+
+	cl := binary.NewClient(ctx, tc)
+	cl.Credentials.User = "bob"
+
+	require.NoError(t, cl.Hello(ctx))
+	assert.NoError(t, clpool.Ping(ctx, cl))
+
+	require.NoError(t, cl.Close())
+	assert.NoError(t, <-errc)
+
+	assert.Equal(t, "alice", creds.User)
+}
+
+func TestCertLoaderReload(t *testing.T) {
+	dir := t.TempDir()
+
+	a := newTestCert(t, "a", nil)
+
+	certFile := writeFile(t, dir, "c.pem", a.pem)
+	keyFile := writeFile(t, dir, "c.key", a.kpem)
+
+	l, err := NewCertLoader(certFile, keyFile)
+	require.NoError(t, err)
+
+	l.CheckInterval = 0
+
+	c, err := l.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, a.cert.Raw, c.Certificate[0])
+
+	b := newTestCert(t, "b", nil)
+
+	writeFile(t, dir, "c.pem", b.pem)
+	writeFile(t, dir, "c.key", b.kpem)
+
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+
+	c, err = l.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, b.cert.Raw, c.Certificate[0])
+
+	// broken files keep the previous certificate
+	writeFile(t, dir, "c.key", []byte("broken"))
+
+	future = future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+
+	c, err = l.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, b.cert.Raw, c.Certificate[0])
+}
+
+func newTestCert(t testing.TB, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		kpem: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}),
+	}
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.cert.Raw},
+		PrivateKey:  c.key,
+	}
+}
+
+func writeFile(t testing.TB, dir, name string, data []byte) string {
+	f := filepath.Join(dir, name)
+
+	require.NoError(t, os.WriteFile(f, data, 0o600))
+
+	return f
+}
@@ -0,0 +1,1239 @@
+package clickhouse
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/nikandfor/errors"
+)
+
+type (
+	decoder interface {
+		// init prepares to decode rows values from raw.
+		init(raw []byte, rows int) error
+		decode(row int, v reflect.Value) error
+	}
+
+	encoder interface {
+		encode(v reflect.Value) error
+		encodeDefault()
+
+		appendPrefix(b []byte) []byte
+		appendData(b []byte) []byte
+	}
+
+	leafDec struct {
+		t    ColType
+		name string
+		raw  bool // see rawCompatible
+
+		vals reflect.Value // slice returned by Column accessor
+	}
+
+	nullableDec struct {
+		elem decoder
+		ptr  bool
+
+		nulls []byte
+	}
+
+	arrayDec struct {
+		elem decoder
+
+		offsets []int
+	}
+
+	mapDec struct {
+		kt       ColType
+		key, val decoder
+
+		offsets []int
+	}
+
+	tupleDec struct {
+		t      tupleType
+		elems  []decoder
+		fields []int          // struct fields or nil for []interface{}
+		types  []reflect.Type // []interface{} element types
+	}
+
+	lowCardDec struct {
+		t    lowCardType
+		elem decoder
+	}
+
+	leafEnc struct {
+		col Column
+		raw bool // see rawCompatible
+	}
+
+	nullableEnc struct {
+		elem encoder
+		ptr  bool
+
+		nulls []byte
+	}
+
+	arrayEnc struct {
+		elem encoder
+
+		offsets []int
+	}
+
+	mapEnc struct {
+		key, val encoder
+
+		offsets []int
+	}
+
+	tupleEnc struct {
+		elems  []encoder
+		fields []int          // struct fields or nil for []interface{}
+		types  []reflect.Type // []interface{} element types
+	}
+
+	lowCardEnc struct {
+		elem *leafEnc
+		ptr  bool
+
+		d lowCardData
+	}
+)
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	uuidType = reflect.TypeOf([16]byte{})
+	ipType   = reflect.TypeOf(net.IP{})
+)
+
+// NewBlock creates empty block with the columns from meta.
+func NewBlock(meta QueryMeta) *Block {
+	b := &Block{
+		Cols: make([]Column, len(meta)),
+	}
+
+	for i, c := range meta {
+		b.Cols[i] = Column{Name: c.Name, Type: c.Type}
+	}
+
+	return b
+}
+
+// Meta returns block columns without data.
+func (b *Block) Meta() QueryMeta {
+	m := make(QueryMeta, len(b.Cols))
+
+	for i, c := range b.Cols {
+		m[i] = Column{Name: c.Name, Type: c.Type}
+	}
+
+	return m
+}
+
+// CheckStruct checks v, struct or a pointer to it, has fields for all the columns.
+// Fields are matched by `ch:"name"` tag or by the field name.
+func (m QueryMeta) CheckStruct(v interface{}) error {
+	rt := reflect.TypeOf(v)
+
+	for rt != nil && (rt.Kind() == reflect.Ptr || rt.Kind() == reflect.Slice) {
+		rt = rt.Elem()
+	}
+
+	if rt == nil || rt.Kind() != reflect.Struct {
+		return errors.New("expected struct, got %T", v)
+	}
+
+	_, _, err := m.decoders(rt)
+
+	return err
+}
+
+// Scan decodes block rows and appends them to dst.
+// dst is a pointer to a slice of structs or pointers to structs.
+func (b *Block) Scan(dst interface{}) (err error) {
+	rv := reflect.ValueOf(dst)
+
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return errors.New("expected pointer to slice, got %T", dst)
+	}
+
+	sv := rv.Elem()
+	et := sv.Type().Elem()
+
+	st := et
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+
+	if st.Kind() != reflect.Struct {
+		return errors.New("expected slice of structs, got %T", dst)
+	}
+
+	decs, fields, err := b.Meta().decoders(st)
+	if err != nil {
+		return err
+	}
+
+	for i, d := range decs {
+		if b.Rows == 0 {
+			break
+		}
+
+		t, err := b.Cols[i].ColType()
+		if err != nil {
+			return err
+		}
+
+		p := t.prefixLen()
+
+		if len(b.Cols[i].RawData) < p {
+			return errors.New("col %v: bad data size: %d", b.Cols[i].Name, len(b.Cols[i].RawData))
+		}
+
+		// prefixes are checked by ReadColumnData, decoders get just the data
+		err = d.init(b.Cols[i].RawData[p:], b.Rows)
+		if err != nil {
+			return errors.Wrap(err, "col %v", b.Cols[i].Name)
+		}
+	}
+
+	l := sv.Len()
+
+	if sv.Cap() < l+b.Rows {
+		n := reflect.MakeSlice(sv.Type(), l, l+b.Rows)
+		reflect.Copy(n, sv)
+		sv.Set(n)
+	}
+
+	sv.SetLen(l + b.Rows)
+
+	for row := 0; row < b.Rows; row++ {
+		v := sv.Index(l + row)
+
+		if et.Kind() == reflect.Ptr {
+			v.Set(reflect.New(st))
+			v = v.Elem()
+		}
+
+		for i, d := range decs {
+			err = d.decode(row, v.FieldByIndex(fields[i]))
+			if err != nil {
+				sv.SetLen(l)
+				return errors.Wrap(err, "row %d: col %v", row, b.Cols[i].Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// AppendRows encodes src and appends it to the block.
+// src is a slice of structs or pointers to structs.
+// Block columns must be already set, see NewBlock.
+func (b *Block) AppendRows(src interface{}) (err error) {
+	sv := reflect.ValueOf(src)
+
+	if sv.Kind() != reflect.Slice {
+		return errors.New("expected slice, got %T", src)
+	}
+
+	st := sv.Type().Elem()
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+
+	if st.Kind() != reflect.Struct {
+		return errors.New("expected slice of structs, got %T", src)
+	}
+
+	encs, fields, err := b.Meta().encoders(st)
+	if err != nil {
+		return err
+	}
+
+	rows := sv.Len()
+
+	for row := 0; row < rows; row++ {
+		v := sv.Index(row)
+
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return errors.New("row %d: nil struct", row)
+			}
+
+			v = v.Elem()
+		}
+
+		for i, e := range encs {
+			err = e.encode(v.FieldByIndex(fields[i]))
+			if err != nil {
+				return errors.Wrap(err, "row %d: col %v", row, b.Cols[i].Name)
+			}
+		}
+	}
+
+	if rows == 0 {
+		return nil
+	}
+
+	data := make([][]byte, len(encs))
+
+	for i, e := range encs {
+		data[i] = e.appendData(e.appendPrefix(nil))
+	}
+
+	for i := range b.Cols {
+		t, err := b.Cols[i].ColType()
+		if err != nil {
+			return err
+		}
+
+		b.Cols[i].RawData, err = AppendColumnData(t, b.Cols[i].RawData, b.Rows, data[i], rows)
+		if err != nil {
+			return errors.Wrap(err, "col %v", b.Cols[i].Name)
+		}
+	}
+
+	b.Rows += rows
+
+	return nil
+}
+
+func (m QueryMeta) decoders(st reflect.Type) (decs []decoder, fields [][]int, err error) {
+	fields, err = m.fields(st)
+	if err != nil {
+		return
+	}
+
+	decs = make([]decoder, len(m))
+
+	for i, c := range m {
+		t, err := ParseColType(c.Type)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "col %v", c.Name)
+		}
+
+		ft := st.FieldByIndex(fields[i])
+
+		decs[i], err = newDecoder(t, ft.Type)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "col %v: field %v", c.Name, ft.Name)
+		}
+	}
+
+	return decs, fields, nil
+}
+
+func (m QueryMeta) encoders(st reflect.Type) (encs []encoder, fields [][]int, err error) {
+	fields, err = m.fields(st)
+	if err != nil {
+		return
+	}
+
+	encs = make([]encoder, len(m))
+
+	for i, c := range m {
+		t, err := ParseColType(c.Type)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "col %v", c.Name)
+		}
+
+		ft := st.FieldByIndex(fields[i])
+
+		encs[i], err = newEncoder(t, ft.Type)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "col %v: field %v", c.Name, ft.Name)
+		}
+	}
+
+	return encs, fields, nil
+}
+
+func (m QueryMeta) fields(st reflect.Type) (fields [][]int, err error) {
+	byName := map[string][]int{}
+
+	structFields(st, nil, byName)
+
+	fields = make([][]int, len(m))
+
+	var missing []string
+
+	for i, c := range m {
+		f, ok := byName[c.Name]
+		if !ok {
+			missing = append(missing, c.Name)
+			continue
+		}
+
+		fields[i] = f
+	}
+
+	if missing != nil {
+		return nil, errors.New("no fields in %v for columns: %v", st, strings.Join(missing, ", "))
+	}
+
+	return fields, nil
+}
+
+func structFields(st reflect.Type, idx []int, byName map[string][]int) {
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+
+		tag, ok := f.Tag.Lookup("ch")
+		if tag == "-" {
+			continue
+		}
+
+		fidx := append(idx[:len(idx):len(idx)], i)
+
+		if !ok && f.Anonymous && f.Type.Kind() == reflect.Struct {
+			structFields(f.Type, fidx, byName)
+			continue
+		}
+
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+
+		name := f.Name
+		if tag != "" {
+			name = tag
+		}
+
+		if _, ok := byName[name]; !ok {
+			byName[name] = fidx
+		}
+	}
+}
+
+func newDecoder(t ColType, rt reflect.Type) (_ decoder, err error) {
+	switch t := t.(type) {
+	case nullableType:
+		d := &nullableDec{ptr: rt.Kind() == reflect.Ptr}
+
+		et := rt
+		if d.ptr {
+			et = rt.Elem()
+		}
+
+		d.elem, err = newDecoder(t.elem, et)
+		if err != nil {
+			return nil, err
+		}
+
+		return d, nil
+	case mapType:
+		if rt.Kind() != reflect.Map {
+			return nil, errors.New("expected map for %v, got %v", t, rt)
+		}
+
+		tt := t.elem.(tupleType)
+		d := &mapDec{kt: tt.elems[0]}
+
+		d.key, err = newDecoder(tt.elems[0], rt.Key())
+		if err != nil {
+			return nil, errors.Wrap(err, "key")
+		}
+
+		d.val, err = newDecoder(tt.elems[1], rt.Elem())
+		if err != nil {
+			return nil, errors.Wrap(err, "value")
+		}
+
+		return d, nil
+	case arrayType:
+		if rt.Kind() != reflect.Slice {
+			return nil, errors.New("expected slice for %v, got %v", t, rt)
+		}
+
+		d := &arrayDec{}
+
+		d.elem, err = newDecoder(t.elem, rt.Elem())
+		if err != nil {
+			return nil, err
+		}
+
+		return d, nil
+	case tupleType:
+		d := &tupleDec{t: t}
+
+		d.fields, d.types, err = tupleFields(t, rt)
+		if err != nil {
+			return nil, err
+		}
+
+		d.elems = make([]decoder, len(t.elems))
+
+		for i, e := range t.elems {
+			d.elems[i], err = newDecoder(e, d.types[i])
+			if err != nil {
+				return nil, errors.Wrap(err, "elem %d", i)
+			}
+		}
+
+		return d, nil
+	case lowCardType:
+		d := &lowCardDec{t: t}
+
+		d.elem, err = newDecoder(t.elem, rt)
+		if err != nil {
+			return nil, err
+		}
+
+		return d, nil
+	}
+
+	name, _, _ := splitType(t.String())
+
+	raw := !leafCompatible(name, rt)
+
+	if raw && !rawCompatible(t, rt) {
+		return nil, errors.New("can't decode %v into %v", t, rt)
+	}
+
+	return &leafDec{t: t, name: name, raw: raw}, nil
+}
+
+func newEncoder(t ColType, rt reflect.Type) (_ encoder, err error) {
+	switch t := t.(type) {
+	case nullableType:
+		e := &nullableEnc{ptr: rt.Kind() == reflect.Ptr}
+
+		et := rt
+		if e.ptr {
+			et = rt.Elem()
+		}
+
+		e.elem, err = newEncoder(t.elem, et)
+		if err != nil {
+			return nil, err
+		}
+
+		return e, nil
+	case mapType:
+		if rt.Kind() != reflect.Map {
+			return nil, errors.New("expected map for %v, got %v", t, rt)
+		}
+
+		tt := t.elem.(tupleType)
+		e := &mapEnc{}
+
+		e.key, err = newEncoder(tt.elems[0], rt.Key())
+		if err != nil {
+			return nil, errors.Wrap(err, "key")
+		}
+
+		e.val, err = newEncoder(tt.elems[1], rt.Elem())
+		if err != nil {
+			return nil, errors.Wrap(err, "value")
+		}
+
+		return e, nil
+	case arrayType:
+		if rt.Kind() != reflect.Slice && rt.Kind() != reflect.Array {
+			return nil, errors.New("expected slice for %v, got %v", t, rt)
+		}
+
+		e := &arrayEnc{}
+
+		e.elem, err = newEncoder(t.elem, rt.Elem())
+		if err != nil {
+			return nil, err
+		}
+
+		return e, nil
+	case tupleType:
+		e := &tupleEnc{}
+
+		e.fields, e.types, err = tupleFields(t, rt)
+		if err != nil {
+			return nil, err
+		}
+
+		e.elems = make([]encoder, len(t.elems))
+
+		for i, el := range t.elems {
+			e.elems[i], err = newEncoder(el, e.types[i])
+			if err != nil {
+				return nil, errors.Wrap(err, "elem %d", i)
+			}
+		}
+
+		return e, nil
+	case lowCardType:
+		e := &lowCardEnc{
+			ptr: t.nullable && rt.Kind() == reflect.Ptr,
+			d:   lowCardData{nullable: t.nullable},
+		}
+
+		et := rt
+		if e.ptr {
+			et = rt.Elem()
+		}
+
+		elem, err := newEncoder(t.dict, et)
+		if err != nil {
+			return nil, err
+		}
+
+		e.elem = elem.(*leafEnc)
+
+		if t.nullable { // NULL key placeholder, not indexed so default value gets its own key
+			e.elem.encodeDefault()
+			e.d.keys = append(e.d.keys, e.elem.take())
+		}
+
+		return e, nil
+	}
+
+	name, _, _ := splitType(t.String())
+
+	raw := !leafCompatible(name, rt)
+
+	if raw && !rawCompatible(t, rt) {
+		return nil, errors.New("can't encode %v into %v", rt, t)
+	}
+
+	return &leafEnc{col: Column{Type: t.String()}, raw: raw}, nil
+}
+
+// tupleFields returns struct fields and their types for the tuple elements.
+// []interface{} is also supported, fields are nil and types are elements natural types then.
+func tupleFields(t tupleType, rt reflect.Type) (fields []int, types []reflect.Type, err error) {
+	if rt.Kind() == reflect.Slice && rt.Elem().Kind() == reflect.Interface {
+		types = make([]reflect.Type, len(t.elems))
+
+		for i, e := range t.elems {
+			types[i], err = GoType(e)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "elem %d", i)
+			}
+		}
+
+		return nil, types, nil
+	}
+
+	if rt.Kind() != reflect.Struct {
+		return nil, nil, errors.New("expected struct for %v, got %v", t, rt)
+	}
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+
+		if f.PkgPath != "" || f.Tag.Get("ch") == "-" {
+			continue
+		}
+
+		fields = append(fields, i)
+		types = append(types, f.Type)
+	}
+
+	if len(fields) != len(t.elems) {
+		return nil, nil, errors.New("%v has %d fields, but %v has %d elements", rt, len(fields), t, len(t.elems))
+	}
+
+	return fields, types, nil
+}
+
+func leafCompatible(name string, rt reflect.Type) bool {
+	k := rt.Kind()
+
+	switch name {
+	case "Int8", "Int16", "Int32", "Int64":
+		return k >= reflect.Int && k <= reflect.Int64
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		return k >= reflect.Uint && k <= reflect.Uint64
+	case "Float32", "Float64":
+		return k == reflect.Float32 || k == reflect.Float64
+	case "Bool":
+		return k == reflect.Bool
+	case "String", "FixedString":
+		return k == reflect.String || k == reflect.Slice && rt.Elem().Kind() == reflect.Uint8
+	case "Enum8", "Enum16":
+		return k == reflect.String
+	case "Date", "Date32", "DateTime", "DateTime64":
+		return rt.ConvertibleTo(timeType)
+	case "UUID":
+		return rt.ConvertibleTo(uuidType)
+	case "IPv4", "IPv6":
+		return rt.ConvertibleTo(ipType)
+	}
+
+	return false
+}
+
+// rawCompatible reports if fixed size type is decoded as little endian bytes.
+// It's used for types without natural Go type like Int128 or Decimal.
+func rawCompatible(t ColType, rt reflect.Type) bool {
+	return t.Size() != 0 && rt.Kind() == reflect.Slice && rt.Elem().Kind() == reflect.Uint8
+}
+
+func (d *leafDec) init(raw []byte, rows int) (err error) {
+	l, err := dataLen(d.t, raw, rows)
+	if err != nil {
+		return err
+	}
+
+	c := Column{Type: d.t.String(), RawData: raw[:l]}
+
+	if d.raw {
+		size := d.t.Size()
+		r := make([][]byte, l/size)
+
+		for i := range r {
+			r[i] = c.RawData[i*size : (i+1)*size]
+		}
+
+		d.vals = reflect.ValueOf(r)
+
+		return nil
+	}
+
+	var vals interface{}
+
+	switch d.name {
+	case "Int8":
+		vals, err = c.Int8s()
+	case "Int16":
+		vals, err = c.Int16s()
+	case "Int32":
+		vals, err = c.Int32s()
+	case "Int64":
+		vals, err = c.Int64s()
+	case "UInt8":
+		vals, err = c.UInt8s()
+	case "UInt16":
+		vals, err = c.UInt16s()
+	case "UInt32":
+		vals, err = c.UInt32s()
+	case "UInt64":
+		vals, err = c.UInt64s()
+	case "Float32":
+		vals, err = c.Float32s()
+	case "Float64":
+		vals, err = c.Float64s()
+	case "Bool":
+		vals, err = c.Bools()
+	case "String", "FixedString":
+		vals, err = c.Strings()
+	case "Enum8", "Enum16":
+		vals, err = c.Enums()
+	case "Date", "Date32", "DateTime", "DateTime64":
+		vals, err = c.Times()
+	case "UUID":
+		vals, err = c.UUIDs()
+	case "IPv4", "IPv6":
+		vals, err = c.IPs()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	d.vals = reflect.ValueOf(vals)
+
+	if d.vals.Len() != rows {
+		return errors.New("expected %d values, got %d", rows, d.vals.Len())
+	}
+
+	return nil
+}
+
+func (d *leafDec) decode(row int, v reflect.Value) error {
+	x := d.vals.Index(row)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(x.Int()) {
+			return errors.New("value overflows %v: %v", v.Type(), x)
+		}
+
+		v.SetInt(x.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.OverflowUint(x.Uint()) {
+			return errors.New("value overflows %v: %v", v.Type(), x)
+		}
+
+		v.SetUint(x.Uint())
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(x.Float())
+	case reflect.Bool:
+		v.SetBool(x.Bool())
+	case reflect.String:
+		v.SetString(x.String())
+	case reflect.Slice:
+		if x.Kind() == reflect.String {
+			v.SetBytes([]byte(x.String()))
+			break
+		}
+
+		v.Set(x.Convert(v.Type()))
+	default:
+		v.Set(x.Convert(v.Type()))
+	}
+
+	return nil
+}
+
+func (d *nullableDec) init(raw []byte, rows int) error {
+	if len(raw) < rows {
+		return errors.New("unexpected end of data")
+	}
+
+	d.nulls = raw[:rows]
+
+	return d.elem.init(raw[rows:], rows)
+}
+
+func (d *nullableDec) decode(row int, v reflect.Value) error {
+	if d.nulls[row] != 0 {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if !d.ptr {
+		return d.elem.decode(row, v)
+	}
+
+	p := reflect.New(v.Type().Elem())
+
+	err := d.elem.decode(row, p.Elem())
+	if err != nil {
+		return err
+	}
+
+	v.Set(p)
+
+	return nil
+}
+
+func (d *arrayDec) init(raw []byte, rows int) (err error) {
+	if len(raw) < 8*rows {
+		return io.ErrUnexpectedEOF
+	}
+
+	d.offsets, raw = splitOffsets(raw, rows)
+
+	return d.elem.init(raw, lastOf(d.offsets))
+}
+
+func (d *arrayDec) decode(row int, v reflect.Value) (err error) {
+	st, end := offsetRange(d.offsets, row)
+
+	s := reflect.MakeSlice(v.Type(), end-st, end-st)
+
+	for j := st; j < end; j++ {
+		err = d.elem.decode(j, s.Index(j-st))
+		if err != nil {
+			return errors.Wrap(err, "index %d", j-st)
+		}
+	}
+
+	v.Set(s)
+
+	return nil
+}
+
+func (d *mapDec) init(raw []byte, rows int) (err error) {
+	if len(raw) < 8*rows {
+		return io.ErrUnexpectedEOF
+	}
+
+	d.offsets, raw = splitOffsets(raw, rows)
+
+	n := lastOf(d.offsets)
+
+	err = d.key.init(raw, n)
+	if err != nil {
+		return errors.Wrap(err, "keys")
+	}
+
+	l, err := dataLen(d.kt, raw, n)
+	if err != nil {
+		return errors.Wrap(err, "keys")
+	}
+
+	return d.val.init(raw[l:], n)
+}
+
+func (d *mapDec) decode(row int, v reflect.Value) (err error) {
+	st, end := offsetRange(d.offsets, row)
+
+	m := reflect.MakeMapWithSize(v.Type(), end-st)
+
+	for j := st; j < end; j++ {
+		k := reflect.New(v.Type().Key()).Elem()
+		x := reflect.New(v.Type().Elem()).Elem()
+
+		err = d.key.decode(j, k)
+		if err != nil {
+			return errors.Wrap(err, "key")
+		}
+
+		err = d.val.decode(j, x)
+		if err != nil {
+			return errors.Wrap(err, "value")
+		}
+
+		m.SetMapIndex(k, x)
+	}
+
+	v.Set(m)
+
+	return nil
+}
+
+func (d *tupleDec) init(raw []byte, rows int) (err error) {
+	for i, e := range d.t.elems {
+		l, err := dataLen(e, raw, rows)
+		if err != nil {
+			return errors.Wrap(err, "elem %d", i)
+		}
+
+		err = d.elems[i].init(raw[:l], rows)
+		if err != nil {
+			return errors.Wrap(err, "elem %d", i)
+		}
+
+		raw = raw[l:]
+	}
+
+	return nil
+}
+
+func (d *tupleDec) decode(row int, v reflect.Value) (err error) {
+	if d.fields == nil {
+		s := reflect.MakeSlice(v.Type(), len(d.elems), len(d.elems))
+
+		for i, e := range d.elems {
+			x := reflect.New(d.types[i]).Elem()
+
+			err = e.decode(row, x)
+			if err != nil {
+				return errors.Wrap(err, "elem %d", i)
+			}
+
+			s.Index(i).Set(x)
+		}
+
+		v.Set(s)
+
+		return nil
+	}
+
+	for i, e := range d.elems {
+		err = e.decode(row, v.Field(d.fields[i]))
+		if err != nil {
+			return errors.Wrap(err, "elem %d", i)
+		}
+	}
+
+	return nil
+}
+
+func (d *lowCardDec) init(raw []byte, rows int) (err error) {
+	if rows == 0 {
+		return d.elem.init(nil, 0)
+	}
+
+	full, err := d.t.full(raw, rows)
+	if err != nil {
+		return err
+	}
+
+	return d.elem.init(full, rows)
+}
+
+func (d *lowCardDec) decode(row int, v reflect.Value) error {
+	return d.elem.decode(row, v)
+}
+
+func (e *leafEnc) encode(v reflect.Value) (err error) {
+	c := &e.col
+	name, _, _ := splitType(c.Type)
+
+	if e.raw {
+		t, _ := c.ColType() // checked in newEncoder
+
+		if v.Len() != t.Size() {
+			return errors.New("expected %d bytes, got %d", t.Size(), v.Len())
+		}
+
+		c.RawData = append(c.RawData, v.Bytes()...)
+
+		return nil
+	}
+
+	switch name {
+	case "Int8", "Int16", "Int32", "Int64":
+		return e.appendInt(v.Int())
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		return e.appendUint(v.Uint())
+	case "Float32":
+		return c.AppendFloat32s(float32(v.Float()))
+	case "Float64":
+		return c.AppendFloat64s(v.Float())
+	case "Bool":
+		return c.AppendBools(v.Bool())
+	case "String", "FixedString":
+		if v.Kind() == reflect.String {
+			return c.AppendStrings(v.String())
+		}
+
+		return c.AppendStrings(string(v.Bytes()))
+	case "Enum8", "Enum16":
+		return c.AppendEnums(v.String())
+	case "Date", "Date32", "DateTime", "DateTime64":
+		return c.AppendTimes(v.Convert(timeType).Interface().(time.Time))
+	case "UUID":
+		return c.AppendUUIDs(v.Convert(uuidType).Interface().([16]byte))
+	case "IPv4", "IPv6":
+		return c.AppendIPs(v.Convert(ipType).Interface().(net.IP))
+	}
+
+	return errors.New("unsupported type: %v", c.Type)
+}
+
+func (e *leafEnc) appendInt(x int64) error {
+	t, _ := e.col.ColType() // checked in newEncoder
+	size := t.Size()
+
+	if bits := 8 * uint(size); x < -1<<(bits-1) || x > 1<<(bits-1)-1 {
+		return errors.New("value overflows %v: %v", e.col.Type, x)
+	}
+
+	for i := 0; i < size; i++ {
+		e.col.RawData = append(e.col.RawData, byte(x>>(8*i)))
+	}
+
+	return nil
+}
+
+func (e *leafEnc) appendUint(x uint64) error {
+	t, _ := e.col.ColType() // checked in newEncoder
+	size := t.Size()
+
+	if size < 8 && x >= 1<<(8*uint(size)) {
+		return errors.New("value overflows %v: %v", e.col.Type, x)
+	}
+
+	for i := 0; i < size; i++ {
+		e.col.RawData = append(e.col.RawData, byte(x>>(8*i)))
+	}
+
+	return nil
+}
+
+func (e *leafEnc) encodeDefault() {
+	t, _ := e.col.ColType() // checked in newEncoder
+
+	if size := t.Size(); size != 0 {
+		e.col.RawData = append(e.col.RawData, make([]byte, size)...)
+	} else {
+		e.col.RawData = append(e.col.RawData, 0)
+	}
+}
+
+// take returns encoded data and resets the encoder.
+func (e *leafEnc) take() []byte {
+	r := append([]byte{}, e.col.RawData...)
+	e.col.RawData = e.col.RawData[:0]
+
+	return r
+}
+
+func (e *leafEnc) appendPrefix(b []byte) []byte { return b }
+
+func (e *leafEnc) appendData(b []byte) []byte { return append(b, e.col.RawData...) }
+
+func (e *nullableEnc) encode(v reflect.Value) error {
+	if e.ptr && v.IsNil() {
+		e.nulls = append(e.nulls, 1)
+		e.elem.encodeDefault()
+
+		return nil
+	}
+
+	if e.ptr {
+		v = v.Elem()
+	}
+
+	e.nulls = append(e.nulls, 0)
+
+	return e.elem.encode(v)
+}
+
+func (e *nullableEnc) encodeDefault() {
+	e.nulls = append(e.nulls, 1)
+	e.elem.encodeDefault()
+}
+
+func (e *nullableEnc) appendPrefix(b []byte) []byte { return e.elem.appendPrefix(b) }
+
+func (e *nullableEnc) appendData(b []byte) []byte {
+	b = append(b, e.nulls...)
+
+	return e.elem.appendData(b)
+}
+
+func (e *arrayEnc) encode(v reflect.Value) (err error) {
+	n := v.Len()
+
+	for i := 0; i < n; i++ {
+		err = e.elem.encode(v.Index(i))
+		if err != nil {
+			return errors.Wrap(err, "index %d", i)
+		}
+	}
+
+	e.offsets = append(e.offsets, lastOf(e.offsets)+n)
+
+	return nil
+}
+
+func (e *arrayEnc) encodeDefault() {
+	e.offsets = append(e.offsets, lastOf(e.offsets))
+}
+
+func (e *arrayEnc) appendPrefix(b []byte) []byte { return e.elem.appendPrefix(b) }
+
+func (e *arrayEnc) appendData(b []byte) []byte {
+	b = appendOffsets(b, e.offsets)
+
+	return e.elem.appendData(b)
+}
+
+func (e *mapEnc) encode(v reflect.Value) (err error) {
+	it := v.MapRange()
+
+	for it.Next() {
+		err = e.key.encode(it.Key())
+		if err != nil {
+			return errors.Wrap(err, "key")
+		}
+
+		err = e.val.encode(it.Value())
+		if err != nil {
+			return errors.Wrap(err, "value")
+		}
+	}
+
+	e.offsets = append(e.offsets, lastOf(e.offsets)+v.Len())
+
+	return nil
+}
+
+func (e *mapEnc) encodeDefault() {
+	e.offsets = append(e.offsets, lastOf(e.offsets))
+}
+
+func (e *mapEnc) appendPrefix(b []byte) []byte {
+	b = e.key.appendPrefix(b)
+
+	return e.val.appendPrefix(b)
+}
+
+func (e *mapEnc) appendData(b []byte) []byte {
+	b = appendOffsets(b, e.offsets)
+	b = e.key.appendData(b)
+
+	return e.val.appendData(b)
+}
+
+func (e *tupleEnc) encode(v reflect.Value) (err error) {
+	if e.fields == nil && v.Len() != len(e.elems) {
+		return errors.New("expected %d elements, got %d", len(e.elems), v.Len())
+	}
+
+	for i, el := range e.elems {
+		var x reflect.Value
+
+		if e.fields == nil {
+			x, err = convertValue(v.Index(i), e.types[i])
+			if err != nil {
+				return errors.Wrap(err, "elem %d", i)
+			}
+		} else {
+			x = v.Field(e.fields[i])
+		}
+
+		err = el.encode(x)
+		if err != nil {
+			return errors.Wrap(err, "elem %d", i)
+		}
+	}
+
+	return nil
+}
+
+func (e *tupleEnc) encodeDefault() {
+	for _, el := range e.elems {
+		el.encodeDefault()
+	}
+}
+
+func (e *tupleEnc) appendPrefix(b []byte) []byte {
+	for _, el := range e.elems {
+		b = el.appendPrefix(b)
+	}
+
+	return b
+}
+
+func (e *tupleEnc) appendData(b []byte) []byte {
+	for _, el := range e.elems {
+		b = el.appendData(b)
+	}
+
+	return b
+}
+
+func (e *lowCardEnc) encode(v reflect.Value) (err error) {
+	if e.ptr && v.IsNil() {
+		e.d.indexes = append(e.d.indexes, 0)
+		return nil
+	}
+
+	if e.ptr {
+		v = v.Elem()
+	}
+
+	err = e.elem.encode(v)
+	if err != nil {
+		return err
+	}
+
+	e.d.indexes = append(e.d.indexes, e.d.key(e.elem.take(), false))
+
+	return nil
+}
+
+func (e *lowCardEnc) encodeDefault() {
+	if e.d.nullable {
+		e.d.indexes = append(e.d.indexes, 0)
+		return
+	}
+
+	e.elem.encodeDefault()
+
+	e.d.indexes = append(e.d.indexes, e.d.key(e.elem.take(), false))
+}
+
+func (e *lowCardEnc) appendPrefix(b []byte) []byte {
+	return appendUInt64(b, lowCardSharedDicts)
+}
+
+func (e *lowCardEnc) appendData(b []byte) []byte {
+	return e.d.encode(b)
+}
+
+func offsetRange(offsets []int, row int) (st, end int) {
+	if row != 0 {
+		st = offsets[row-1]
+	}
+
+	return st, offsets[row]
+}
@@ -0,0 +1,168 @@
+package clickhouse
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	scanPoint struct {
+		X int32
+		Y string
+	}
+
+	scanRow struct {
+		ID    uint64           `ch:"id"`
+		Name  string           `ch:"name"`
+		Score float64          `ch:"score"`
+		Note  *string          `ch:"note"`
+		Tags  []string         `ch:"tags"`
+		Attrs map[string]int64 `ch:"attrs"`
+		Kind  string           `ch:"kind"`
+		Host  *string          `ch:"host"`
+		Point scanPoint        `ch:"point"`
+		At    time.Time        `ch:"at"`
+		IP    net.IP           `ch:"ip"`
+
+		Skip int `ch:"-"`
+	}
+)
+
+var scanMeta = QueryMeta{
+	{Name: "id", Type: "UInt64"},
+	{Name: "name", Type: "LowCardinality(String)"},
+	{Name: "score", Type: "Float64"},
+	{Name: "note", Type: "Nullable(String)"},
+	{Name: "tags", Type: "Array(String)"},
+	{Name: "attrs", Type: "Map(String, Int64)"},
+	{Name: "kind", Type: "Enum8('a' = 1, 'b' = 2)"},
+	{Name: "host", Type: "LowCardinality(Nullable(String))"},
+	{Name: "point", Type: "Tuple(Int32, String)"},
+	{Name: "at", Type: "DateTime('UTC')"},
+	{Name: "ip", Type: "IPv4"},
+}
+
+func TestScanRoundTrip(t *testing.T) {
+	note := "note"
+	host := ""
+	at := time.Date(2021, 12, 1, 10, 20, 30, 0, time.UTC)
+
+	rows := []scanRow{{
+		ID:    1,
+		Name:  "first",
+		Score: 1.5,
+		Note:  &note,
+		Tags:  []string{"a", "b"},
+		Attrs: map[string]int64{"k": -1},
+		Kind:  "b",
+		Point: scanPoint{X: 3, Y: "y"},
+		At:    at,
+		IP:    net.IPv4(1, 2, 3, 4).To4(),
+	}, {
+		ID:    2,
+		Name:  "first",
+		Tags:  []string{},
+		Attrs: map[string]int64{},
+		Kind:  "a",
+		Host:  &host,
+		At:    at,
+		IP:    net.IPv4(5, 6, 7, 8).To4(),
+		Skip:  5,
+	}}
+
+	b := NewBlock(scanMeta)
+
+	require.NoError(t, b.AppendRows(rows[:1]))
+	require.NoError(t, b.AppendRows(rows[1:]))
+	assert.Equal(t, 2, b.Rows)
+
+	for _, c := range b.Cols {
+		ct, err := c.ColType()
+		require.NoError(t, err)
+
+		l, err := ColumnDataLen(ct, c.RawData, b.Rows)
+		require.NoError(t, err, c.Name)
+		assert.Equal(t, len(c.RawData), l, c.Name)
+	}
+
+	var res []scanRow
+	require.NoError(t, b.Scan(&res))
+
+	rows[1].Skip = 0
+
+	assert.Equal(t, rows, res)
+
+	var ptrs []*scanRow
+	require.NoError(t, b.Scan(&ptrs))
+
+	if assert.Len(t, ptrs, 2) {
+		assert.Equal(t, rows[0], *ptrs[0])
+	}
+}
+
+func TestScanRawAndInterfaceTuple(t *testing.T) {
+	type row struct {
+		Big   []byte        `ch:"big"`
+		Tuple []interface{} `ch:"tuple"`
+	}
+
+	meta := QueryMeta{
+		{Name: "big", Type: "Int128"},
+		{Name: "tuple", Type: "Tuple(String, Nullable(UInt8))"},
+	}
+
+	big := make([]byte, 16)
+	big[0], big[15] = 1, 2
+
+	x := uint8(3)
+
+	b := NewBlock(meta)
+
+	require.NoError(t, b.AppendRows([]row{{Big: big, Tuple: []interface{}{"a", 3}}}))
+	assert.Error(t, b.AppendRows([]row{{Big: big[:8], Tuple: []interface{}{"a", nil}}}))
+
+	var res []row
+	require.NoError(t, b.Scan(&res))
+
+	assert.Equal(t, []row{{Big: big, Tuple: []interface{}{"a", &x}}}, res)
+}
+
+func TestScanErrors(t *testing.T) {
+	type short struct {
+		ID uint64 `ch:"id"`
+	}
+
+	err := scanMeta.CheckStruct(short{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "name, score")
+	}
+
+	type wrong struct {
+		ID string `ch:"id"`
+	}
+
+	err = QueryMeta{{Name: "id", Type: "UInt64"}}.CheckStruct(&wrong{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "col id: field ID")
+	}
+
+	assert.NoError(t, QueryMeta{{Name: "id", Type: "UInt64"}}.CheckStruct([]short{}))
+
+	b := NewBlock(QueryMeta{{Name: "id", Type: "UInt8"}})
+
+	type big struct {
+		ID int `ch:"id"`
+	}
+
+	type small struct {
+		ID uint `ch:"id"`
+	}
+
+	assert.Error(t, b.AppendRows([]big{{ID: 1}}))
+	assert.Error(t, b.AppendRows([]small{{ID: 300}}))
+	assert.Error(t, b.Scan(short{}))
+}
@@ -0,0 +1,330 @@
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"regexp"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/clickhouse/binary"
+	"github.com/nikandfor/clickhouse/clpool"
+	"github.com/nikandfor/clickhouse/dsn"
+	"github.com/nikandfor/errors"
+)
+
+type (
+	Driver struct{}
+
+	Connector struct {
+		pool click.ClientPool
+
+		Compressed bool
+
+		d *Driver
+	}
+
+	conn struct {
+		pool click.ClientPool
+		cl   click.Client
+		c    *binary.Conn
+
+		tx  *tx
+		bad bool
+	}
+
+	tx struct {
+		ctx context.Context
+		c   *conn
+
+		batches []*batch
+	}
+
+	// batch is prepared INSERT rows sent on Commit.
+	batch struct {
+		query string
+		rows  [][]driver.Value
+	}
+)
+
+var (
+	_ driver.Driver        = &Driver{}
+	_ driver.DriverContext = &Driver{}
+	_ driver.Connector     = &Connector{}
+
+	_ driver.Conn               = &conn{}
+	_ driver.ConnBeginTx        = &conn{}
+	_ driver.ConnPrepareContext = &conn{}
+	_ driver.QueryerContext     = &conn{}
+	_ driver.ExecerContext      = &conn{}
+	_ driver.Pinger             = &conn{}
+	_ driver.Validator          = &conn{}
+	_ driver.NamedValueChecker  = &conn{}
+)
+
+// DriverName is the name the driver is registered under in database/sql.
+// It differs from "clickhouse" so that it can be used along with clickhouse-go.
+const DriverName = "clickhouse-native"
+
+var valuesRE = regexp.MustCompile(`(?is)\s+VALUES\b.*$`)
+
+func init() {
+	sql.Register(DriverName, &Driver{})
+}
+
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	c, err := d.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Connect(context.Background())
+}
+
+// OpenConnector parses dsn and creates a connector with clpool.BinaryPool.
+func (d *Driver) OpenConnector(name string) (driver.Connector, error) {
+	ds, err := dsn.Parse(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse dsn")
+	}
+
+	pool := clpool.NewBinaryPool(ds.Hosts...)
+
+	pool.Strategy, err = clpool.ParseStrategy(ds.Strategy)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse dsn")
+	}
+
+	pool.TLSConfig, err = ds.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "tls config")
+	}
+
+	pool.Timeout = ds.DialTimeout
+	pool.ReadTimeout = ds.ReadTimeout
+	pool.WriteTimeout = ds.WriteTimeout
+
+	pool.Credentials = click.Credentials{
+		Database: ds.Database,
+		User:     ds.User,
+		Password: ds.Password,
+	}
+
+	c := NewConnector(pool)
+
+	c.Compressed = ds.Compress
+	c.d = d
+
+	return c, nil
+}
+
+// NewConnector creates a connector getting connections from the pool.
+// Pool must return *binary.Client.
+func NewConnector(pool click.ClientPool) *Connector {
+	return &Connector{
+		pool: pool,
+		d:    &Driver{},
+	}
+}
+
+func (c *Connector) Connect(ctx context.Context) (_ driver.Conn, err error) {
+	cl, err := c.pool.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bc, ok := cl.(*binary.Client)
+	if !ok {
+		_ = c.pool.Put(ctx, cl, nil)
+
+		return nil, errors.New("unsupported client: %T", cl)
+	}
+
+	cc := &conn{
+		pool: c.pool,
+		cl:   cl,
+		c:    binary.NewConn(bc),
+	}
+
+	cc.c.Compressed = c.Compressed
+
+	return cc, nil
+}
+
+func (c *Connector) Driver() driver.Driver { return c.d }
+
+func (c *Connector) Close() error { return c.pool.Close() }
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	s := &stmt{
+		c:     c,
+		query: query,
+	}
+
+	q := click.Query{Query: query}
+	s.insert = q.IsInsert()
+
+	return s, nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction.
+// ClickHouse doesn't have transactions, it's just prepared INSERTs batching.
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("transaction already started")
+	}
+
+	c.tx = &tx{
+		ctx: ctx,
+		c:   c,
+	}
+
+	return c.tx, nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (_ driver.Rows, err error) {
+	query, err = bind(query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.c.Query(ctx, query)
+	if err != nil {
+		return nil, c.check(err)
+	}
+
+	return newRows(c, r), nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (_ driver.Result, err error) {
+	query, err = bind(query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.c.Exec(ctx, query)
+	if err != nil {
+		return nil, c.check(err)
+	}
+
+	return driver.ResultNoRows, nil
+}
+
+// insert sends rows in one block.
+func (c *conn) insert(ctx context.Context, query string, rows [][]driver.Value) (err error) {
+	r, err := c.c.Query(ctx, insertQuery(query))
+	if err != nil {
+		return c.check(err)
+	}
+
+	bb, err := click.NewBlockBuilder(r.Meta())
+	if err != nil {
+		_ = r.Close()
+		return err
+	}
+
+	for i, row := range rows {
+		err = appendRow(bb, row)
+		if err != nil {
+			_ = r.Close()
+			return errors.Wrap(err, "row %d", i)
+		}
+	}
+
+	err = r.Insert(bb.Block())
+	if err != nil {
+		return c.check(err)
+	}
+
+	return nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	return c.check(c.c.Ping(ctx))
+}
+
+func (c *conn) IsValid() bool { return !c.bad }
+
+// CheckNamedValue passes arrays, maps and other values as is.
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if _, ok := nv.Value.(driver.Valuer); ok {
+		return driver.ErrSkip
+	}
+
+	return nil
+}
+
+func (c *conn) Close() error {
+	var err error
+	if c.bad {
+		err = driver.ErrBadConn
+	}
+
+	return c.pool.Put(context.Background(), c.cl, err)
+}
+
+// check marks connection bad on any error except server exceptions.
+func (c *conn) check(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var exc *click.Exception
+	if !errors.As(err, &exc) {
+		c.bad = true
+	}
+
+	return err
+}
+
+func (t *tx) Commit() (err error) {
+	defer func() {
+		t.c.tx = nil
+	}()
+
+	for _, b := range t.batches {
+		if len(b.rows) == 0 {
+			continue
+		}
+
+		err = t.c.insert(t.ctx, b.query, b.rows)
+		if err != nil {
+			return errors.Wrap(err, "insert")
+		}
+	}
+
+	return nil
+}
+
+func (t *tx) Rollback() error {
+	t.c.tx = nil
+
+	return nil
+}
+
+func (t *tx) batch(query string) *batch {
+	for _, b := range t.batches {
+		if b.query == query {
+			return b
+		}
+	}
+
+	b := &batch{query: query}
+
+	t.batches = append(t.batches, b)
+
+	return b
+}
+
+// insertQuery cuts VALUES part of the query, data is sent in blocks.
+func insertQuery(q string) string {
+	return valuesRE.ReplaceAllString(q, "") + " VALUES"
+}
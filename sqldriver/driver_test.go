@@ -0,0 +1,225 @@
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/clickhouse/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	pipePool struct {
+		t testing.TB
+
+		meta    click.QueryMeta
+		result  *click.Block
+		queries []string
+		blocks  []*click.Block
+	}
+)
+
+func TestDriverName(t *testing.T) {
+	assert.Contains(t, sql.Drivers(), DriverName)
+	assert.NotContains(t, sql.Drivers(), "clickhouse")
+}
+
+func TestDriver(t *testing.T) {
+	meta := click.QueryMeta{
+		{Name: "id", Type: "UInt64"},
+		{Name: "name", Type: "Nullable(String)"},
+	}
+
+	res := click.NewBlock(meta)
+
+	type row struct {
+		ID   uint64  `ch:"id"`
+		Name *string `ch:"name"`
+	}
+
+	name := "a"
+	require.NoError(t, res.AppendRows([]row{{ID: 1, Name: &name}, {ID: 2}}))
+
+	pool := &pipePool{t: t, meta: meta, result: res}
+
+	db := sql.OpenDB(NewConnector(pool))
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, name FROM t WHERE name != ?", "x'y")
+	require.NoError(t, err)
+
+	var ids []uint64
+	var names []sql.NullString
+
+	for rows.Next() {
+		var id uint64
+		var n sql.NullString
+
+		require.NoError(t, rows.Scan(&id, &n))
+
+		ids = append(ids, id)
+		names = append(names, n)
+	}
+
+	require.NoError(t, rows.Err())
+	require.NoError(t, rows.Close())
+
+	assert.Equal(t, []uint64{1, 2}, ids)
+	assert.Equal(t, []sql.NullString{{String: "a", Valid: true}, {}}, names)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	s, err := tx.Prepare("INSERT INTO t (id, name) VALUES (?, ?)")
+	require.NoError(t, err)
+
+	_, err = s.Exec("1", "a")
+	require.NoError(t, err)
+
+	_, err = s.Exec(2, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, tx.Commit())
+
+	assert.Equal(t, []string{
+		"SELECT id, name FROM t WHERE name != 'x\\'y'",
+		"INSERT INTO t (id, name) VALUES",
+	}, pool.queries)
+
+	if assert.Len(t, pool.blocks, 1) {
+		assert.Equal(t, res, pool.blocks[0])
+	}
+}
+
+func TestBind(t *testing.T) {
+	q, err := bind("SELECT ?, '?', [?], ?", []driver.NamedValue{
+		{Value: int64(1)},
+		{Value: []string{"a", "b"}},
+		{Value: nil},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT 1, '?', [['a', 'b']], NULL", q)
+
+	q, err = bind("SELECT ? -- ?\n, ? # ?'\n, /* ? /* ? */ ' */ ?, '/* ?'", []driver.NamedValue{
+		{Value: 1},
+		{Value: 2},
+		{Value: 3},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT 1 -- ?\n, 2 # ?'\n, /* ? /* ? */ ' */ 3, '/* ?'", q)
+
+	_, err = bind("SELECT ?", nil)
+	assert.NoError(t, err)
+
+	_, err = bind("SELECT ?", []driver.NamedValue{{Value: 1}, {Value: 2}})
+	assert.Error(t, err)
+}
+
+func TestConvertArg(t *testing.T) {
+	v, err := convertArg("2020-01-02 03:04:05", reflect.TypeOf(time.Time{}))
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), v)
+
+	v, err = convertArg("1.2.3.4", reflect.TypeOf(net.IP{}))
+	require.NoError(t, err)
+	assert.Equal(t, net.ParseIP("1.2.3.4"), v)
+
+	v, err = convertArg("00112233-4455-6677-8899-aabbccddeeff", reflect.TypeOf(&[16]byte{}))
+	require.NoError(t, err)
+	assert.Equal(t, [16]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, v)
+
+	v, err = convertArg("12", reflect.TypeOf(uint16(0)))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(12), v)
+
+	_, err = convertArg("bad", reflect.TypeOf(time.Time{}))
+	assert.Error(t, err)
+}
+
+func (p *pipePool) Get(ctx context.Context, opts ...click.ClientOption) (click.Client, error) {
+	cc, sc := net.Pipe()
+
+	go p.serve(ctx, sc)
+
+	cl := binary.NewClient(ctx, cc)
+
+	err := cl.Hello(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+func (p *pipePool) serve(ctx context.Context, c net.Conn) {
+	defer c.Close()
+
+	srv := binary.NewServerConn(ctx, c)
+
+	err := srv.Hello(ctx)
+	if err != nil {
+		return
+	}
+
+	for {
+		_, err = srv.NextPacket(ctx)
+		if err != nil {
+			return
+		}
+
+		q, err := srv.RecvQuery(ctx)
+		if !assert.NoError(p.t, err) {
+			return
+		}
+
+		p.queries = append(p.queries, q.Query)
+
+		err = srv.SendQueryMeta(ctx, p.meta, false)
+		if !assert.NoError(p.t, err) {
+			return
+		}
+
+		if q.IsInsert() {
+			for {
+				_, err = srv.NextPacket(ctx)
+				if !assert.NoError(p.t, err) {
+					return
+				}
+
+				b, err := srv.RecvBlock(ctx, false)
+				if !assert.NoError(p.t, err) {
+					return
+				}
+
+				if b.IsEmpty() {
+					break
+				}
+
+				p.blocks = append(p.blocks, b)
+			}
+		} else {
+			err = srv.SendBlock(ctx, p.result, false)
+			if !assert.NoError(p.t, err) {
+				return
+			}
+		}
+
+		err = srv.SendEndOfStream(ctx)
+		if !assert.NoError(p.t, err) {
+			return
+		}
+	}
+}
+
+func (p *pipePool) Put(ctx context.Context, cl click.Client, err error) error {
+	return cl.(*binary.Client).Close()
+}
+
+func (p *pipePool) Close() error { return nil }
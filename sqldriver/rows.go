@@ -0,0 +1,134 @@
+package sqldriver
+
+import (
+	"database/sql/driver"
+	"io"
+	"reflect"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/clickhouse/binary"
+)
+
+type (
+	rows struct {
+		c *conn
+		r *binary.Rows
+
+		vals   [][]interface{} // current block columns
+		row, n int
+	}
+)
+
+var (
+	_ driver.Rows                           = &rows{}
+	_ driver.RowsColumnTypeDatabaseTypeName = &rows{}
+	_ driver.RowsColumnTypeScanType         = &rows{}
+	_ driver.RowsColumnTypeNullable         = &rows{}
+)
+
+var anyType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+func newRows(c *conn, r *binary.Rows) *rows {
+	return &rows{
+		c: c,
+		r: r,
+	}
+}
+
+func (r *rows) Columns() []string {
+	meta := r.r.Meta()
+	cols := make([]string, len(meta))
+
+	for i, c := range meta {
+		cols[i] = c.Name
+	}
+
+	return cols
+}
+
+func (r *rows) Close() error {
+	return r.c.check(r.r.Close())
+}
+
+func (r *rows) Next(dest []driver.Value) (err error) {
+	for r.row >= r.n {
+		if !r.r.Next() {
+			if err = r.r.Err(); err != nil {
+				return r.c.check(err)
+			}
+
+			return io.EOF
+		}
+
+		b := r.r.Block()
+
+		r.vals = make([][]interface{}, len(b.Cols))
+
+		for i, c := range b.Cols {
+			r.vals[i], err = c.Values(b.Rows)
+			if err != nil {
+				return err
+			}
+		}
+
+		r.row, r.n = 0, b.Rows
+	}
+
+	for i := range dest {
+		dest[i] = driverValue(r.vals[i][r.row])
+	}
+
+	r.row++
+
+	return nil
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.r.Meta()[i].Type
+}
+
+func (r *rows) ColumnTypeScanType(i int) reflect.Type {
+	rt, err := r.goType(i)
+	if err != nil {
+		return anyType
+	}
+
+	if rt.Kind() == reflect.Ptr {
+		return rt.Elem()
+	}
+
+	return rt
+}
+
+func (r *rows) ColumnTypeNullable(i int) (nullable, ok bool) {
+	rt, err := r.goType(i)
+	if err != nil {
+		return false, false
+	}
+
+	return rt.Kind() == reflect.Ptr, true
+}
+
+func (r *rows) goType(i int) (reflect.Type, error) {
+	t, err := click.ParseColType(r.r.Meta()[i].Type)
+	if err != nil {
+		return nil, err
+	}
+
+	return click.GoType(t)
+}
+
+// driverValue dereferences Nullable values.
+func driverValue(v interface{}) driver.Value {
+	rv := reflect.ValueOf(v)
+
+	if rv.Kind() != reflect.Ptr {
+		return v
+	}
+
+	if rv.IsNil() {
+		return nil
+	}
+
+	return rv.Elem().Interface()
+}
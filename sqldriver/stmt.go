@@ -0,0 +1,361 @@
+package sqldriver
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	click "github.com/nikandfor/clickhouse"
+	"github.com/nikandfor/errors"
+)
+
+type (
+	stmt struct {
+		c *conn
+
+		query  string
+		insert bool
+	}
+)
+
+var (
+	_ driver.Stmt             = &stmt{}
+	_ driver.StmtExecContext  = &stmt{}
+	_ driver.StmtQueryContext = &stmt{}
+)
+
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+	time.RFC3339Nano,
+}
+
+func (s *stmt) Close() error { return nil }
+
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), named(args))
+}
+
+// ExecContext executes the statement.
+// INSERT rows are sent in blocks. They are batched until Commit inside a transaction.
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if !s.insert || len(args) == 0 {
+		return s.c.ExecContext(ctx, s.query, args)
+	}
+
+	row := make([]driver.Value, len(args))
+
+	for i, a := range args {
+		row[i] = a.Value
+	}
+
+	if s.c.tx != nil {
+		b := s.c.tx.batch(s.query)
+		b.rows = append(b.rows, row)
+
+		return driver.RowsAffected(1), nil
+	}
+
+	err := s.c.insert(ctx, s.query, [][]driver.Value{row})
+	if err != nil {
+		return nil, err
+	}
+
+	return driver.RowsAffected(1), nil
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.c.QueryContext(ctx, s.query, args)
+}
+
+func appendRow(bb *click.BlockBuilder, row []driver.Value) (err error) {
+	types := bb.Types()
+
+	if len(row) != len(types) {
+		return errors.New("expected %d values, got %d", len(types), len(row))
+	}
+
+	vals := make([]interface{}, len(row))
+
+	for i, v := range row {
+		vals[i], err = convertArg(v, types[i])
+		if err != nil {
+			return errors.Wrap(err, "value %d", i)
+		}
+	}
+
+	return bb.Append(vals...)
+}
+
+// convertArg parses string arguments for non-string columns.
+// Other values are converted by click.BlockBuilder.
+func convertArg(v driver.Value, rt reflect.Type) (_ interface{}, err error) {
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+
+	s, ok := v.(string)
+	if b, isb := v.([]byte); isb && rt.Kind() != reflect.Slice {
+		s, ok = string(b), true
+	}
+
+	if !ok || rt.Kind() == reflect.String {
+		return v, nil
+	}
+
+	switch reflect.Zero(rt).Interface().(type) {
+	case time.Time:
+		for _, l := range timeLayouts {
+			t, err := time.Parse(l, s)
+			if err == nil {
+				return t, nil
+			}
+		}
+
+		return nil, errors.New("bad time: %q", s)
+	case net.IP:
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("bad ip: %q", s)
+		}
+
+		return ip, nil
+	case [16]byte:
+		var id [16]byte
+
+		h := strings.ReplaceAll(s, "-", "")
+
+		if len(h) != 32 {
+			return nil, errors.New("bad uuid: %q", s)
+		}
+
+		_, err = hex.Decode(id[:], []byte(h))
+		if err != nil {
+			return nil, errors.New("bad uuid: %q", s)
+		}
+
+		return id, nil
+	}
+
+	switch rt.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(s, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(s, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(s, 64)
+	case reflect.Bool:
+		return strconv.ParseBool(s)
+	}
+
+	return v, nil
+}
+
+// bind replaces ? placeholders outside of quotes and comments with args literals.
+func bind(query string, args []driver.NamedValue) (_ string, err error) {
+	if len(args) == 0 {
+		return query, nil
+	}
+
+	b := make([]byte, 0, len(query))
+	n := 0
+
+	var quote byte
+
+	for i := 0; i < len(query); i++ {
+		if quote == 0 {
+			if end := commentEnd(query, i); end != i {
+				b = append(b, query[i:end]...)
+				i = end - 1
+
+				continue
+			}
+		}
+
+		c := query[i]
+
+		switch {
+		case quote != 0 && c == '\\' && i+1 < len(query):
+			b = append(b, c)
+			i++
+			c = query[i]
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"' || c == '`'):
+			quote = c
+		case quote == 0 && c == '?':
+			if n == len(args) {
+				return "", errors.New("not enough args: %d", len(args))
+			}
+
+			b, err = appendLiteral(b, args[n].Value)
+			if err != nil {
+				return "", errors.Wrap(err, "arg %d", n)
+			}
+
+			n++
+
+			continue
+		}
+
+		b = append(b, c)
+	}
+
+	if n != len(args) {
+		return "", errors.New("too many args: %d, expected %d", len(args), n)
+	}
+
+	return string(b), nil
+}
+
+// commentEnd returns the end of comment starting at i or i if there is no comment.
+// Comments are -- and # till the end of line, and nested /* */.
+func commentEnd(q string, i int) int {
+	switch {
+	case strings.HasPrefix(q[i:], "--") || q[i] == '#':
+		p := strings.IndexByte(q[i:], '\n')
+		if p < 0 {
+			return len(q)
+		}
+
+		return i + p + 1
+	case strings.HasPrefix(q[i:], "/*"):
+		i += 2
+
+		for depth := 1; depth > 0 && i < len(q); {
+			switch {
+			case strings.HasPrefix(q[i:], "/*"):
+				depth++
+				i += 2
+			case strings.HasPrefix(q[i:], "*/"):
+				depth--
+				i += 2
+			default:
+				i++
+			}
+		}
+
+		return i
+	}
+
+	return i
+}
+
+func appendLiteral(b []byte, v interface{}) (_ []byte, err error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, "NULL"...), nil
+	case string:
+		return appendQuoted(b, v), nil
+	case []byte:
+		return appendQuoted(b, string(v)), nil
+	case bool:
+		if v {
+			return append(b, '1'), nil
+		}
+
+		return append(b, '0'), nil
+	case time.Time:
+		b = append(b, "toDateTime64("...)
+		b = appendQuoted(b, v.UTC().Format("2006-01-02 15:04:05.999999999"))
+
+		return append(b, ", 9, 'UTC')"...), nil
+	case net.IP:
+		return appendQuoted(b, v.String()), nil
+	}
+
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.AppendInt(b, rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.AppendUint(b, rv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.AppendFloat(b, rv.Float(), 'g', -1, 64), nil
+	case reflect.String:
+		return appendQuoted(b, rv.String()), nil
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return append(b, "NULL"...), nil
+		}
+
+		return appendLiteral(b, rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		b = append(b, '[')
+
+		for i := 0; i < rv.Len(); i++ {
+			if i != 0 {
+				b = append(b, ", "...)
+			}
+
+			b, err = appendLiteral(b, rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return append(b, ']'), nil
+	case reflect.Map:
+		b = append(b, "map("...)
+
+		it := rv.MapRange()
+
+		for i := 0; it.Next(); i++ {
+			if i != 0 {
+				b = append(b, ", "...)
+			}
+
+			b, err = appendLiteral(b, it.Key().Interface())
+			if err != nil {
+				return nil, err
+			}
+
+			b = append(b, ", "...)
+
+			b, err = appendLiteral(b, it.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return append(b, ')'), nil
+	}
+
+	return nil, errors.New("unsupported type: %T", v)
+}
+
+func appendQuoted(b []byte, s string) []byte {
+	b = append(b, '\'')
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\'' || s[i] == '\\' {
+			b = append(b, '\\')
+		}
+
+		b = append(b, s[i])
+	}
+
+	return append(b, '\'')
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	r := make([]driver.NamedValue, len(args))
+
+	for i, a := range args {
+		r[i] = driver.NamedValue{Ordinal: i + 1, Value: a}
+	}
+
+	return r
+}
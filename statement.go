@@ -0,0 +1,497 @@
+package clickhouse
+
+import (
+	"strings"
+
+	"github.com/nikandfor/errors"
+)
+
+type (
+	// Statement is what the query does, as far as it can be told
+	// without the full SQL parser. Invalid queries are not detected.
+	Statement struct {
+		Kind StatementKind
+
+		// Keyword is the main statement keyword in upper case.
+		// SELECT for WITH ... SELECT.
+		Keyword string
+
+		// Target for INSERT and DDL, the first table in FROM for SELECT.
+		// Database is empty if not specified in the query.
+		Database string
+		Table    string
+
+		// Function is the table function name for INSERT INTO FUNCTION and SELECT ... FROM.
+		Function string
+
+		// INSERT only.
+		Columns []string
+		Format  string // Values for VALUES
+		Select  bool   // INSERT ... SELECT, no data is sent by the client
+	}
+
+	StatementKind uint8
+
+	sqlLexer struct {
+		s string
+		i int
+	}
+
+	sqlToken struct {
+		// w - word, q - quoted identifier, s - string, n - number,
+		// 0 - end of query, punctuation char otherwise.
+		kind byte
+		val  string
+	}
+)
+
+// Statement kinds.
+const (
+	StatementUnknown StatementKind = iota
+	StatementSelect                // SELECT, SHOW, DESCRIBE, EXISTS, EXPLAIN, CHECK
+	StatementInsert
+	StatementDDL    // CREATE, ALTER, DROP, TRUNCATE, RENAME, ATTACH, DETACH, EXCHANGE, OPTIMIZE
+	StatementSystem // SYSTEM, KILL
+	StatementOther  // SET, USE, GRANT and the others
+)
+
+var statementKinds = map[string]StatementKind{
+	"SELECT":   StatementSelect,
+	"SHOW":     StatementSelect,
+	"DESCRIBE": StatementSelect,
+	"DESC":     StatementSelect,
+	"EXISTS":   StatementSelect,
+	"EXPLAIN":  StatementSelect,
+	"CHECK":    StatementSelect,
+	"INSERT":   StatementInsert,
+	"CREATE":   StatementDDL,
+	"ALTER":    StatementDDL,
+	"DROP":     StatementDDL,
+	"TRUNCATE": StatementDDL,
+	"RENAME":   StatementDDL,
+	"ATTACH":   StatementDDL,
+	"DETACH":   StatementDDL,
+	"EXCHANGE": StatementDDL,
+	"OPTIMIZE": StatementDDL,
+	"UNDROP":   StatementDDL,
+	"SYSTEM":   StatementSystem,
+	"KILL":     StatementSystem,
+}
+
+// ParseStatement classifies the query.
+func ParseStatement(q string) (s Statement) {
+	l := &sqlLexer{s: q}
+
+	t := l.next()
+	for t.kind == '(' {
+		t = l.next()
+	}
+
+	if t.kind != 'w' {
+		return
+	}
+
+	kw := strings.ToUpper(t.val)
+
+	if kw == "WITH" {
+		kw = l.skipWith()
+	}
+
+	s.Keyword = kw
+
+	s.Kind = statementKinds[kw]
+	if s.Kind == StatementUnknown {
+		s.Kind = StatementOther
+	}
+
+	switch kw {
+	case "":
+		s.Kind = StatementSelect // WITH without SELECT is still a SELECT
+	case "SELECT":
+		s.parseFrom(l)
+	case "INSERT":
+		s.parseInsert(l)
+	case "DESCRIBE", "DESC", "EXISTS", "TRUNCATE":
+		s.parseTarget(l, true)
+	case "CHECK", "CREATE", "ALTER", "DROP", "RENAME", "ATTACH", "DETACH", "EXCHANGE", "OPTIMIZE", "UNDROP":
+		s.parseTarget(l, false)
+	}
+
+	return
+}
+
+// ParseStatementKind parses kind name as returned by String.
+func ParseStatementKind(s string) (StatementKind, error) {
+	for k := StatementSelect; k <= StatementOther; k++ {
+		if k.String() == s {
+			return k, nil
+		}
+	}
+
+	return 0, errors.New("unknown statement kind: %v", s)
+}
+
+func (k StatementKind) String() string {
+	switch k {
+	case StatementSelect:
+		return "select"
+	case StatementInsert:
+		return "insert"
+	case StatementDDL:
+		return "ddl"
+	case StatementSystem:
+		return "system"
+	case StatementOther:
+		return "other"
+	default:
+		return "unknown"
+	}
+}
+
+// skipWith skips WITH clause and returns the following SELECT or INSERT keyword.
+func (l *sqlLexer) skipWith() string {
+	depth := 0
+
+	for {
+		t := l.next()
+
+		switch t.kind {
+		case 0:
+			return ""
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case 'w':
+			if depth != 0 {
+				continue
+			}
+
+			if kw := strings.ToUpper(t.val); kw == "SELECT" || kw == "INSERT" {
+				return kw
+			}
+		}
+	}
+}
+
+func (s *Statement) parseFrom(l *sqlLexer) {
+	depth := 0
+
+	for {
+		t := l.next()
+
+		switch t.kind {
+		case 0:
+			return
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case 'w':
+			if depth != 0 || !strings.EqualFold(t.val, "FROM") {
+				continue
+			}
+
+			s.parseName(l, l.next())
+
+			if s.Table != "" && l.peek().kind == '(' {
+				s.Function, s.Table = s.Table, ""
+			}
+
+			return
+		}
+	}
+}
+
+func (s *Statement) parseInsert(l *sqlLexer) {
+	t := l.next()
+	if t.kind == 'w' && strings.EqualFold(t.val, "INTO") {
+		t = l.next()
+	}
+
+	if t.kind == 'w' && strings.EqualFold(t.val, "TABLE") {
+		t = l.next()
+	}
+
+	if t.kind == 'w' && strings.EqualFold(t.val, "FUNCTION") {
+		t = l.next()
+
+		if !t.ident() {
+			return
+		}
+
+		s.Function = t.val
+
+		l.skipParens()
+	} else if !s.parseName(l, t) {
+		return
+	}
+
+	if l.peek().kind == '(' {
+		l.next()
+
+		s.parseColumns(l)
+	}
+
+	for {
+		t := l.next()
+
+		switch t.kind {
+		case 0:
+			return
+		case 'w':
+		default:
+			continue
+		}
+
+		switch strings.ToUpper(t.val) {
+		case "FORMAT":
+			if t := l.next(); t.ident() {
+				s.Format = t.val
+			}
+
+			return // data follows
+		case "VALUES":
+			s.Format = "Values"
+
+			return
+		case "SELECT", "WITH":
+			s.Select = true
+
+			return
+		}
+	}
+}
+
+func (s *Statement) parseColumns(l *sqlLexer) {
+	var b strings.Builder
+	var prev sqlToken
+	depth := 1
+
+	for {
+		t := l.next()
+
+		switch t.kind {
+		case 0:
+			return
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+
+		if depth == 0 || depth == 1 && t.kind == ',' {
+			if b.Len() != 0 {
+				s.Columns = append(s.Columns, b.String())
+			}
+
+			b.Reset()
+		} else {
+			if b.Len() != 0 && prev.ident() && t.ident() {
+				b.WriteByte(' ')
+			}
+
+			b.WriteString(t.val)
+		}
+
+		prev = t
+
+		if depth == 0 {
+			return
+		}
+	}
+}
+
+// parseTarget parses [TEMPORARY] TABLE|VIEW|DICTIONARY|DATABASE [IF [NOT] EXISTS] name.
+func (s *Statement) parseTarget(l *sqlLexer, implicit bool) {
+	database := false
+
+	for {
+		t := l.next()
+
+		if t.kind == 'w' {
+			switch strings.ToUpper(t.val) {
+			case "TABLE", "TABLES", "VIEW", "DICTIONARY":
+				implicit = true
+				continue
+			case "DATABASE":
+				implicit, database = true, true
+				continue
+			case "OR", "REPLACE", "TEMPORARY", "MATERIALIZED", "LIVE", "WINDOW", "IF", "NOT", "EXISTS":
+				continue
+			}
+		}
+
+		if !implicit || !s.parseName(l, t) {
+			return
+		}
+
+		if database {
+			s.Database, s.Table = s.Table, ""
+		}
+
+		return
+	}
+}
+
+// parseName parses [db.]name starting from t.
+func (s *Statement) parseName(l *sqlLexer, t sqlToken) bool {
+	if !t.ident() {
+		return false
+	}
+
+	if l.peek().kind != '.' {
+		s.Table = t.val
+		return true
+	}
+
+	save := *l
+	l.next()
+
+	n := l.next()
+	if !n.ident() {
+		*l = save
+		s.Table = t.val
+
+		return true
+	}
+
+	s.Database, s.Table = t.val, n.val
+
+	return true
+}
+
+func (l *sqlLexer) skipParens() {
+	if l.peek().kind != '(' {
+		return
+	}
+
+	depth := 0
+
+	for {
+		switch l.next().kind {
+		case 0:
+			return
+		case '(':
+			depth++
+		case ')':
+			depth--
+
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+func (l *sqlLexer) peek() sqlToken {
+	save := *l
+	t := l.next()
+	*l = save
+
+	return t
+}
+
+func (l *sqlLexer) next() (t sqlToken) {
+	l.skipSpace()
+
+	if l.i >= len(l.s) {
+		return
+	}
+
+	st := l.i
+	c := l.s[l.i]
+
+	switch {
+	case isWordChar(c) && !isDigit(c):
+		for l.i < len(l.s) && isWordChar(l.s[l.i]) {
+			l.i++
+		}
+
+		return sqlToken{kind: 'w', val: l.s[st:l.i]}
+	case isDigit(c):
+		for l.i < len(l.s) && (isWordChar(l.s[l.i]) || l.s[l.i] == '.') {
+			l.i++
+		}
+
+		return sqlToken{kind: 'n', val: l.s[st:l.i]}
+	case c == '\'':
+		return sqlToken{kind: 's', val: l.quoted(c)}
+	case c == '`' || c == '"':
+		return sqlToken{kind: 'q', val: l.quoted(c)}
+	default:
+		l.i++
+
+		return sqlToken{kind: c, val: l.s[st:l.i]}
+	}
+}
+
+// quoted reads quoted string and returns it unquoted.
+// Quote is escaped by backslash or doubled.
+func (l *sqlLexer) quoted(q byte) string {
+	var b strings.Builder
+
+	l.i++
+
+	for l.i < len(l.s) {
+		c := l.s[l.i]
+		l.i++
+
+		switch {
+		case c == '\\' && l.i < len(l.s):
+			c = l.s[l.i]
+			l.i++
+		case c == q && l.i < len(l.s) && l.s[l.i] == q:
+			l.i++
+		case c == q:
+			return b.String()
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// skipSpace skips whitespaces and comments: -- and # till the end of line, and nested /* */.
+func (l *sqlLexer) skipSpace() {
+	for l.i < len(l.s) {
+		switch {
+		case strings.IndexByte(" \t\r\n\f\v", l.s[l.i]) >= 0:
+			l.i++
+		case strings.HasPrefix(l.s[l.i:], "--") || l.s[l.i] == '#':
+			p := strings.IndexByte(l.s[l.i:], '\n')
+			if p < 0 {
+				l.i = len(l.s)
+				return
+			}
+
+			l.i += p + 1
+		case strings.HasPrefix(l.s[l.i:], "/*"):
+			l.i += 2
+
+			for depth := 1; depth > 0 && l.i < len(l.s); {
+				switch {
+				case strings.HasPrefix(l.s[l.i:], "/*"):
+					depth++
+					l.i += 2
+				case strings.HasPrefix(l.s[l.i:], "*/"):
+					depth--
+					l.i += 2
+				default:
+					l.i++
+				}
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (t sqlToken) ident() bool { return t.kind == 'w' || t.kind == 'q' }
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || isDigit(c) || c >= 0x80
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
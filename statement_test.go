@@ -0,0 +1,79 @@
+package clickhouse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStatement(t *testing.T) {
+	for _, tc := range []struct {
+		q string
+		s Statement
+	}{
+		{"", Statement{}},
+		{"SELECT 1", Statement{Kind: StatementSelect, Keyword: "SELECT"}},
+		{"  \n\t-- comment\n# another\n/* multi /* nested */ line */ select * from db.t where a in (select b from c)", Statement{Kind: StatementSelect, Keyword: "SELECT", Database: "db", Table: "t"}},
+		{"(SELECT * FROM `my db`.\"my\"\"t\") UNION ALL SELECT 2", Statement{Kind: StatementSelect, Keyword: "SELECT", Database: "my db", Table: `my"t`}},
+		{"SELECT * FROM (SELECT 1 FROM t)", Statement{Kind: StatementSelect, Keyword: "SELECT"}},
+		{"SELECT number FROM numbers(10)", Statement{Kind: StatementSelect, Keyword: "SELECT", Function: "numbers"}},
+		{"WITH (SELECT max(a) FROM u) AS m SELECT * FROM t WHERE a = m", Statement{Kind: StatementSelect, Keyword: "SELECT", Table: "t"}},
+		{"SHOW TABLES", Statement{Kind: StatementSelect, Keyword: "SHOW"}},
+		{"DESC db.t", Statement{Kind: StatementSelect, Keyword: "DESC", Database: "db", Table: "t"}},
+
+		{"INSERT INTO t VALUES (1, 'a')", Statement{Kind: StatementInsert, Keyword: "INSERT", Table: "t", Format: "Values"}},
+		{"insert into db.t (a, `b c`, n.x) format CSV\n1,2,3", Statement{Kind: StatementInsert, Keyword: "INSERT", Database: "db", Table: "t", Columns: []string{"a", "b c", "n.x"}, Format: "CSV"}},
+		{"INSERT INTO t (* EXCEPT (c)) SETTINGS async_insert = 1 FORMAT Native", Statement{Kind: StatementInsert, Keyword: "INSERT", Table: "t", Columns: []string{"*EXCEPT(c)"}, Format: "Native"}},
+		{"INSERT INTO t (a, b)", Statement{Kind: StatementInsert, Keyword: "INSERT", Table: "t", Columns: []string{"a", "b"}}},
+		{"INSERT INTO TABLE t SELECT * FROM u", Statement{Kind: StatementInsert, Keyword: "INSERT", Table: "t", Select: true}},
+		{"INSERT INTO FUNCTION remote('h', db.t) (a) VALUES", Statement{Kind: StatementInsert, Keyword: "INSERT", Function: "remote", Columns: []string{"a"}, Format: "Values"}},
+		{"WITH 1 AS x INSERT INTO t FORMAT TSV", Statement{Kind: StatementInsert, Keyword: "INSERT", Table: "t", Format: "TSV"}},
+
+		{"CREATE TABLE IF NOT EXISTS db.t (a Int32) ENGINE = Memory", Statement{Kind: StatementDDL, Keyword: "CREATE", Database: "db", Table: "t"}},
+		{"CREATE OR REPLACE TEMPORARY TABLE t AS u", Statement{Kind: StatementDDL, Keyword: "CREATE", Table: "t"}},
+		{"CREATE DATABASE db", Statement{Kind: StatementDDL, Keyword: "CREATE", Database: "db"}},
+		{"CREATE USER bob", Statement{Kind: StatementDDL, Keyword: "CREATE"}},
+		{"ALTER TABLE t DELETE WHERE 1", Statement{Kind: StatementDDL, Keyword: "ALTER", Table: "t"}},
+		{"DROP TABLE IF EXISTS db.t", Statement{Kind: StatementDDL, Keyword: "DROP", Database: "db", Table: "t"}},
+		{"TRUNCATE t", Statement{Kind: StatementDDL, Keyword: "TRUNCATE", Table: "t"}},
+		{"RENAME TABLE a TO b", Statement{Kind: StatementDDL, Keyword: "RENAME", Table: "a"}},
+		{"OPTIMIZE TABLE t FINAL", Statement{Kind: StatementDDL, Keyword: "OPTIMIZE", Table: "t"}},
+
+		{"SYSTEM FLUSH LOGS", Statement{Kind: StatementSystem, Keyword: "SYSTEM"}},
+		{"KILL QUERY WHERE 1", Statement{Kind: StatementSystem, Keyword: "KILL"}},
+		{"SET max_threads = 1", Statement{Kind: StatementOther, Keyword: "SET"}},
+	} {
+		assert.Equal(t, tc.s, ParseStatement(tc.q), "%q", tc.q)
+	}
+}
+
+func TestQueryIsInsert(t *testing.T) {
+	for _, tc := range []struct {
+		q      string
+		insert bool
+		exec   bool
+	}{
+		{q: "SELECT 1"},
+		{q: " INSERT INTO t VALUES", insert: true},
+		{q: "INSERT INTO t SELECT 1"},
+		{q: "/* c */ CREATE TABLE t (a Int32) ENGINE = Memory", exec: true},
+		{q: "SYSTEM FLUSH LOGS", exec: true},
+		{q: "SHOW TABLES"},
+	} {
+		q := &Query{Query: tc.q}
+
+		assert.Equal(t, tc.insert, q.IsInsert(), "%q", tc.q)
+		assert.Equal(t, tc.exec, q.IsExec(), "%q", tc.q)
+	}
+}
+
+func TestParseStatementKind(t *testing.T) {
+	for k := StatementSelect; k <= StatementOther; k++ {
+		p, err := ParseStatementKind(k.String())
+		assert.NoError(t, err)
+		assert.Equal(t, k, p)
+	}
+
+	_, err := ParseStatementKind("unknown")
+	assert.Error(t, err)
+}
@@ -2,7 +2,9 @@ package clickhouse
 
 import (
 	"fmt"
-	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/nikandfor/tlog/wire"
 )
@@ -11,20 +13,93 @@ type (
 	Query struct {
 		Query string
 
-		ID       string
-		QuotaKey string
+		ID string
 
 		Compressed bool
 
-		//	Tables []ExtTable
+		Settings Settings
+
+		Tables []ExtTable
 
-		//	Info []byte
+		Info ClientInfo
+
+		// Deprecated: Use Info.QuotaKey.
+		// Sent if Info.QuotaKey is empty, set on receive.
+		QuotaKey string
 
+		// Deprecated: Use Info.Client.
+		// Sent if Info.Client is empty, set on receive.
 		Client Agent
 	}
 
+	// ClientInfo describes who and how initiated the query.
+	ClientInfo struct {
+		Kind QueryKind
+
+		InitialUser    string
+		InitialQueryID string
+		InitialAddress string
+		InitialTime    time.Time
+
+		Interface Interface
+
+		// TCP interface
+		OSUser       string
+		Hostname     string
+		Client       Agent
+		VersionPatch int
+
+		// HTTP interface
+		HTTPMethod    uint8
+		HTTPUserAgent string
+		ForwardedFor  string
+		Referer       string
+
+		QuotaKey         string
+		DistributedDepth int
+
+		Trace TraceContext
+
+		CollaborateWithInitiator bool
+		ParallelReplicas         int
+		ReplicaNumber            int
+	}
+
+	// TraceContext is OpenTelemetry trace context. Empty TraceID means no trace.
+	TraceContext struct {
+		TraceID    [16]byte
+		SpanID     uint64
+		TraceState string
+		TraceFlags uint8
+	}
+
+	QueryKind uint8
+	Interface uint8
+
 	QueryMeta []Column
 
+	// ExtTable is an external table sent along with the query.
+	ExtTable struct {
+		Name      string
+		Structure QueryMeta
+
+		Blocks []*Block
+	}
+
+	// TableColumns is the table columns description sent before INSERT data.
+	TableColumns struct {
+		Table   string
+		Columns string
+	}
+
+	Setting struct {
+		Name  string
+		Value string
+		Flags uint64
+	}
+
+	Settings []Setting
+
 	Column struct {
 		Name string
 		Type string
@@ -53,6 +128,9 @@ type (
 		Rows      uint64
 		Bytes     uint64
 		TotalRows uint64
+
+		WrittenRows  uint64
+		WrittenBytes uint64
 	}
 
 	ProfileInfo struct {
@@ -79,28 +157,123 @@ type (
 	Ver [3]int
 )
 
-var (
-	insertRE = regexp.MustCompile(`^(?i)INSERT INTO`) // TODO: WITH
-	execRE   = regexp.MustCompile(`^(?i)(?:CREATE|ALTER|DROP)`)
+// Query kinds.
+const (
+	NoQuery QueryKind = iota
+	InitialQuery
+	SecondaryQuery
+)
+
+// Client interfaces.
+const (
+	InterfaceTCP Interface = iota + 1
+	InterfaceHTTP
+)
+
+// Setting flags.
+const (
+	SettingImportant = 1 << iota
+	SettingCustom
 )
 
-func (q *Query) IsInsert() bool { return insertRE.MatchString(q.Query) }
+func (q *Query) Statement() Statement { return ParseStatement(q.Query) }
+
+// IsInsert reports whether the client sends data blocks after the query.
+// INSERT ... SELECT is not the case.
+func (q *Query) IsInsert() bool {
+	s := q.Statement()
 
-func (q *Query) IsExec() bool { return execRE.MatchString(q.Query) }
+	return s.Kind == StatementInsert && !s.Select
+}
+
+// IsExec reports whether the query is a command: DDL, SYSTEM or other non-SELECT statement.
+func (q *Query) IsExec() bool {
+	switch q.Statement().Kind {
+	case StatementDDL, StatementSystem, StatementOther:
+		return true
+	default:
+		return false
+	}
+}
 
 func (q *Query) Copy() *Query {
 	return &Query{
 		Query:      q.Query,
 		ID:         q.ID,
-		QuotaKey:   q.QuotaKey,
 		Compressed: q.Compressed,
-		//	Info:       append([]byte{}, q.Info...),
-		Client: q.Client,
+		Settings:   append(Settings{}, q.Settings...),
+		Tables:     append([]ExtTable{}, q.Tables...),
+		Info:       q.Info,
+		QuotaKey:   q.QuotaKey,
+		Client:     q.Client,
+	}
+}
+
+// Get returns setting value. The last one wins if set multiple times.
+func (s Settings) Get(name string) (v string, ok bool) {
+	for _, x := range s {
+		if x.Name == name {
+			v, ok = x.Value, true
+		}
+	}
+
+	return
+}
+
+// Set replaces setting value or adds a new one.
+func (s *Settings) Set(name, value string) {
+	for i := range *s {
+		if (*s)[i].Name == name {
+			(*s)[i].Value = value
+			return
+		}
 	}
+
+	*s = append(*s, Setting{Name: name, Value: value})
+}
+
+// Key returns canonical representation which is the same for equivalent settings.
+func (s Settings) Key() string {
+	if len(s) == 0 {
+		return ""
+	}
+
+	m := make(map[string]string, len(s))
+
+	for _, x := range s {
+		m[x.Name] = x.Value
+	}
+
+	names := make([]string, 0, len(m))
+
+	for n := range m {
+		names = append(names, n)
+	}
+
+	sort.Strings(names)
+
+	var b strings.Builder
+
+	for _, n := range names {
+		fmt.Fprintf(&b, "%q=%q,", n, m[n])
+	}
+
+	return b.String()
 }
 
 func (b *Block) IsEmpty() bool { return b == nil || b.Rows == 0 && len(b.Cols) == 0 }
 
+// Col returns column by name or nil.
+func (b *Block) Col(name string) *Column {
+	for i := range b.Cols {
+		if b.Cols[i].Name == name {
+			return &b.Cols[i]
+		}
+	}
+
+	return nil
+}
+
 func (b *Block) DataSize() (size int64) {
 	for _, col := range b.Cols {
 		size += int64(1 + len(col.Name))
@@ -0,0 +1,351 @@
+package clickhouse
+
+import (
+	"reflect"
+
+	"github.com/nikandfor/errors"
+)
+
+type (
+	// BlockBuilder appends rows of values to a block.
+	// Values are converted to the column natural type, see GoType.
+	BlockBuilder struct {
+		meta  QueryMeta
+		types []reflect.Type
+		encs  []encoder
+
+		rows int
+	}
+)
+
+var (
+	interfacesType = reflect.TypeOf([]interface{}{})
+	bytesType      = reflect.TypeOf([]byte{})
+)
+
+// GoType returns natural Go type for the column type.
+//
+// Integers and floats are mapped to the same size Go types,
+// String, FixedString and Enums to string, Bool to bool,
+// Date and DateTime types to time.Time, UUID to [16]byte and IPv4/IPv6 to net.IP.
+// Other fixed size types like Int128 or Decimal are raw little endian []byte.
+//
+// Nullable(T) is *T, Array(T) is []T, Map(K, V) is map[K]V,
+// Tuple is []interface{} and LowCardinality(T) is the same as T.
+func GoType(t ColType) (_ reflect.Type, err error) {
+	switch t := t.(type) {
+	case nullableType:
+		et, err := GoType(t.elem)
+		if err != nil {
+			return nil, err
+		}
+
+		return reflect.PtrTo(et), nil
+	case mapType:
+		tt := t.elem.(tupleType)
+
+		kt, err := GoType(tt.elems[0])
+		if err != nil {
+			return nil, err
+		}
+
+		vt, err := GoType(tt.elems[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return reflect.MapOf(kt, vt), nil
+	case arrayType:
+		et, err := GoType(t.elem)
+		if err != nil {
+			return nil, err
+		}
+
+		return reflect.SliceOf(et), nil
+	case tupleType:
+		return interfacesType, nil
+	case lowCardType:
+		return GoType(t.elem)
+	}
+
+	name, _, _ := splitType(t.String())
+
+	switch name {
+	case "Int8":
+		return reflect.TypeOf(int8(0)), nil
+	case "Int16":
+		return reflect.TypeOf(int16(0)), nil
+	case "Int32":
+		return reflect.TypeOf(int32(0)), nil
+	case "Int64":
+		return reflect.TypeOf(int64(0)), nil
+	case "UInt8":
+		return reflect.TypeOf(uint8(0)), nil
+	case "UInt16":
+		return reflect.TypeOf(uint16(0)), nil
+	case "UInt32":
+		return reflect.TypeOf(uint32(0)), nil
+	case "UInt64":
+		return reflect.TypeOf(uint64(0)), nil
+	case "Float32":
+		return reflect.TypeOf(float32(0)), nil
+	case "Float64":
+		return reflect.TypeOf(float64(0)), nil
+	case "Bool":
+		return reflect.TypeOf(false), nil
+	case "String", "FixedString", "Enum8", "Enum16":
+		return reflect.TypeOf(""), nil
+	case "Date", "Date32", "DateTime", "DateTime64":
+		return timeType, nil
+	case "UUID":
+		return uuidType, nil
+	case "IPv4", "IPv6":
+		return ipType, nil
+	}
+
+	if t.Size() != 0 {
+		return bytesType, nil
+	}
+
+	return nil, errors.New("unsupported type: %v", t)
+}
+
+// Values decodes column into values of its natural type, see GoType.
+func (c Column) Values(rows int) (vals []interface{}, err error) {
+	t, err := c.ColType()
+	if err != nil {
+		return
+	}
+
+	rt, err := GoType(t)
+	if err != nil {
+		return
+	}
+
+	d, err := newDecoder(t, rt)
+	if err != nil {
+		return
+	}
+
+	vals = make([]interface{}, rows)
+
+	if rows == 0 {
+		return vals, nil
+	}
+
+	p := t.prefixLen()
+
+	if len(c.RawData) < p {
+		return nil, c.sizeErr()
+	}
+
+	err = d.init(c.RawData[p:], rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "col %v", c.Name)
+	}
+
+	for i := range vals {
+		x := reflect.New(rt).Elem()
+
+		err = d.decode(i, x)
+		if err != nil {
+			return nil, errors.Wrap(err, "col %v: row %d", c.Name, i)
+		}
+
+		vals[i] = x.Interface()
+	}
+
+	return vals, nil
+}
+
+func NewBlockBuilder(meta QueryMeta) (b *BlockBuilder, err error) {
+	b = &BlockBuilder{
+		meta:  meta,
+		types: make([]reflect.Type, len(meta)),
+		encs:  make([]encoder, len(meta)),
+	}
+
+	for i, c := range meta {
+		t, err := ParseColType(c.Type)
+		if err != nil {
+			return nil, errors.Wrap(err, "col %v", c.Name)
+		}
+
+		b.types[i], err = GoType(t)
+		if err != nil {
+			return nil, errors.Wrap(err, "col %v", c.Name)
+		}
+
+		b.encs[i], err = newEncoder(t, b.types[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "col %v", c.Name)
+		}
+	}
+
+	return b, nil
+}
+
+// Types returns columns natural types.
+func (b *BlockBuilder) Types() []reflect.Type { return b.types }
+
+// Rows returns the number of rows appended.
+func (b *BlockBuilder) Rows() int { return b.rows }
+
+// Append appends one row.
+// nil is NULL for Nullable columns and zero value for others.
+//
+// Row is not appended on error, but the builder must not be used anymore.
+func (b *BlockBuilder) Append(row ...interface{}) (err error) {
+	if len(row) != len(b.encs) {
+		return errors.New("expected %d values, got %d", len(b.encs), len(row))
+	}
+
+	vals := make([]reflect.Value, len(row))
+
+	for i, v := range row {
+		vals[i], err = convertValue(reflect.ValueOf(v), b.types[i])
+		if err != nil {
+			return errors.Wrap(err, "col %v", b.meta[i].Name)
+		}
+	}
+
+	for i, e := range b.encs {
+		err = e.encode(vals[i])
+		if err != nil {
+			return errors.Wrap(err, "col %v", b.meta[i].Name)
+		}
+	}
+
+	b.rows++
+
+	return nil
+}
+
+// Block returns the block with all the appended rows.
+func (b *BlockBuilder) Block() *Block {
+	bl := NewBlock(b.meta)
+	bl.Rows = b.rows
+
+	if b.rows == 0 {
+		return bl
+	}
+
+	for i, e := range b.encs {
+		bl.Cols[i].RawData = e.appendData(e.appendPrefix(nil))
+	}
+
+	return bl
+}
+
+// convertValue converts v to rt.
+// Numbers are converted with overflow checks, pointers are dereferenced or allocated,
+// slices and maps are converted elementwise.
+func convertValue(v reflect.Value, rt reflect.Type) (_ reflect.Value, err error) {
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	if !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return reflect.Zero(rt), nil
+	}
+
+	if v.Type().AssignableTo(rt) {
+		return v, nil
+	}
+
+	if rt.Kind() == reflect.Ptr {
+		x, err := convertValue(v, rt.Elem())
+		if err != nil {
+			return x, err
+		}
+
+		p := reflect.New(rt.Elem())
+		p.Elem().Set(x)
+
+		return p, nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		return convertValue(v.Elem(), rt)
+	}
+
+	r := reflect.New(rt).Elem()
+
+	switch rk, vk := rt.Kind(), v.Kind(); {
+	case isInt(rk) && isInt(vk):
+		if r.OverflowInt(v.Int()) {
+			return r, errors.New("value overflows %v: %v", rt, v)
+		}
+
+		r.SetInt(v.Int())
+	case isInt(rk) && isUint(vk):
+		if v.Uint() > 1<<63-1 || r.OverflowInt(int64(v.Uint())) {
+			return r, errors.New("value overflows %v: %v", rt, v)
+		}
+
+		r.SetInt(int64(v.Uint()))
+	case isUint(rk) && isUint(vk):
+		if r.OverflowUint(v.Uint()) {
+			return r, errors.New("value overflows %v: %v", rt, v)
+		}
+
+		r.SetUint(v.Uint())
+	case isUint(rk) && isInt(vk):
+		if v.Int() < 0 || r.OverflowUint(uint64(v.Int())) {
+			return r, errors.New("value overflows %v: %v", rt, v)
+		}
+
+		r.SetUint(uint64(v.Int()))
+	case isFloat(rk) && isFloat(vk):
+		r.SetFloat(v.Float())
+	case isFloat(rk) && isInt(vk):
+		r.SetFloat(float64(v.Int()))
+	case isFloat(rk) && isUint(vk):
+		r.SetFloat(float64(v.Uint()))
+	case rk == reflect.String && vk == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		r.SetString(string(v.Bytes()))
+	case rk == reflect.Slice && rt.Elem().Kind() == reflect.Uint8 && vk == reflect.String:
+		r.SetBytes([]byte(v.String()))
+	case rk == reflect.Slice && (vk == reflect.Slice || vk == reflect.Array):
+		r.Set(reflect.MakeSlice(rt, v.Len(), v.Len()))
+
+		for i := 0; i < v.Len(); i++ {
+			x, err := convertValue(v.Index(i), rt.Elem())
+			if err != nil {
+				return r, errors.Wrap(err, "index %d", i)
+			}
+
+			r.Index(i).Set(x)
+		}
+	case rk == reflect.Map && vk == reflect.Map:
+		r.Set(reflect.MakeMapWithSize(rt, v.Len()))
+
+		it := v.MapRange()
+
+		for it.Next() {
+			k, err := convertValue(it.Key(), rt.Key())
+			if err != nil {
+				return r, errors.Wrap(err, "key %v", it.Key())
+			}
+
+			x, err := convertValue(it.Value(), rt.Elem())
+			if err != nil {
+				return r, errors.Wrap(err, "key %v", it.Key())
+			}
+
+			r.SetMapIndex(k, x)
+		}
+	case rk == vk && v.Type().ConvertibleTo(rt):
+		r.Set(v.Convert(rt))
+	default:
+		return r, errors.New("can't convert %v to %v", v.Type(), rt)
+	}
+
+	return r, nil
+}
+
+func isInt(k reflect.Kind) bool { return k >= reflect.Int && k <= reflect.Int64 }
+
+func isUint(k reflect.Kind) bool { return k >= reflect.Uint && k <= reflect.Uintptr }
+
+func isFloat(k reflect.Kind) bool { return k == reflect.Float32 || k == reflect.Float64 }
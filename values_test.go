@@ -0,0 +1,62 @@
+package clickhouse
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoType(t *testing.T) {
+	for tp, exp := range map[string]interface{}{
+		"UInt32":                                uint32(0),
+		"LowCardinality(Nullable(String))":      (*string)(nil),
+		"Array(Nullable(Int8))":                 []*int8{},
+		"Map(String, Array(UInt64))":            map[string][]uint64{},
+		"Tuple(String, Int64)":                  []interface{}{},
+		"Decimal(10, 2)":                        []byte{},
+		"Array(LowCardinality(FixedString(2)))": []string{},
+	} {
+		ct, err := ParseColType(tp)
+		require.NoError(t, err, tp)
+
+		rt, err := GoType(ct)
+		require.NoError(t, err, tp)
+		assert.Equal(t, reflect.TypeOf(exp), rt, tp)
+	}
+}
+
+func TestBlockBuilder(t *testing.T) {
+	meta := QueryMeta{
+		{Name: "n", Type: "Nullable(UInt16)"},
+		{Name: "t", Type: "Tuple(String, Int64)"},
+		{Name: "d", Type: "Decimal32(2)"},
+		{Name: "a", Type: "Array(LowCardinality(String))"},
+	}
+
+	bb, err := NewBlockBuilder(meta)
+	require.NoError(t, err)
+
+	require.NoError(t, bb.Append(int64(5), []interface{}{"a", 1}, []byte{1, 0, 0, 0}, []string{"x", "x"}))
+	require.NoError(t, bb.Append(nil, []interface{}{"b", uint8(2)}, []byte{2, 0, 0, 0}, nil))
+
+	assert.Error(t, bb.Append(-1, []interface{}{"c", 3}, []byte{3, 0, 0, 0}, nil))
+	assert.Error(t, bb.Append(1, 2))
+
+	b := bb.Block()
+	assert.Equal(t, 2, b.Rows)
+
+	n5 := uint16(5)
+
+	for i, exp := range [][]interface{}{
+		{&n5, (*uint16)(nil)},
+		{[]interface{}{"a", int64(1)}, []interface{}{"b", int64(2)}},
+		{[]byte{1, 0, 0, 0}, []byte{2, 0, 0, 0}},
+		{[]string{"x", "x"}, []string{}},
+	} {
+		vals, err := b.Cols[i].Values(b.Rows)
+		require.NoError(t, err, meta[i].Name)
+		assert.Equal(t, exp, vals, meta[i].Name)
+	}
+}